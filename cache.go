@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+// The phase cache (cache.dir) keeps the results of the expensive phases
+// under a key that hashes everything they depend on: the content of the
+// input files or matrix, and the phase parameters. A later run that asks
+// for the same phase with the same inputs loads the result instead of
+// computing it, so e.g. a new beta reuses the parsed GTF, the clean
+// expression matrix and the correlation matrix. Entries are never
+// invalidated, only added; -force recomputes every phase and overwrites
+// its entry.
+//
+//	<cache.dir>/gtf/<key>.gob          gene lengths
+//	<cache.dir>/preprocess/<key>.bin   clean expression matrix
+//	<cache.dir>/<kind>/<key>.bin       correlation, adjacency and TOM
+//
+// The .bin entries are ordinary binary matrix files, so a run can also
+// resume from one (see resume.go).
+
+// cacheVersion is part of every key. Bump it when a phase changes its
+// results for the same inputs, which makes every older entry a miss.
+const cacheVersion = 2
+
+// cacheReportFile lists the cache result of every phase of a run.
+const cacheReportFile = "cache_report.csv"
+
+// Cache results of a phase.
+const (
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheForced = "forced"
+)
+
+// phaseCache looks up and stores phase results. A nil *phaseCache is a
+// disabled cache: every method simply computes.
+type phaseCache struct {
+	dir     string
+	force   bool
+	storage wgcna.MatrixStorage
+	// fileHashes memoizes the SHA-256 of the input files.
+	fileHashes map[string]string
+	results    []cacheResult
+}
+
+// cacheResult is one line of the cache report.
+type cacheResult struct {
+	phase, status, key string
+}
+
+// newPhaseCache returns the cache configured in opts, or nil if cache.dir
+// is empty.
+func newPhaseCache(opts pipelineOptions) *phaseCache {
+	if opts.Cache.Dir == "" {
+		return nil
+	}
+	return &phaseCache{
+		dir:        opts.Cache.Dir,
+		force:      opts.Cache.Force,
+		storage:    opts.matrixStorage(),
+		fileHashes: make(map[string]string),
+	}
+}
+
+// geneLengths returns the gene lengths of a GTF file, parsed by compute
+// unless they are cached.
+func (c *phaseCache) geneLengths(gtfPath string, compute func() (map[string]float64, error)) (map[string]float64, error) {
+	if c == nil {
+		return compute()
+	}
+	gtfHash, err := c.fileHash(gtfPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cacheKey(cacheVersion, "gtf", gtfHash)
+	if err != nil {
+		return nil, err
+	}
+	load := func(path string) (map[string]float64, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		var lengths map[string]float64
+		return lengths, gob.NewDecoder(file).Decode(&lengths)
+	}
+	store := func(path string, lengths map[string]float64) error {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := gob.NewEncoder(file).Encode(lengths); err != nil {
+			return err
+		}
+		return file.Close()
+	}
+	return lookupOrCompute(c, "gtf", "gtf", key, ".gob", load, store, compute)
+}
+
+// expression returns the clean expression matrix of the configured GCT,
+// GTF and filters, computed by compute unless it is cached.
+func (c *phaseCache) expression(opts pipelineOptions, compute func() (*wgcna.ExpressionMatrix, error)) (*wgcna.ExpressionMatrix, error) {
+	if c == nil {
+		return compute()
+	}
+	gctHash, err := c.fileHash(opts.Inputs.GCTFile)
+	if err != nil {
+		return nil, err
+	}
+	gtfHash, err := c.fileHash(opts.Inputs.GTFFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cacheKey(cacheVersion, "preprocess", gctHash, gtfHash, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	load := func(path string) (*wgcna.ExpressionMatrix, error) {
+		expr, _, err := wgcna.ReadExpressionMatrix(path)
+		return expr, err
+	}
+	store := func(path string, expr *wgcna.ExpressionMatrix) error {
+		return expr.WriteBinary(path, opts)
+	}
+	return lookupOrCompute(c, "preprocess", "preprocess", key, ".bin", load, store, compute)
+}
+
+// fingerprinter is a matrix whose content can be hashed.
+type fingerprinter interface{ Fingerprint() string }
+
+// network returns a network matrix of the given kind computed from input
+// with params, computed by compute unless it is cached. label names the
+// phase in the report (e.g. "block_2/tom").
+func (c *phaseCache) network(opts *pipelineOptions, kind wgcna.MatrixKind, label string, input fingerprinter, params any,
+	compute func() (*wgcna.NetworkMatrix, error)) (*wgcna.NetworkMatrix, error) {
+	if c == nil {
+		return compute()
+	}
+	key, err := cacheKey(cacheVersion, string(kind), input.Fingerprint(), params)
+	if err != nil {
+		return nil, err
+	}
+	load := func(path string) (*wgcna.NetworkMatrix, error) {
+		m, _, err := wgcna.ReadNetworkMatrix(path, c.storage)
+		return m, err
+	}
+	store := func(path string, m *wgcna.NetworkMatrix) error {
+		return m.WriteBinary(path, kind, opts)
+	}
+	return lookupOrCompute(c, label, string(kind), key, ".bin", load, store, compute)
+}
+
+// lookupOrCompute loads the entry <dir>/<subdir>/<key><ext> if it exists
+// (and -force is not set), and otherwise computes the result and stores
+// it. A corrupt entry is recomputed; failing to store one is only a
+// warning.
+func lookupOrCompute[T any](c *phaseCache, label, subdir, key, ext string, load func(string) (T, error),
+	store func(string, T) error, compute func() (T, error)) (T, error) {
+	path := filepath.Join(c.dir, subdir, key+ext)
+	status := cacheMiss
+	if c.force {
+		status = cacheForced
+	} else if _, err := os.Stat(path); err == nil {
+		v, err := load(path)
+		if err == nil {
+			log.Printf("  (cache) %s: hit, loaded %s", label, path)
+			c.results = append(c.results, cacheResult{label, cacheHit, key})
+			return v, nil
+		}
+		log.Printf("warning: cache entry %s is unreadable, recomputing: %v", path, err)
+	}
+	log.Printf("  (cache) %s: %s", label, status)
+	c.results = append(c.results, cacheResult{label, status, key})
+
+	v, err := compute()
+	if err != nil {
+		return v, err
+	}
+	if err := storeEntry(path, func(tmp string) error { return store(tmp, v) }); err != nil {
+		log.Printf("warning: failed to store cache entry %s: %v", path, err)
+	}
+	return v, nil
+}
+
+// storeEntry lets store write an entry to a temporary file, then renames
+// it into place, so an interrupted run never leaves a truncated entry.
+func storeEntry(path string, store func(tmp string) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	file.Close()
+	defer os.Remove(tmp)
+	if err := store(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// fileHash returns the SHA-256 of a file's content.
+func (c *phaseCache) fileHash(path string) (string, error) {
+	if h, ok := c.fileHashes[path]; ok {
+		return h, nil
+	}
+	h, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	c.fileHashes[path] = h
+	return h, nil
+}
+
+// hashFile returns the hex SHA-256 of a file's content.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheKey hashes the cache version (cacheVersion outside tests) and the
+// JSON encoding of parts. parts that do not encode, such as a NaN
+// parameter, are an error.
+func cacheKey(version int, parts ...any) (string, error) {
+	data, err := json.Marshal(append([]any{version}, parts...))
+	if err != nil {
+		return "", fmt.Errorf("failed to compute the cache key: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// report logs a summary of the cache results and writes them to path.
+func (c *phaseCache) report(path string) error {
+	if c == nil {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, r := range c.results {
+		counts[r.status]++
+	}
+	log.Printf("Cache: %d hits, %d misses, %d forced (details in %s)",
+		counts[cacheHit], counts[cacheMiss], counts[cacheForced], path)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write([]string{"phase", "result", "key"})
+	for _, r := range c.results {
+		w.Write([]string{r.phase, r.status, r.key})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+func TestCacheKey(t *testing.T) {
+	opts := defaultPipelineOptions()
+	expr := &wgcna.ExpressionMatrix{Genes: []string{"A", "B"}, Samples: []string{"S1", "S2"}, Data: [][]float64{{1, 2}, {3, 4}}}
+	key := func(version int, expr *wgcna.ExpressionMatrix, params any) string {
+		t.Helper()
+		k, err := cacheKey(version, string(wgcna.KindCorrelation), expr.Fingerprint(), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	base := key(cacheVersion, expr, opts.Correlation)
+
+	// Equal inputs in other values give the same key.
+	same := &wgcna.ExpressionMatrix{Genes: []string{"A", "B"}, Samples: []string{"S1", "S2"}, Data: [][]float64{{1, 2}, {3, 4}}}
+	if got := key(cacheVersion, same, defaultPipelineOptions().Correlation); got != base {
+		t.Errorf("equal inputs: key %s, want %s", got, base)
+	}
+
+	changedValue := &wgcna.ExpressionMatrix{Genes: same.Genes, Samples: same.Samples, Data: [][]float64{{1, 2}, {3, 4.5}}}
+	spearman := opts.Correlation
+	spearman.Method = string(wgcna.Spearman)
+	for name, got := range map[string]string{
+		"input content": key(cacheVersion, changedValue, opts.Correlation),
+		"parameter":     key(cacheVersion, expr, spearman),
+		"cache version": key(cacheVersion+1, expr, opts.Correlation),
+	} {
+		if got == base {
+			t.Errorf("changed %s: same key %s", name, got)
+		}
+	}
+
+	if _, err := cacheKey(cacheVersion, "adjacency", math.NaN()); err == nil {
+		t.Error("no error for a NaN parameter")
+	}
+}
+
+func TestPhaseCacheNetwork(t *testing.T) {
+	opts := defaultPipelineOptions()
+	opts.Cache.Dir = t.TempDir()
+	expr := &wgcna.ExpressionMatrix{Genes: []string{"A", "B"}, Samples: []string{"S1", "S2"}, Data: [][]float64{{1, 2}, {3, 4}}}
+
+	// compute returns a matrix whose off-diagonal value is the number of
+	// times it was called.
+	calls := 0
+	compute := func() (*wgcna.NetworkMatrix, error) {
+		calls++
+		m := wgcna.NewNetworkMatrix(expr.Genes)
+		m.Set(0, 1, float64(calls))
+		return m, nil
+	}
+	run := func(c *phaseCache, params any) float64 {
+		t.Helper()
+		m, err := c.network(&opts, wgcna.KindCorrelation, "correlation", expr, params, compute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.At(0, 1)
+	}
+
+	c := newPhaseCache(opts)
+	if got := run(c, "pearson"); got != 1 || calls != 1 {
+		t.Fatalf("first run: value %v after %d calls", got, calls)
+	}
+	if got := run(c, "pearson"); got != 1 || calls != 1 {
+		t.Errorf("same inputs: value %v after %d calls, want the cached 1", got, calls)
+	}
+	if got := run(c, "spearman"); got != 2 || calls != 2 {
+		t.Errorf("other parameters: value %v after %d calls, want a new 2", got, calls)
+	}
+
+	// -force recomputes and overwrites the entry.
+	_, forceOpts, err := parseCommand([]string{"tom", "-cache-dir", opts.Cache.Dir, "-force"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forced := newPhaseCache(forceOpts)
+	if got := run(forced, "pearson"); got != 3 || calls != 3 {
+		t.Errorf("-force: value %v after %d calls, want a new 3", got, calls)
+	}
+	if got := run(newPhaseCache(opts), "pearson"); got != 3 || calls != 3 {
+		t.Errorf("after -force: value %v after %d calls, want the stored 3", got, calls)
+	}
+
+	var statuses []string
+	for _, r := range append(c.results, forced.results...) {
+		statuses = append(statuses, r.status)
+	}
+	if want := []string{cacheMiss, cacheHit, cacheMiss, cacheForced}; !slices.Equal(statuses, want) {
+		t.Errorf("cache results %v, want %v", statuses, want)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(opts.Cache.Dir, string(wgcna.KindCorrelation)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("%d correlation entries, want 2 (no temporary files)", len(entries))
+	}
+}
+
+func TestPhaseCacheCorruptEntry(t *testing.T) {
+	// An unreadable entry is recomputed and replaced.
+	dir := t.TempDir()
+	gtf := filepath.Join(dir, "genes.gtf")
+	if err := os.WriteFile(gtf, []byte("any content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultPipelineOptions()
+	opts.Cache.Dir = filepath.Join(dir, "cache")
+	calls := 0
+	compute := func() (map[string]float64, error) {
+		calls++
+		return map[string]float64{"G1": 1.5}, nil
+	}
+	c := newPhaseCache(opts)
+	if _, err := c.geneLengths(gtf, compute); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := filepath.Glob(filepath.Join(opts.Cache.Dir, "gtf", "*.gob"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("gtf entries %v (%v)", matches, err)
+	}
+	if err := os.WriteFile(matches[0], []byte("not gob"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for run := 1; run <= 2; run++ {
+		lengths, err := c.geneLengths(gtf, compute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lengths["G1"] != 1.5 || calls != 2 {
+			t.Errorf("run %d after corrupting the entry: %v after %d calls, want 2 calls", run, lengths, calls)
+		}
+	}
+}
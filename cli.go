@@ -0,0 +1,615 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+// pipelinePhase identifies how far a command runs the pipeline.
+// Every phase depends on the one before it, so a command simply
+// stops after its phase.
+type pipelinePhase int
+
+const (
+	phasePreprocess pipelinePhase = iota + 1
+	phaseCorrelate
+	phaseSoftThreshold
+	phaseAdjacency
+	phaseTOM
+	phaseDissim
+	phaseCluster
+	phaseModules
+	phaseEigengenes
+	phaseMerge
+	phaseMembership
+	phaseHubs
+)
+
+// commandPhases maps every subcommand to the last phase it runs.
+var commandPhases = map[string]pipelinePhase{
+	"preprocess":     phasePreprocess,
+	"correlate":      phaseCorrelate,
+	"soft-threshold": phaseSoftThreshold,
+	"adjacency":      phaseAdjacency,
+	"tom":            phaseTOM,
+	"dissim":         phaseDissim,
+	"cluster":        phaseCluster,
+	"modules":        phaseModules,
+	"eigengenes":     phaseEigengenes,
+	"merge":          phaseMerge,
+	"kme":            phaseMembership,
+	"hubs":           phaseHubs,
+	"run-all":        phaseHubs,
+}
+
+// commandOrder is the order used when printing usage.
+var commandOrder = []string{"preprocess", "correlate", "soft-threshold", "adjacency", "tom", "dissim", "cluster", "modules", "eigengenes", "merge", "kme", "hubs", "run-all"}
+
+// pipelineOptions holds everything that used to be a compile-time constant.
+// It is filled from defaults, then a run configuration file (see config.go),
+// then command-line flags, and it is written back out as run_config.json.
+type pipelineOptions struct {
+	Inputs      inputOptions       `json:"inputs"`
+	Output      outputOptions      `json:"output"`
+	Filter      filterOptions      `json:"filter"`
+	Correlation correlationOptions `json:"correlation"`
+	Network     networkOptions     `json:"network"`
+	Blocks      blockOptions       `json:"blocks"`
+	Clustering  clusteringOptions  `json:"clustering"`
+	TreeCut     treeCutOptions     `json:"tree_cut"`
+	Eigengenes  eigengeneOptions   `json:"eigengenes"`
+	Merge       mergeOptions       `json:"merge"`
+	Hubs        hubOptions         `json:"hubs"`
+	Cache       cacheOptions       `json:"cache"`
+
+	// cache is the phase cache opened from Cache (nil when disabled).
+	cache *phaseCache
+	// manifest records the run for manifest.json (nil outside a run).
+	manifest *runManifest
+	// blockLabels receives the Phase 7 module labels of every block
+	// directory in block mode, for runBlockwise to merge.
+	blockLabels map[string][]int
+	// blocks holds the genes of every block in block mode, whose
+	// adjacency matrices give the connectivity of Phase 10.
+	blocks [][]int
+	// adjacency is the Phase 3 adjacency matrix, kept open for the
+	// connectivity of Phase 10 by a run without blocks.
+	adjacency *wgcna.NetworkMatrix
+}
+
+type inputOptions struct {
+	GCTFile string `json:"gct"`
+	GTFFile string `json:"gtf"`
+	// ResumeFrom is a saved matrix (expression, correlation, adjacency, TOM
+	// or dissimilarity, as .bin or .csv) to start from instead of the GCT
+	// and GTF.
+	ResumeFrom string `json:"resume_from,omitempty"`
+}
+
+type outputOptions struct {
+	Dir             string   `json:"dir"`
+	CleanMatrixFile string   `json:"clean_matrix"`
+	Formats         []string `json:"formats"`
+	// MatrixFormats overrides Formats for single matrices, keyed by
+	// expression, correlation, adjacency, tom or dissimilarity.
+	MatrixFormats map[string][]string `json:"matrix_formats,omitempty"`
+}
+
+type filterOptions struct {
+	LowExpressionThreshold float64 `json:"low_expression_threshold"`
+	LowVariancePercentile  float64 `json:"low_variance_percentile"`
+}
+
+type correlationOptions struct {
+	Method          string  `json:"method"`
+	MaxPOutliers    float64 `json:"max_p_outliers"`
+	PearsonFallback string  `json:"pearson_fallback"`
+}
+
+type networkOptions struct {
+	Type          string  `json:"type"`
+	SoftPowerBeta float64 `json:"beta"`
+	// AutoBeta replaces SoftPowerBeta by the lowest candidate power whose
+	// signed scale-free fit R^2 reaches TargetRSquared.
+	AutoBeta        bool      `json:"auto_beta"`
+	TargetRSquared  float64   `json:"target_r_squared"`
+	CandidatePowers []float64 `json:"candidate_powers"`
+	// TOMType is unsigned or signed; the signed TOM of an unsigned network
+	// keeps the signs of the correlations (see wgcna.TOMOptions).
+	TOMType string `json:"tom_type"`
+	// Precision is the storage precision of the correlation, adjacency,
+	// TOM and dissimilarity matrices: float64 or float32.
+	Precision string `json:"precision"`
+	// MemoryBudgetGB caps the RAM used by those matrices; a matrix that
+	// does not fit is memory-mapped to a file in SpillDir. 0 means no limit.
+	MemoryBudgetGB float64 `json:"memory_budget_gb"`
+	// SpillDir defaults to the output directory.
+	SpillDir string `json:"spill_dir"`
+}
+
+// blockOptions enables block mode (see runBlockwise) when MaxBlockSize > 0.
+type blockOptions struct {
+	MaxBlockSize int `json:"max_block_size"`
+	// PreclusteringCenters is the number of k-means centres; 0 picks
+	// min(n/20, 100*n/max_block_size) like blockwiseModules.
+	PreclusteringCenters int   `json:"preclustering_centers"`
+	Seed                 int64 `json:"seed"`
+}
+
+// clusteringOptions controls the gene dendrogram built from the
+// dissimilarity matrix.
+type clusteringOptions struct {
+	// Linkage is average, complete, single or ward.D2, as in R's hclust.
+	Linkage string `json:"linkage"`
+}
+
+// treeCutOptions controls the Dynamic Tree Cut of the gene dendrogram,
+// with the argument names of R's cutreeDynamic.
+type treeCutOptions struct {
+	Method         string `json:"method"`
+	DeepSplit      int    `json:"deep_split"`
+	MinClusterSize int    `json:"min_cluster_size"`
+	// CutHeight is the largest joining height considered; 0 picks the
+	// default of the method.
+	CutHeight         float64 `json:"cut_height"`
+	PAMStage          bool    `json:"pam_stage"`
+	PAMRespectsDendro bool    `json:"pam_respects_dendro"`
+}
+
+// eigengeneOptions controls the module eigengenes.
+type eigengeneOptions struct {
+	// ExcludeGrey leaves out the eigengene of the genes in no module.
+	ExcludeGrey bool `json:"exclude_grey"`
+}
+
+// mergeOptions controls the merging of modules with similar eigengenes.
+type mergeOptions struct {
+	// CutHeight is the largest eigengene dissimilarity (1 - correlation)
+	// at which modules are merged.
+	CutHeight float64 `json:"cut_height"`
+}
+
+// hubOptions controls the selection of hub genes.
+type hubOptions struct {
+	// Ranking is kme, kwithin or combined.
+	Ranking string `json:"ranking"`
+	// TopN is the number of hub genes per module; 0 keeps them all.
+	TopN int `json:"top_n"`
+	// MinKME and MinGS are the kME and |gene significance| a hub gene must
+	// exceed; 0 means no threshold.
+	MinKME float64 `json:"min_kme"`
+	MinGS  float64 `json:"min_gs"`
+	// Traits is a sample x trait CSV, and Trait the column the gene
+	// significance is computed for (may be empty if there is only one).
+	Traits string `json:"traits"`
+	Trait  string `json:"trait"`
+}
+
+// cacheOptions enables the phase cache (see cache.go) when Dir is set.
+type cacheOptions struct {
+	Dir string `json:"dir"`
+	// Force recomputes every phase and overwrites its cache entry. It is a
+	// choice of this run, so it is not part of run configuration files.
+	Force bool `json:"-"`
+}
+
+// defaultPipelineOptions returns the options the pipeline used before it had a CLI.
+func defaultPipelineOptions() pipelineOptions {
+	return pipelineOptions{
+		Inputs: inputOptions{
+			GCTFile: gctDataFile,
+			GTFFile: gtfAnnotationFile,
+		},
+		Output: outputOptions{
+			Dir:             ".",
+			CleanMatrixFile: outputMatrixFile,
+			Formats:         []string{"csv"},
+		},
+		Filter: filterOptions{
+			LowExpressionThreshold: lowExpressionThreshold,
+			LowVariancePercentile:  lowVariancePercentile,
+		},
+		Correlation: correlationOptions{
+			Method:          string(wgcna.Pearson),
+			MaxPOutliers:    1,
+			PearsonFallback: string(wgcna.FallbackIndividual),
+		},
+		Network: networkOptions{
+			Type:            defaultNetworkType,
+			SoftPowerBeta:   softPowerBeta,
+			TargetRSquared:  defaultTargetRSquared,
+			CandidatePowers: append([]float64(nil), wgcna.DefaultSoftThresholdPowers...),
+			TOMType:         string(wgcna.UnsignedTOM),
+			Precision:       string(wgcna.Float64),
+		},
+		Clustering: clusteringOptions{
+			Linkage: string(wgcna.AverageLinkage),
+		},
+		TreeCut: defaultTreeCutOptions(),
+		Merge: mergeOptions{
+			CutHeight: wgcna.DefaultMergeOptions().CutHeight,
+		},
+		Hubs: hubOptions{
+			Ranking: string(wgcna.DefaultHubOptions().Ranking),
+			TopN:    wgcna.DefaultHubOptions().TopN,
+		},
+	}
+}
+
+// defaultTreeCutOptions returns the Dynamic Tree Cut settings of the Shiny app.
+func defaultTreeCutOptions() treeCutOptions {
+	def := wgcna.DefaultTreeCutOptions()
+	return treeCutOptions{
+		Method:            string(def.Method),
+		DeepSplit:         def.DeepSplit,
+		MinClusterSize:    def.MinClusterSize,
+		PAMStage:          def.PAMStage,
+		PAMRespectsDendro: def.PAMRespectsDendro,
+	}
+}
+
+// parseCommand reads the subcommand and its flags from args (without the program name).
+// It returns the last phase to run and the resolved options.
+// Flags given explicitly on the command line override values from -config.
+func parseCommand(args []string, stderr io.Writer) (pipelinePhase, pipelineOptions, error) {
+	opts := defaultPipelineOptions()
+	if len(args) == 0 {
+		printUsage(stderr)
+		return 0, opts, errors.New("no command given")
+	}
+
+	command := args[0]
+	if command == "help" || command == "-h" || command == "--help" {
+		printUsage(stderr)
+		return 0, opts, flag.ErrHelp
+	}
+	phase, ok := commandPhases[command]
+	if !ok {
+		printUsage(stderr)
+		return 0, opts, fmt.Errorf("unknown command %q", command)
+	}
+
+	var configPath string
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&configPath, "config", "", "run configuration file (.yaml, .yml or .json); flags override it")
+	registerPipelineFlags(fs, &opts)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: wgcna %s [flags]\n\nFlags:\n", command)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 0, opts, err
+	}
+	if fs.NArg() > 0 {
+		return 0, opts, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if configPath != "" {
+		fromFile, err := loadRunConfig(configPath, defaultPipelineOptions())
+		if err != nil {
+			return 0, opts, err
+		}
+		// Re-apply the flags that were set explicitly on top of the file.
+		override := flag.NewFlagSet(command, flag.ContinueOnError)
+		registerPipelineFlags(override, &fromFile)
+		var setErr error
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "config" || setErr != nil {
+				return
+			}
+			setErr = override.Set(f.Name, f.Value.String())
+		})
+		if setErr != nil {
+			return 0, opts, setErr
+		}
+		opts = fromFile
+	}
+	return phase, opts, nil
+}
+
+// registerPipelineFlags binds the pipeline options to a flag set.
+func registerPipelineFlags(fs *flag.FlagSet, opts *pipelineOptions) {
+	fs.StringVar(&opts.Inputs.GCTFile, "gct", opts.Inputs.GCTFile, "GCT raw read count file (.gct.gz)")
+	fs.StringVar(&opts.Inputs.GTFFile, "gtf", opts.Inputs.GTFFile, "GTF annotation file used for gene lengths (.gtf.gz)")
+	fs.StringVar(&opts.Inputs.ResumeFrom, "resume-from", opts.Inputs.ResumeFrom,
+		"saved clean expression, correlation, adjacency, TOM or dissimilarity matrix (.bin or .csv) to resume from")
+	fs.StringVar(&opts.Output.Dir, "out", opts.Output.Dir, "directory that receives all output files")
+	fs.StringVar(&opts.Output.CleanMatrixFile, "clean-matrix", opts.Output.CleanMatrixFile, "file name of the cleaned expression matrix inside -out")
+	fs.Var((*stringListFlag)(&opts.Output.Formats), "formats", "comma-separated output formats for the matrices: csv, bin, npy, npz, rmat")
+	fs.Var((*formatMapFlag)(&opts.Output.MatrixFormats), "matrix-formats",
+		"per-matrix formats overriding -formats, e.g. dissimilarity=csv+npz,tom=bin")
+	fs.Float64Var(&opts.Filter.LowExpressionThreshold, "low-expr", opts.Filter.LowExpressionThreshold,
+		"drop a gene if this fraction of samples has log2(TPM+1) < 1")
+	fs.Float64Var(&opts.Filter.LowVariancePercentile, "low-var", opts.Filter.LowVariancePercentile,
+		"drop this lower fraction of genes ranked by variance")
+	fs.StringVar(&opts.Correlation.Method, "cor-method", opts.Correlation.Method, "correlation method: pearson, bicor, spearman or kendall")
+	fs.Float64Var(&opts.Correlation.MaxPOutliers, "max-p-outliers", opts.Correlation.MaxPOutliers,
+		"bicor only: largest fraction of samples on each side of the median treated as outliers")
+	fs.StringVar(&opts.Correlation.PearsonFallback, "pearson-fallback", opts.Correlation.PearsonFallback,
+		"bicor only: what to do for genes with zero MAD: individual or none")
+	fs.StringVar(&opts.Network.Type, "network-type", opts.Network.Type, "adjacency network type: unsigned, signed or \"signed hybrid\"")
+	fs.Float64Var(&opts.Network.SoftPowerBeta, "beta", opts.Network.SoftPowerBeta, "soft-thresholding power for the adjacency matrix")
+	fs.BoolVar(&opts.Network.AutoBeta, "auto-beta", opts.Network.AutoBeta, "pick beta from the scale-free topology fit instead of using -beta")
+	fs.Float64Var(&opts.Network.TargetRSquared, "target-r2", opts.Network.TargetRSquared, "signed scale-free fit R^2 that -auto-beta must reach")
+	fs.Var((*floatListFlag)(&opts.Network.CandidatePowers), "powers", "comma-separated candidate powers for soft-threshold / -auto-beta")
+	fs.StringVar(&opts.Network.TOMType, "tom-type", opts.Network.TOMType, "topological overlap type: unsigned or signed")
+	fs.StringVar(&opts.Network.Precision, "precision", opts.Network.Precision,
+		"storage precision of the network matrices: float64, or float32 for half the memory")
+	fs.Float64Var(&opts.Network.MemoryBudgetGB, "memory-budget", opts.Network.MemoryBudgetGB,
+		"GB of RAM for the network matrices; larger ones are memory-mapped to disk (0 = no limit)")
+	fs.StringVar(&opts.Network.SpillDir, "spill-dir", opts.Network.SpillDir,
+		"directory for the files of disk-backed matrices (default: the output directory)")
+	fs.IntVar(&opts.Blocks.MaxBlockSize, "max-block-size", opts.Blocks.MaxBlockSize,
+		"split the genes into blocks of at most this many co-expressed genes (0 = one network of all genes)")
+	fs.IntVar(&opts.Blocks.PreclusteringCenters, "block-centers", opts.Blocks.PreclusteringCenters,
+		"number of k-means centres used to form the blocks (0 = automatic)")
+	fs.Int64Var(&opts.Blocks.Seed, "block-seed", opts.Blocks.Seed, "random seed of the block pre-clustering")
+	fs.StringVar(&opts.Clustering.Linkage, "linkage", opts.Clustering.Linkage,
+		"hierarchical clustering linkage: average, complete, single or ward.D2")
+	fs.StringVar(&opts.TreeCut.Method, "cut-method", opts.TreeCut.Method, "Dynamic Tree Cut method: hybrid or tree")
+	fs.IntVar(&opts.TreeCut.DeepSplit, "deep-split", opts.TreeCut.DeepSplit, "Dynamic Tree Cut sensitivity to splitting, 0 to 4")
+	fs.IntVar(&opts.TreeCut.MinClusterSize, "min-module-size", opts.TreeCut.MinClusterSize, "smallest module Dynamic Tree Cut reports")
+	fs.Float64Var(&opts.TreeCut.CutHeight, "cut-height", opts.TreeCut.CutHeight,
+		"largest joining height Dynamic Tree Cut considers (0 = the method's default)")
+	fs.BoolVar(&opts.TreeCut.PAMStage, "pam-stage", opts.TreeCut.PAMStage,
+		"hybrid only: assign genes outside the modules to the nearest module if close enough")
+	fs.BoolVar(&opts.TreeCut.PAMRespectsDendro, "pam-respects-dendro", opts.TreeCut.PAMRespectsDendro,
+		"hybrid only: restrict the PAM stage to modules on the same branch")
+	fs.BoolVar(&opts.Eigengenes.ExcludeGrey, "exclude-grey", opts.Eigengenes.ExcludeGrey,
+		"leave out the eigengene of the genes in no module (module 0)")
+	fs.Float64Var(&opts.Merge.CutHeight, "merge-cut-height", opts.Merge.CutHeight,
+		"merge modules whose eigengenes have a dissimilarity (1 - correlation) of at most this")
+	fs.StringVar(&opts.Hubs.Ranking, "hub-ranking", opts.Hubs.Ranking, "rank the hub genes of a module by kme, kwithin or combined")
+	fs.IntVar(&opts.Hubs.TopN, "top-hubs", opts.Hubs.TopN, "number of hub genes per module (0 = every gene passing the thresholds)")
+	fs.Float64Var(&opts.Hubs.MinKME, "min-kme", opts.Hubs.MinKME, "hub genes need a kME with their module above this (0 = no threshold)")
+	fs.Float64Var(&opts.Hubs.MinGS, "min-gs", opts.Hubs.MinGS,
+		"hub genes need an absolute gene significance above this (0 = no threshold; needs -traits)")
+	fs.StringVar(&opts.Hubs.Traits, "traits", opts.Hubs.Traits, "sample x trait CSV for the gene significance of the hub genes")
+	fs.StringVar(&opts.Hubs.Trait, "trait", opts.Hubs.Trait, "trait column of -traits to compute the gene significance for")
+	fs.StringVar(&opts.Cache.Dir, "cache-dir", opts.Cache.Dir,
+		"directory caching the results of each phase by input and parameter hashes (empty = no cache)")
+	fs.BoolVar(&opts.Cache.Force, "force", opts.Cache.Force, "recompute every phase even if it is cached, and refresh the cache")
+}
+
+// stringListFlag is a comma-separated flag value such as "csv,npy".
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*s = append(*s, item)
+		}
+	}
+	return nil
+}
+
+// formatMapFlag is a list of matrix=format+format entries such as
+// "dissimilarity=csv+npz,tom=bin".
+type formatMapFlag map[string][]string
+
+func (f *formatMapFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	kinds := make([]string, 0, len(*f))
+	for kind := range *f {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	entries := make([]string, len(kinds))
+	for i, kind := range kinds {
+		entries[i] = kind + "=" + strings.Join((*f)[kind], "+")
+	}
+	return strings.Join(entries, ",")
+}
+
+func (f *formatMapFlag) Set(value string) error {
+	*f = make(map[string][]string)
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		kind, formats, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid entry %q (want matrix=format+format)", entry)
+		}
+		var list []string
+		for _, format := range strings.Split(formats, "+") {
+			if format = strings.TrimSpace(format); format != "" {
+				list = append(list, format)
+			}
+		}
+		(*f)[strings.TrimSpace(kind)] = list
+	}
+	return nil
+}
+
+// floatListFlag is a comma-separated list of numbers such as "1,2,3,4".
+type floatListFlag []float64
+
+func (f *floatListFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	items := make([]string, len(*f))
+	for i, v := range *f {
+		items[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(items, ",")
+}
+
+func (f *floatListFlag) Set(value string) error {
+	*f = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", item)
+		}
+		*f = append(*f, v)
+	}
+	return nil
+}
+
+// printUsage prints the top-level help.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: wgcna <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands (each runs the pipeline up to and including its phase):")
+	descriptions := map[string]string{
+		"preprocess":     "parse GTF, normalize and filter the GCT, write the clean matrix",
+		"correlate":      "... and compute the correlation matrix",
+		"soft-threshold": "... and write the scale-free fit table for candidate powers",
+		"adjacency":      "... and apply soft thresholding",
+		"tom":            "... and compute the topological overlap matrix",
+		"dissim":         "... and compute the dissimilarity matrix",
+		"cluster":        "... and build the gene dendrogram (hierarchical clustering)",
+		"modules":        "... and detect modules with Dynamic Tree Cut",
+		"eigengenes":     "... and compute the module eigengenes",
+		"merge":          "... and merge modules with similar eigengenes",
+		"kme":            "... and write the module membership (kME) and connectivity table",
+		"hubs":           "... and pick the hub genes of every module",
+		"run-all":        "run every phase (same as hubs)",
+	}
+	for _, name := range commandOrder {
+		fmt.Fprintf(w, "  %-15s %s\n", name, descriptions[name])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'wgcna <command> -h' to list the flags of a command.")
+}
+
+// filterOptions converts the Phase 1 options for the wgcna package.
+func (o pipelineOptions) filterOptions() wgcna.FilterOptions {
+	return wgcna.FilterOptions{
+		LowExpressionThreshold: o.Filter.LowExpressionThreshold,
+		LowVariancePercentile:  o.Filter.LowVariancePercentile,
+	}
+}
+
+// correlationOptions converts the Phase 2 options for the wgcna package.
+func (o pipelineOptions) correlationOptions() wgcna.CorrelationOptions {
+	return wgcna.CorrelationOptions{
+		Method:          wgcna.CorrelationMethod(o.Correlation.Method),
+		MaxPOutliers:    o.Correlation.MaxPOutliers,
+		PearsonFallback: wgcna.PearsonFallback(o.Correlation.PearsonFallback),
+		Precision:       wgcna.Precision(o.Network.Precision),
+		Storage:         o.matrixStorage(),
+	}
+}
+
+// matrixStorage converts the memory budget for the wgcna package.
+func (o pipelineOptions) matrixStorage() wgcna.MatrixStorage {
+	dir := o.Network.SpillDir
+	if dir == "" {
+		dir = o.Output.Dir
+	}
+	return wgcna.MatrixStorage{MemoryBudget: int64(o.Network.MemoryBudgetGB * 1e9), Dir: dir}
+}
+
+// adjacencyOptions converts the Phase 3 options for the wgcna package.
+func (o pipelineOptions) adjacencyOptions() wgcna.AdjacencyOptions {
+	return wgcna.AdjacencyOptions{
+		Type: wgcna.NetworkType(o.Network.Type),
+		Beta: o.Network.SoftPowerBeta,
+	}
+}
+
+// tomOptions converts the TOM options for the wgcna package. corr is the
+// correlation matrix of the adjacency, which only the signed TOM of an
+// unsigned network uses.
+func (o pipelineOptions) tomOptions(corr *wgcna.NetworkMatrix) wgcna.TOMOptions {
+	opts := wgcna.TOMOptions{Type: wgcna.TOMType(o.Network.TOMType)}
+	if o.tomNeedsCorrelation() {
+		opts.Correlation = corr
+	}
+	return opts
+}
+
+// tomNeedsCorrelation reports whether the TOM takes the signs of the
+// adjacencies from the correlation matrix.
+func (o pipelineOptions) tomNeedsCorrelation() bool {
+	return wgcna.TOMType(o.Network.TOMType) == wgcna.SignedTOM && wgcna.NetworkType(o.Network.Type) == wgcna.Unsigned
+}
+
+// softThresholdOptions converts the soft-threshold options for the wgcna package.
+func (o pipelineOptions) softThresholdOptions() wgcna.SoftThresholdOptions {
+	return wgcna.SoftThresholdOptions{
+		Powers: o.Network.CandidatePowers,
+		Type:   wgcna.NetworkType(o.Network.Type),
+	}
+}
+
+// blockOptions converts the block mode options for the wgcna package.
+func (o pipelineOptions) blockOptions() wgcna.BlockOptions {
+	return wgcna.BlockOptions{
+		MaxBlockSize: o.Blocks.MaxBlockSize,
+		NumCenters:   o.Blocks.PreclusteringCenters,
+		Type:         wgcna.NetworkType(o.Network.Type),
+		Seed:         o.Blocks.Seed,
+	}
+}
+
+// treeCutOptions converts the Dynamic Tree Cut options for the wgcna package.
+func (o pipelineOptions) treeCutOptions() wgcna.TreeCutOptions {
+	return wgcna.TreeCutOptions{
+		Method:            wgcna.TreeCutMethod(o.TreeCut.Method),
+		DeepSplit:         o.TreeCut.DeepSplit,
+		MinClusterSize:    o.TreeCut.MinClusterSize,
+		CutHeight:         o.TreeCut.CutHeight,
+		PAMStage:          o.TreeCut.PAMStage,
+		PAMRespectsDendro: o.TreeCut.PAMRespectsDendro,
+	}
+}
+
+// eigengeneOptions converts the module eigengene options for the wgcna package.
+func (o pipelineOptions) eigengeneOptions() wgcna.EigengeneOptions {
+	return wgcna.EigengeneOptions{ExcludeGrey: o.Eigengenes.ExcludeGrey}
+}
+
+// mergeOptions converts the module merging options for the wgcna package.
+func (o pipelineOptions) mergeOptions() wgcna.MergeOptions {
+	return wgcna.MergeOptions{CutHeight: o.Merge.CutHeight}
+}
+
+// hubOptions converts the hub gene options for the wgcna package.
+func (o pipelineOptions) hubOptions() wgcna.HubOptions {
+	return wgcna.HubOptions{
+		Ranking: wgcna.HubRanking(o.Hubs.Ranking),
+		TopN:    o.Hubs.TopN,
+		MinKME:  o.Hubs.MinKME,
+		MinGS:   o.Hubs.MinGS,
+	}
+}
+
+// phaseLabel names a phase whose matrices are written into dir, prefixed
+// with the block directory in block mode (e.g. "block_2/tom").
+func (o pipelineOptions) phaseLabel(dir, phase string) string {
+	if rel, err := filepath.Rel(o.Output.Dir, dir); err == nil && rel != "." {
+		return filepath.ToSlash(filepath.Join(rel, phase))
+	}
+	return phase
+}
+
+// outputPath places a file name inside the output directory.
+func (o pipelineOptions) outputPath(name string) string {
+	return filepath.Join(o.Output.Dir, name)
+}
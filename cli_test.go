@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandDispatch(t *testing.T) {
+	if len(commandOrder) != len(commandPhases) {
+		t.Errorf("%d commands in the usage, %d with a phase", len(commandOrder), len(commandPhases))
+	}
+	want := map[string]pipelinePhase{
+		"preprocess": phasePreprocess, "correlate": phaseCorrelate, "soft-threshold": phaseSoftThreshold,
+		"adjacency": phaseAdjacency, "tom": phaseTOM, "dissim": phaseDissim, "cluster": phaseCluster,
+		"modules": phaseModules, "eigengenes": phaseEigengenes, "merge": phaseMerge, "kme": phaseMembership,
+		"hubs": phaseHubs, "run-all": phaseHubs,
+	}
+	for _, command := range commandOrder {
+		phase, opts, err := parseCommand([]string{command, "-out", "results"}, io.Discard)
+		if err != nil {
+			t.Errorf("%s: %v", command, err)
+			continue
+		}
+		if phase != want[command] {
+			t.Errorf("%s runs up to phase %d, want %d", command, phase, want[command])
+		}
+		if opts.Output.Dir != "results" {
+			t.Errorf("%s: -out gave %q", command, opts.Output.Dir)
+		}
+	}
+
+	var usage bytes.Buffer
+	for _, help := range []string{"help", "-h", "--help"} {
+		usage.Reset()
+		if _, _, err := parseCommand([]string{help}, &usage); !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("%s: error %v, want flag.ErrHelp", help, err)
+		}
+		for _, command := range commandOrder {
+			if !strings.Contains(usage.String(), "  "+command+" ") {
+				t.Errorf("%s: the usage does not list %s", help, command)
+			}
+		}
+	}
+
+	for name, args := range map[string][]string{
+		"no command":      nil,
+		"unknown command": {"cluster-all"},
+		"unknown flag":    {"tom", "-betta", "6"},
+		"invalid value":   {"tom", "-beta", "six"},
+		"extra argument":  {"tom", "-beta", "6", "results"},
+		"missing config":  {"tom", "-config", "missing.yaml"},
+	} {
+		if _, _, err := parseCommand(args, io.Discard); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestParseCommandConfigAndFlags(t *testing.T) {
+	// Flags given explicitly override the configuration file; the others
+	// keep its values, not the defaults.
+	path := filepath.Join(t.TempDir(), "run.yaml")
+	config := "network:\n  beta: 8\n  type: unsigned\noutput:\n  formats: [bin, npz]\ntree_cut:\n  deep_split: 1\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, opts, err := parseCommand([]string{"modules", "-beta", "10", "-config", path, "-deep-split", "3"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Network.SoftPowerBeta != 10 || opts.TreeCut.DeepSplit != 3 {
+		t.Errorf("flags: beta %v, deep split %d, want 10 and 3", opts.Network.SoftPowerBeta, opts.TreeCut.DeepSplit)
+	}
+	if opts.Network.Type != "unsigned" || !slices.Equal(opts.Output.Formats, []string{"bin", "npz"}) {
+		t.Errorf("configuration: network type %q, formats %v", opts.Network.Type, opts.Output.Formats)
+	}
+	if opts.Clustering.Linkage != defaultPipelineOptions().Clustering.Linkage {
+		t.Errorf("linkage %q, want the default", opts.Clustering.Linkage)
+	}
+
+	_, opts, err = parseCommand([]string{"tom", "-formats", "csv, npy", "-matrix-formats", "tom=bin+npz,dissimilarity=csv", "-powers", "1,2.5"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(opts.Output.Formats, []string{"csv", "npy"}) || !slices.Equal(opts.Output.MatrixFormats["tom"], []string{"bin", "npz"}) ||
+		!slices.Equal(opts.Output.MatrixFormats["dissimilarity"], []string{"csv"}) || !slices.Equal(opts.Network.CandidatePowers, []float64{1, 2.5}) {
+		t.Errorf("list flags: formats %v, matrix formats %v, powers %v", opts.Output.Formats, opts.Output.MatrixFormats, opts.Network.CandidatePowers)
+	}
+}
@@ -1,3 +1,5 @@
+import os
+import numpy as np
 import pandas as pd
 import scipy.cluster.hierarchy as sch
 import matplotlib.pyplot as plt
@@ -6,12 +8,17 @@ import sys
 
 # 1. 加载 Go 生成的差异矩阵
 print("Loading dissimilarity matrix...")
-try:
-    # index_col=0 意味着第一列是基因名
-    df = pd.read_csv("dissimilarity_matrix.csv", index_col=0)
-except FileNotFoundError:
-    print("Error: dissimilarity_matrix.csv not found. Run the Go program first.")
-    sys.exit(1)
+if os.path.exists("dissimilarity_matrix.npz"):
+    # 二进制导出 (-formats npz)，比解析 CSV 快得多
+    with np.load("dissimilarity_matrix.npz") as npz:
+        df = pd.DataFrame(npz["matrix"], index=npz["genes"], columns=npz["genes"])
+else:
+    try:
+        # index_col=0 意味着第一列是基因名
+        df = pd.read_csv("dissimilarity_matrix.csv", index_col=0)
+    except FileNotFoundError:
+        print("Error: dissimilarity_matrix.csv not found. Run the Go program first.")
+        sys.exit(1)
 
 gene_names = df.index.tolist()
 print(f"Loaded matrix with {len(gene_names)} genes.")
@@ -0,0 +1,28 @@
+// Command build-gct merges GDC STAR gene count TSV files into a single
+// gzipped GCT file that the wgcna pipeline can read.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+const (
+	defaultInputRootDir = "./gdc"
+	defaultOutputGCT    = "./gene_reads_v10_thyroid.gct.gz"
+)
+
+func main() {
+	inputRootDir := flag.String("in", defaultInputRootDir, "root directory of the GDC download (one sub-directory per sample)")
+	outputGCT := flag.String("out", defaultOutputGCT, "output GCT file (.gct.gz)")
+	flag.Parse()
+
+	log.Println("=== Building GCT from STAR TSV files ===")
+	if err := wgcna.BuildGCT(*inputRootDir, *outputGCT); err != nil {
+		log.Fatalf("Failed: %v", err)
+	}
+
+	log.Println("🎉 GCT building finished successfully!")
+}
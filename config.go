@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+// Defaults of the network options.
+const (
+	defaultNetworkType = "signed hybrid"
+
+	// defaultTargetRSquared is the RsquaredCut default of R's pickSoftThreshold.
+	defaultTargetRSquared = 0.85
+
+	// runConfigFile is the resolved configuration echoed into the output directory.
+	runConfigFile = "run_config.json"
+)
+
+var (
+	validOutputFormats = []string{"csv", "bin", "npy", "npz", "rmat"}
+	// validMatrixKinds are the keys of output.matrix_formats.
+	validMatrixKinds = []string{
+		string(wgcna.KindExpression), string(wgcna.KindCorrelation), string(wgcna.KindAdjacency),
+		string(wgcna.KindTOM), string(wgcna.KindDissimilarity),
+	}
+)
+
+// loadRunConfig reads a YAML or JSON run configuration on top of base.
+// Keys missing from the file keep the value from base; unknown keys are an error
+// so that a typo does not silently fall back to a default.
+func loadRunConfig(path string, base pipelineOptions) (pipelineOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return base, fmt.Errorf("cannot read config %s: %w", path, err)
+	}
+
+	jsonData := data
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		tree, err := parseSimpleYAML(data, reflect.TypeOf(base))
+		if err != nil {
+			return base, fmt.Errorf("config %s: %w", path, err)
+		}
+		if jsonData, err = json.Marshal(tree); err != nil {
+			return base, fmt.Errorf("config %s: %w", path, err)
+		}
+	default:
+		return base, fmt.Errorf("config %s: unsupported extension (use .yaml, .yml or .json)", path)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&base); err != nil {
+		return base, fmt.Errorf("config %s: %w", path, err)
+	}
+	return base, nil
+}
+
+// validateOptions checks every option before any heavy work starts,
+// and reports all problems at once.
+func validateOptions(opts pipelineOptions) error {
+	var problems []error
+
+	inputs := []struct{ name, path string }{
+		{"inputs.gct", opts.Inputs.GCTFile},
+		{"inputs.gtf", opts.Inputs.GTFFile},
+	}
+	if opts.Inputs.ResumeFrom != "" {
+		// The GCT and GTF are not read when resuming.
+		inputs = inputs[:0]
+		inputs = append(inputs, struct{ name, path string }{"inputs.resume_from", opts.Inputs.ResumeFrom})
+	}
+	for _, input := range inputs {
+		info, err := os.Stat(input.path)
+		switch {
+		case input.path == "":
+			problems = append(problems, fmt.Errorf("%s is empty", input.name))
+		case err != nil:
+			problems = append(problems, fmt.Errorf("%s: %w", input.name, err))
+		case info.IsDir():
+			problems = append(problems, fmt.Errorf("%s: %s is a directory", input.name, input.path))
+		}
+	}
+
+	if opts.Output.Dir == "" {
+		problems = append(problems, errors.New("output.dir is empty"))
+	}
+	if opts.Output.CleanMatrixFile == "" || filepath.Base(opts.Output.CleanMatrixFile) != opts.Output.CleanMatrixFile {
+		problems = append(problems, fmt.Errorf("output.clean_matrix must be a plain file name, got %q", opts.Output.CleanMatrixFile))
+	}
+	if len(opts.Output.Formats) == 0 {
+		problems = append(problems, errors.New("output.formats is empty"))
+	}
+	for _, format := range opts.Output.Formats {
+		if !containsString(validOutputFormats, format) {
+			problems = append(problems, fmt.Errorf("output.formats: unknown format %q (valid: %s)", format, strings.Join(validOutputFormats, ", ")))
+		}
+	}
+	kinds := make([]string, 0, len(opts.Output.MatrixFormats))
+	for kind := range opts.Output.MatrixFormats {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		formats := opts.Output.MatrixFormats[kind]
+		if !containsString(validMatrixKinds, kind) {
+			problems = append(problems, fmt.Errorf("output.matrix_formats: unknown matrix %q (valid: %s)", kind, strings.Join(validMatrixKinds, ", ")))
+		}
+		for _, format := range formats {
+			if !containsString(validOutputFormats, format) {
+				problems = append(problems, fmt.Errorf("output.matrix_formats.%s: unknown format %q (valid: %s)", kind, format, strings.Join(validOutputFormats, ", ")))
+			}
+		}
+	}
+
+	if err := opts.filterOptions().Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("filter: %w", err))
+	}
+
+	corrOpts := opts.correlationOptions()
+	// Precision and storage are reported as network.* below.
+	corrOpts.Precision, corrOpts.Storage = "", wgcna.MatrixStorage{}
+	if opts.Correlation.MaxPOutliers == 0 {
+		// 0 would silently mean "no limit" in the wgcna package.
+		problems = append(problems, errors.New("correlation.max_p_outliers must be in (0, 1], got 0"))
+	} else if err := corrOpts.Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("correlation: %w (valid methods: %s)", err, correlationMethodNames()))
+	}
+
+	if err := opts.adjacencyOptions().Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("network: %w (valid types: %s)", err, networkTypeNames()))
+	}
+	if t := opts.Network.TargetRSquared; !(t > 0 && t <= 1) {
+		problems = append(problems, fmt.Errorf("network.target_r_squared must be in (0, 1], got %v", t))
+	}
+	if len(opts.Network.CandidatePowers) == 0 {
+		problems = append(problems, errors.New("network.candidate_powers is empty"))
+	}
+	for _, p := range opts.Network.CandidatePowers {
+		if !(p > 0) {
+			problems = append(problems, fmt.Errorf("network.candidate_powers must be > 0, got %v", p))
+		}
+	}
+	if err := opts.tomOptions(nil).Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("network.tom_type: %w (valid: %s)", err, tomTypeNames()))
+	}
+	if !containsString(precisionNames(), opts.Network.Precision) {
+		problems = append(problems, fmt.Errorf("network.precision: unknown precision %q (valid: %s)", opts.Network.Precision, strings.Join(precisionNames(), ", ")))
+	}
+	if !(opts.Network.MemoryBudgetGB >= 0) {
+		problems = append(problems, fmt.Errorf("network.memory_budget_gb must be >= 0, got %v", opts.Network.MemoryBudgetGB))
+	}
+	if dir := opts.Network.SpillDir; dir != "" {
+		if info, err := os.Stat(dir); err != nil {
+			problems = append(problems, fmt.Errorf("network.spill_dir: %w", err))
+		} else if !info.IsDir() {
+			problems = append(problems, fmt.Errorf("network.spill_dir: %s is not a directory", dir))
+		}
+	}
+
+	if opts.Blocks.MaxBlockSize < 0 || opts.Blocks.MaxBlockSize == 1 {
+		problems = append(problems, fmt.Errorf("blocks.max_block_size must be 0 (off) or at least 2, got %d", opts.Blocks.MaxBlockSize))
+	}
+	if opts.Blocks.PreclusteringCenters < 0 {
+		problems = append(problems, fmt.Errorf("blocks.preclustering_centers must be >= 0, got %d", opts.Blocks.PreclusteringCenters))
+	}
+
+	if !containsString(linkageNames(), opts.Clustering.Linkage) {
+		problems = append(problems, fmt.Errorf("clustering.linkage: unknown linkage %q (valid: %s)", opts.Clustering.Linkage, strings.Join(linkageNames(), ", ")))
+	}
+
+	cutOpts := opts.treeCutOptions()
+	if cutOpts.MinClusterSize == 0 {
+		// 0 would silently mean the R default of 20 in the wgcna package.
+		problems = append(problems, errors.New("tree_cut.min_cluster_size must be >= 1, got 0"))
+		cutOpts.MinClusterSize = 1
+	}
+	if err := cutOpts.Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("tree_cut: %w (valid methods: %s)", err, treeCutMethodNames()))
+	}
+
+	if opts.Merge.CutHeight == 0 {
+		// 0 would silently mean the R default of 0.25 in the wgcna package.
+		problems = append(problems, errors.New("merge.cut_height must be > 0, got 0"))
+	} else if err := opts.mergeOptions().Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("merge: %w", err))
+	}
+
+	if err := opts.hubOptions().Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("hubs: %w (valid rankings: %s)", err, hubRankingNames()))
+	}
+	if path := opts.Hubs.Traits; path != "" {
+		if info, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Errorf("hubs.traits: %w", err))
+		} else if info.IsDir() {
+			problems = append(problems, fmt.Errorf("hubs.traits: %s is a directory", path))
+		}
+	} else {
+		if opts.Hubs.MinGS > 0 {
+			problems = append(problems, errors.New("hubs.min_gs needs a trait file (hubs.traits)"))
+		}
+		if opts.Hubs.Trait != "" {
+			problems = append(problems, errors.New("hubs.trait needs a trait file (hubs.traits)"))
+		}
+	}
+
+	if dir := opts.Cache.Dir; dir != "" {
+		if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+			problems = append(problems, fmt.Errorf("cache.dir: %s is not a directory", dir))
+		}
+	}
+	if opts.Cache.Force && opts.Cache.Dir == "" {
+		problems = append(problems, errors.New("-force needs a cache directory (cache.dir)"))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid run configuration:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
+
+// writeRunConfig echoes the resolved options into the output directory,
+// so every output matrix can be traced back to the parameters that produced it.
+// The file can be passed back in with -config to repeat the run.
+func writeRunConfig(opts pipelineOptions) error {
+	data, err := json.MarshalIndent(opts, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := opts.outputPath(runConfigFile)
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	opts.manifest.addOutput(path)
+	return nil
+}
+
+// networkTypeNames lists the accepted network.type values for error messages.
+func networkTypeNames() string {
+	names := make([]string, len(wgcna.NetworkTypes))
+	for i, t := range wgcna.NetworkTypes {
+		names[i] = string(t)
+	}
+	return strings.Join(names, ", ")
+}
+
+// tomTypeNames lists the accepted network.tom_type values for error messages.
+func tomTypeNames() string {
+	names := make([]string, len(wgcna.TOMTypes))
+	for i, t := range wgcna.TOMTypes {
+		names[i] = string(t)
+	}
+	return strings.Join(names, ", ")
+}
+
+// correlationMethodNames lists the accepted correlation.method values for error messages.
+func correlationMethodNames() string {
+	names := make([]string, len(wgcna.CorrelationMethods))
+	for i, m := range wgcna.CorrelationMethods {
+		names[i] = string(m)
+	}
+	return strings.Join(names, ", ")
+}
+
+// precisionNames lists the accepted network.precision values.
+func precisionNames() []string {
+	names := make([]string, len(wgcna.Precisions))
+	for i, p := range wgcna.Precisions {
+		names[i] = string(p)
+	}
+	return names
+}
+
+// linkageNames lists the accepted clustering.linkage values.
+func linkageNames() []string {
+	names := make([]string, len(wgcna.Linkages))
+	for i, l := range wgcna.Linkages {
+		names[i] = string(l)
+	}
+	return names
+}
+
+// treeCutMethodNames lists the accepted tree_cut.method values for error messages.
+func treeCutMethodNames() string {
+	names := make([]string, len(wgcna.TreeCutMethods))
+	for i, m := range wgcna.TreeCutMethods {
+		names[i] = string(m)
+	}
+	return strings.Join(names, ", ")
+}
+
+// hubRankingNames lists the accepted hubs.ranking values for error messages.
+func hubRankingNames() string {
+	names := make([]string, len(wgcna.HubRankings))
+	for i, r := range wgcna.HubRankings {
+		names[i] = string(r)
+	}
+	return strings.Join(names, ", ")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSimpleYAML parses the small YAML subset used by run configurations:
+// nested mappings by indentation, scalars, "- item" lists and [a, b] inline lists.
+// Comments start with '#'. Anchors, multi-line strings and flow mappings are not supported.
+//
+// target is the type the document will be decoded into (nil if unknown):
+// a scalar that goes into a string field stays a string, so that e.g. a
+// trait named no or a file named 1e5 need no quotes. Other scalars become
+// booleans (true, yes, false, no) and numbers where they can.
+func parseSimpleYAML(data []byte, target reflect.Type) (map[string]any, error) {
+	type yamlLine struct {
+		number int
+		indent int
+		text   string
+	}
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		if strings.TrimSpace(raw) == "" || raw == "---" {
+			continue
+		}
+		trimmed := strings.TrimLeft(raw, " ")
+		if trimmed[0] == '\t' {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{number: i + 1, indent: len(raw) - len(trimmed), text: trimmed})
+	}
+
+	pos := 0
+	var parseBlock func(indent int, target reflect.Type) (any, error)
+	parseBlock = func(indent int, target reflect.Type) (any, error) {
+		if strings.HasPrefix(lines[pos].text, "- ") || lines[pos].text == "-" {
+			var list []any
+			for pos < len(lines) && lines[pos].indent == indent && strings.HasPrefix(lines[pos].text, "-") {
+				item := strings.TrimSpace(strings.TrimPrefix(lines[pos].text, "-"))
+				list = append(list, parseYAMLScalar(item, yamlElemType(target)))
+				pos++
+			}
+			return list, nil
+		}
+
+		block := make(map[string]any)
+		for pos < len(lines) && lines[pos].indent == indent {
+			line := lines[pos]
+			key, value, ok := strings.Cut(line.text, ":")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected \"key: value\"", line.number)
+			}
+			key = strings.Trim(strings.TrimSpace(key), `"'`)
+			if _, dup := block[key]; dup {
+				return nil, fmt.Errorf("line %d: duplicate key %q", line.number, key)
+			}
+			value = strings.TrimSpace(value)
+			field := yamlFieldType(target, key)
+			pos++
+			switch {
+			case value != "":
+				block[key] = parseYAMLScalar(value, field)
+			case pos < len(lines) && lines[pos].indent > indent:
+				child, err := parseBlock(lines[pos].indent, field)
+				if err != nil {
+					return nil, err
+				}
+				block[key] = child
+			case pos < len(lines) && lines[pos].indent == indent && strings.HasPrefix(lines[pos].text, "-"):
+				// Lists may sit at the same indentation as their key.
+				child, err := parseBlock(indent, field)
+				if err != nil {
+					return nil, err
+				}
+				block[key] = child
+			default:
+				block[key] = nil
+			}
+		}
+		if pos < len(lines) && lines[pos].indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", lines[pos].number)
+		}
+		return block, nil
+	}
+
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+	root, err := parseBlock(lines[0].indent, target)
+	if err != nil {
+		return nil, err
+	}
+	if pos < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[pos].number)
+	}
+	tree, ok := root.(map[string]any)
+	if !ok {
+		return nil, errors.New("top level must be a mapping")
+	}
+	return tree, nil
+}
+
+// parseYAMLScalar converts a YAML scalar or inline list into a JSON-compatible
+// value for a field of type target (nil if unknown), which stays a string if
+// target is one.
+func parseYAMLScalar(s string, target reflect.Type) any {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		list := []any{}
+		if inner == "" {
+			return list
+		}
+		for _, item := range strings.Split(inner, ",") {
+			list = append(list, parseYAMLScalar(strings.TrimSpace(item), yamlElemType(target)))
+		}
+		return list
+	}
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		if s[0] == '"' {
+			if unquoted, err := strconv.Unquote(s); err == nil {
+				return unquoted
+			}
+		}
+		return s[1 : len(s)-1]
+	}
+	if s == "null" || s == "~" || s == "" {
+		return nil
+	}
+	if target != nil && target.Kind() == reflect.String {
+		return s
+	}
+	switch s {
+	case "true", "True", "yes":
+		return true
+	case "false", "False", "no":
+		return false
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+// yamlFieldType returns the type of the value key holds in a mapping of
+// type target: the field with that JSON name of a struct, or the values of
+// a map. It returns nil if target is nil or has no such field.
+func yamlFieldType(target reflect.Type, key string) reflect.Type {
+	if target == nil {
+		return nil
+	}
+	switch target.Kind() {
+	case reflect.Map:
+		return target.Elem()
+	case reflect.Struct:
+		for i := 0; i < target.NumField(); i++ {
+			field := target.Field(i)
+			if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); field.IsExported() && name == key {
+				return field.Type
+			}
+		}
+	}
+	return nil
+}
+
+// yamlElemType returns the type of the items of a list of type target, or
+// nil if target is nil or not a list.
+func yamlElemType(target reflect.Type) reflect.Type {
+	if target == nil || (target.Kind() != reflect.Slice && target.Kind() != reflect.Array) {
+		return nil
+	}
+	return target.Elem()
+}
+
+// stripYAMLComment removes a trailing "# comment" that is not inside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSimpleYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    map[string]any
+		wantErr string
+	}{
+		{
+			name: "nested mappings",
+			yaml: "network:\n  type: signed\n  beta: 6\n  inner:\n    deep: x\noutput:\n  dir: out\n",
+			want: map[string]any{
+				"network": map[string]any{"type": "signed", "beta": 6.0, "inner": map[string]any{"deep": "x"}},
+				"output":  map[string]any{"dir": "out"},
+			},
+		},
+		{
+			name: "list at the indentation of its key",
+			yaml: "formats:\n- csv\n- bin\nnext: true\n",
+			want: map[string]any{"formats": []any{"csv", "bin"}, "next": true},
+		},
+		{
+			name: "indented list",
+			yaml: "output:\n  formats:\n    - csv\n    - npz\n  dir: out\n",
+			want: map[string]any{"output": map[string]any{"formats": []any{"csv", "npz"}, "dir": "out"}},
+		},
+		{
+			name: "inline lists",
+			yaml: "powers: [1, 2.5, 3]\nempty: []\nnames: [a, 'b c']\n",
+			want: map[string]any{"powers": []any{1.0, 2.5, 3.0}, "empty": []any{}, "names": []any{"a", "b c"}},
+		},
+		{
+			name: "comments and quoted #",
+			yaml: "# heading\n---\ndir: \"results #1\" # the run\nname: 'a # b'\ntag: a#b\n  # indented comment\n",
+			want: map[string]any{"dir": "results #1", "name": "a # b", "tag": "a#b"},
+		},
+		{
+			name: "scalars",
+			yaml: "yes_value: yes\nfalse_value: False\nnull_value: ~\nempty:\nquoted_empty: \"\"\nescaped: \"a\\tb\"\n\"quoted key\": 1e-3\n",
+			want: map[string]any{
+				"yes_value": true, "false_value": false, "null_value": nil, "empty": nil,
+				"quoted_empty": "", "escaped": "a\tb", "quoted key": 0.001,
+			},
+		},
+		{name: "empty document", yaml: "# nothing\n\n", want: map[string]any{}},
+		{name: "tab indentation", yaml: "network:\n\tbeta: 6\n", wantErr: "line 2: tabs are not allowed"},
+		{name: "duplicate key", yaml: "beta: 6\nnetwork: signed\nbeta: 8\n", wantErr: "line 3: duplicate key \"beta\""},
+		{name: "nested duplicate key", yaml: "network:\n  beta: 6\n  beta: 8\n", wantErr: "line 3: duplicate key"},
+		{name: "unexpected indentation", yaml: "beta: 6\n  type: signed\n", wantErr: "line 2: unexpected indentation"},
+		{name: "dedent to an unknown level", yaml: "network:\n    beta: 6\n  type: signed\n", wantErr: "line 3: unexpected indentation"},
+		{name: "no colon", yaml: "network\n", wantErr: "line 1: expected \"key: value\""},
+		{name: "top-level list", yaml: "- a\n- b\n", wantErr: "top level must be a mapping"},
+	}
+	for _, tt := range tests {
+		got, err := parseSimpleYAML([]byte(tt.yaml), nil)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseSimpleYAMLStringFields(t *testing.T) {
+	// Scalars going into string fields are not coerced, so names that look
+	// like numbers or booleans need no quotes; the other fields still get
+	// numbers and booleans.
+	yaml := "output:\n  clean_matrix: 1e5\n  formats: [csv, 2]\n  matrix_formats:\n    tom:\n    - yes\n" +
+		"network:\n  beta: 1e1\n  auto_beta: yes\n  spill_dir: ~\n" +
+		"hubs:\n  trait: no\n  top_n: 10\nunknown: no\n"
+	got, err := parseSimpleYAML([]byte(yaml), reflect.TypeOf(pipelineOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"output": map[string]any{
+			"clean_matrix":   "1e5",
+			"formats":        []any{"csv", "2"},
+			"matrix_formats": map[string]any{"tom": []any{"yes"}},
+		},
+		"network": map[string]any{"beta": 10.0, "auto_beta": true, "spill_dir": nil},
+		"hubs":    map[string]any{"trait": "no", "top_n": 10.0},
+		// A key of no field is coerced, and rejected when decoded.
+		"unknown": false,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "run.yaml")
+	if err := os.WriteFile(path, []byte("hubs:\n  trait: no\n  min_kme: 0.8\noutput:\n  clean_matrix: 2024\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := loadRunConfig(path, defaultPipelineOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Hubs.Trait != "no" || opts.Hubs.MinKME != 0.8 || opts.Output.CleanMatrixFile != "2024" {
+		t.Errorf("trait %q, min kME %v, clean matrix %q", opts.Hubs.Trait, opts.Hubs.MinKME, opts.Output.CleanMatrixFile)
+	}
+}
+
+func TestLoadRunConfig(t *testing.T) {
+	// The example configuration holds the defaults.
+	opts, err := loadRunConfig("wgcna_config.example.yaml", defaultPipelineOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Output = defaultPipelineOptions().Output
+	if want := defaultPipelineOptions(); !reflect.DeepEqual(opts, want) {
+		t.Errorf("the example configuration differs from the defaults:\n%+v\nwant\n%+v", opts, want)
+	}
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"typo.yaml":   "network:\n  betta: 6\n",
+		"type.yaml":   "network:\n  beta: six\n",
+		"config.toml": "beta = 6\n",
+		"bad.json":    "{\"network\": {\"beta\": }}",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadRunConfig(path, defaultPipelineOptions()); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// validInputs returns the default options with GCT and GTF files that
+// exist, and the output in a temporary directory.
+func validInputs(t *testing.T) pipelineOptions {
+	t.Helper()
+	dir := t.TempDir()
+	opts := defaultPipelineOptions()
+	opts.Inputs.GCTFile = filepath.Join(dir, "reads.gct.gz")
+	opts.Inputs.GTFFile = filepath.Join(dir, "genes.gtf.gz")
+	for _, path := range []string{opts.Inputs.GCTFile, opts.Inputs.GTFFile} {
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts.Output.Dir = filepath.Join(dir, "out")
+	return opts
+}
+
+func TestValidateOptions(t *testing.T) {
+	if err := validateOptions(validInputs(t)); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+
+	// Every problem is reported in one error.
+	opts := validInputs(t)
+	opts.Inputs.GTFFile = filepath.Join(t.TempDir(), "missing.gtf.gz")
+	opts.Output.Formats = []string{"csv", "xls"}
+	opts.Output.MatrixFormats = map[string][]string{"tom": {"parquet"}, "eigengenes": {"csv"}}
+	opts.Filter.LowVariancePercentile = 1.5
+	opts.Correlation.Method = "distance"
+	opts.Network.Type = "directed"
+	opts.Network.CandidatePowers = []float64{4, -1}
+	opts.Network.Precision = "float16"
+	opts.Blocks.MaxBlockSize = 1
+	opts.Clustering.Linkage = "median"
+	opts.TreeCut.MinClusterSize = 0
+	opts.Merge.CutHeight = 0
+	opts.Hubs.MinGS = 0.3
+	opts.Cache.Force = true
+	err := validateOptions(opts)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, want := range []string{
+		"inputs.gtf",
+		`output.formats: unknown format "xls"`,
+		`output.matrix_formats.tom: unknown format "parquet"`,
+		`output.matrix_formats: unknown matrix "eigengenes"`,
+		"filter:",
+		"correlation:",
+		"network:",
+		"network.candidate_powers must be > 0, got -1",
+		`network.precision: unknown precision "float16"`,
+		"blocks.max_block_size",
+		`clustering.linkage: unknown linkage "median"`,
+		"tree_cut.min_cluster_size",
+		"merge.cut_height",
+		"hubs.min_gs needs a trait file",
+		"-force needs a cache directory",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("the error does not report %q:\n%v", want, err)
+		}
+	}
+
+	// When resuming, the GCT and GTF are not needed but the artifact is.
+	opts = validInputs(t)
+	opts.Inputs.GCTFile, opts.Inputs.GTFFile = "", ""
+	opts.Inputs.ResumeFrom = filepath.Join(t.TempDir(), "tom_matrix.bin")
+	if err := validateOptions(opts); err == nil || !strings.Contains(err.Error(), "inputs.resume_from") || strings.Contains(err.Error(), "inputs.gct") {
+		t.Errorf("resuming from a missing file: %v", err)
+	}
+}
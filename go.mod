@@ -0,0 +1,3 @@
+module github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery
+
+go 1.21
@@ -1,165 +1,785 @@
-package main
-
-import (
-	"fmt"
-	"log"
-	"os"
-	"strconv"
-	"strings"
-	"math"
-)
-
-const (
-	// input1: GCT data path
-	gctDataFile = "gene_reads_v10_thyroid.gct.gz"
-
-	// input2: GTF annotation path (length of genes, for TPM)
-	gtfAnnotationFile = "gencode.v36.annotation.gtf.gz"
-
-	// output: matrix cleaned
-	outputMatrixFile = "clean_thyroid_matrix.csv"
-
-	// Filtering parameter
-	// We delete a gene if it's expressed in 90% samples (based on log2(TPM+1) < 1)
-	lowExpressionThreshold = 0.9
-
-	// delete genes of low variance percentile
-	lowVariancePercentile = 0.25
-
-	//soft threshold: beta
-	softPowerBeta = 6.0
-)
-
-func main() {
-	//PHASE1: Preprocessing the data (parsing & filtering)
-	log.Println("Phase 1: Preprocessing the data (parsing & filtering)")
-	// parsing GTF annotations (we need gene length for TPM)
-	log.Println("Parsing GTF annotation...")
-	// We need to perform **streaming parsing** of GTF because it becomes extremely large after decompression.
-	// With parseGTFtoLengths, we get: 
-	// map[gene_id_with_version] -> length_in_kilobases
-	geneLengthsKB, err := parseGTFToLengths(gtfAnnotationFile)
-	if err != nil {
-		log.Fatalf("Failed: %v", err)
-	}
-	log.Printf("...succeed in parsing %d genes length\n", len(geneLengthsKB))
-
-	
-	// preprocessing GCT raw main counts
-	
-	log.Println("Preprocessing GCT raw counts")
-	
-	// With processGCTFile, we get a cleaned matrix.
-	finalMatrix, finalGeneList, finalSampleList, err := processGCTFile(
-		gctDataFile,
-		geneLengthsKB,
-		lowExpressionThreshold,
-		lowVariancePercentile,
-	)
-	if err != nil {
-		log.Fatalf("Failed: %v", err)
-	}
-
-	
-	log.Println("Phase 2: Correlation matrix & Adjacency matrix")
-	// PHASE2: Pearsons matrix; Correlation matrix
-	// ---------------------------------------------------------
-	log.Println("Generating the matrix:", outputMatrixFile)
-	err = writeOutputCSV(outputMatrixFile, finalMatrix, finalGeneList, finalSampleList)
-	if err != nil {
-		log.Fatalf("Failed in writing the matrix: %v", err)
-	}
-
-	
-	log.Printf("  (P2) uses a %d gene x %d sample matrix", len(finalGeneList), len(finalSampleList))
-	correlationMatrix, err := RunPhase2(finalMatrix, finalGeneList)
-	if err != nil {
-		log.Fatalf("failed to run phase 2: %v", err)
-	}
-
-	err = writeCorrelationMatrix("correlation_matrix.csv", correlationMatrix, finalGeneList)
-	if err != nil {
-		// Log a warning if saving fails, but don't stop the program
-		log.Printf("warning: failed to save correlation matrix: %v", err)
-	}
-	// PHASE 3: construct the Adjacency Matrix
-	// ---------------------------------------------------------
-	log.Println("Phase 3: Calculating Adjacency Matrix...")
-    log.Printf(" -> Applying Soft Thresholding with Beta = %.1f", softPowerBeta)
-
-	adjacencyMatrix := CalculateAdjacencyMatrix(correlationMatrix, softPowerBeta)
-	log.Printf(" -> Adjacency Matrix created. Size: %d x %d", len(adjacencyMatrix), len(adjacencyMatrix))
-	//save the adjacency matrix
-	log.Println("Saving Adjacency Matrix to CSV...")
-    err = writeCorrelationMatrix("adjacency_matrix.csv", adjacencyMatrix, finalGeneList) 
-    if err != nil {
-        log.Printf("warning: failed to save adjacency matrix: %v", err)
-    }
-	// PHASE 4: Topological Overlap Matrix (TOM)
-	// ---------------------------------------------------------
-	log.Println("Phase 4: Calculating Topological Overlap Matrix (TOM)...")
-	tomMatrix := CalculateTOM(adjacencyMatrix)
-	log.Printf(" -> TOM created. Size: %d x %d", len(tomMatrix), len(tomMatrix))
-	log.Println("Saving TOM Matrix to CSV (This might be large)...")
-    err = writeCorrelationMatrix("tom_matrix.csv", tomMatrix, finalGeneList)
-    if err != nil {
-        log.Printf("warning: failed to save TOM matrix: %v", err)
-    }
-
-	// PHASE 5: Prepare for Clustering (Dissimilarity)
-    // ---------------------------------------------------------
-    log.Println("Phase 5: Calculating Dissimilarity (1-TOM)...")
-	distMatrix := CalculateDissimilarity(tomMatrix)
-
-	for i := range distMatrix {
-		for j := range distMatrix[i] {
-			distMatrix[i][j] = math.Sqrt(distMatrix[i][j])
-		}
-	}
-		
-	// save Dissimilarity matrix for RShiny visualization.
-	finalFile := "dissimilarity_matrix.csv"
-	log.Println("Saving Dissimilarity Matrix for clustering...")
-	err = writeCorrelationMatrix(finalFile, distMatrix, finalGeneList)
-	if err != nil {
-		log.Fatalf("Failed to save final dissimilarity matrix: %v", err)
-	}
-
-	log.Println("DONE! Pipeline finished.")
-}
-
-
-// writeOutputCSV takes in filepath, processed matrix, genelist, samplelist input
-// It saves the matrix in local environment.
-func writeOutputCSV(filePath string, matrix [][]float64, geneList []string, sampleList []string) error {
-	file, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Write in sample id
-	// add a gene_id column
-	header := append([]string{"gene_id"}, sampleList...)
-	_, err = fmt.Fprintln(file, strings.Join(header, ","))
-	if err != nil {
-		return err
-	}
-
-	// write in the gene data
-	for i, geneID := range geneList {
-		row := matrix[i]
-		rowStr := make([]string, len(row)+1)
-		rowStr[0] = geneID
-		for j, val := range row {
-			rowStr[j+1] = strconv.FormatFloat(val, 'f', 6, 64) 
-		}
-		_, err = fmt.Fprintln(file, strings.Join(rowStr, ","))
-		if err != nil {
-			
-			log.Printf("Failed to write %s, %v", geneID, err)
-		}
-	}
-	return nil
-}
-
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+// Default values for the command-line flags (see cli.go).
+const (
+	// input1: GCT data path
+	gctDataFile = "gene_reads_v10_thyroid.gct.gz"
+
+	// input2: GTF annotation path (length of genes, for TPM)
+	gtfAnnotationFile = "gencode.v36.annotation.gtf.gz"
+
+	// output: matrix cleaned
+	outputMatrixFile = "clean_thyroid_matrix.csv"
+
+	// Filtering parameter
+	// We delete a gene if it's expressed in 90% samples (based on log2(TPM+1) < 1)
+	lowExpressionThreshold = 0.9
+
+	// delete genes of low variance percentile
+	lowVariancePercentile = 0.25
+
+	//soft threshold: beta
+	softPowerBeta = 6.0
+)
+
+func main() {
+	lastPhase, opts, err := parseCommand(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed: %v", err)
+	}
+
+	// Check the whole configuration before spending an hour in RunPhase2.
+	if err := validateOptions(opts); err != nil {
+		log.Fatalf("Failed: %v", err)
+	}
+	// Read the parameters of the artifact before run_config.json is overwritten.
+	if opts.Inputs.ResumeFrom != "" {
+		if err := checkResumeArtifact(opts, lastPhase); err != nil {
+			log.Fatalf("Failed: %v", err)
+		}
+	}
+	if err := os.MkdirAll(opts.Output.Dir, 0o755); err != nil {
+		log.Fatalf("Failed to create output directory %s: %v", opts.Output.Dir, err)
+	}
+	opts.manifest = newRunManifest(os.Args[1], os.Args[2:])
+	if err := writeRunConfig(opts); err != nil {
+		log.Fatalf("Failed: %v", err)
+	}
+	log.Printf("Writing outputs to %s (resolved configuration in %s, record of the run in %s)",
+		opts.Output.Dir, runConfigFile, manifestFile)
+
+	if err := runPipeline(opts, lastPhase); err != nil {
+		log.Fatalf("Failed: %v", err)
+	}
+}
+
+// runPipeline runs every phase up to and including lastPhase. The run
+// manifest, if any, is written whether the run succeeds or fails.
+func runPipeline(opts pipelineOptions, lastPhase pipelinePhase) (err error) {
+	opts.cache = newPhaseCache(opts)
+	if opts.manifest != nil {
+		defer func() {
+			if opts.cache != nil {
+				opts.manifest.addOutput(opts.outputPath(cacheReportFile))
+			}
+			opts.manifest.finish(opts, err)
+			if writeErr := opts.manifest.write(opts.outputPath(manifestFile)); writeErr != nil {
+				log.Printf("warning: %v", writeErr)
+			}
+		}()
+	}
+	if opts.Inputs.ResumeFrom != "" {
+		err = resumePipeline(&opts, lastPhase)
+	} else {
+		err = runFromInputs(&opts, lastPhase)
+	}
+	if err != nil {
+		return err
+	}
+	if err := opts.cache.report(opts.outputPath(cacheReportFile)); err != nil {
+		log.Printf("warning: failed to write the cache report: %v", err)
+	}
+	log.Println(phaseDoneMessages[lastPhase])
+	return nil
+}
+
+// runFromInputs runs Phase 1 on the GCT and GTF files, then the later
+// phases up to and including lastPhase.
+func runFromInputs(opts *pipelineOptions, lastPhase pipelinePhase) error {
+	//PHASE1: Preprocessing the data (parsing & filtering)
+	log.Println("Phase 1: Preprocessing the data (parsing & filtering)")
+	endPhase := opts.manifest.startPhase("preprocess")
+	expr, err := opts.cache.expression(*opts, func() (*wgcna.ExpressionMatrix, error) {
+		// parsing GTF annotations (we need gene length for TPM)
+		log.Println("Parsing GTF annotation...")
+		// We need to perform **streaming parsing** of GTF because it becomes extremely large after decompression.
+		// With ParseGTFToLengths, we get:
+		// map[gene_id_with_version] -> length_in_kilobases
+		endGTF := opts.manifest.startPhase("gtf")
+		geneLengthsKB, err := opts.cache.geneLengths(opts.Inputs.GTFFile, func() (map[string]float64, error) {
+			return wgcna.ParseGTFToLengths(opts.Inputs.GTFFile)
+		})
+		endGTF()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("...succeed in parsing %d genes length\n", len(geneLengthsKB))
+
+		// preprocessing GCT raw main counts
+		log.Println("Preprocessing GCT raw counts")
+
+		// With ProcessGCT, we get a cleaned matrix.
+		return wgcna.ProcessGCT(opts.Inputs.GCTFile, geneLengthsKB, opts.filterOptions())
+	})
+	if err != nil {
+		return err
+	}
+
+	opts.manifest.setFilters(expr.Stats)
+	if err := saveExpressionMatrix(opts, expr); err != nil {
+		return fmt.Errorf("failed in writing the matrix: %w", err)
+	}
+	endPhase()
+	return runFromExpression(opts, lastPhase, expr)
+}
+
+// runFromExpression runs the phases after Phase 1 on the clean expression
+// matrix, in block mode if it has more genes than blocks.max_block_size.
+func runFromExpression(opts *pipelineOptions, lastPhase pipelinePhase, expr *wgcna.ExpressionMatrix) error {
+	if lastPhase == phasePreprocess {
+		return nil
+	}
+	if opts.Blocks.MaxBlockSize > 0 && expr.NumGenes() > opts.Blocks.MaxBlockSize {
+		return runBlockwise(opts, lastPhase, expr)
+	}
+	return runNetworkPhases(opts, lastPhase, expr, opts.Output.Dir, true)
+}
+
+// phaseDoneMessages is logged when a command has run its last phase.
+var phaseDoneMessages = map[pipelinePhase]string{
+	phasePreprocess:    "DONE! Stopped after preprocessing.",
+	phaseCorrelate:     "DONE! Stopped after the correlation matrix.",
+	phaseSoftThreshold: "DONE! Stopped after the soft-threshold table.",
+	phaseAdjacency:     "DONE! Stopped after the adjacency matrix.",
+	phaseTOM:           "DONE! Stopped after the TOM.",
+	phaseDissim:        "DONE! Stopped after the dissimilarity matrix.",
+	phaseCluster:       "DONE! Stopped after the gene dendrogram.",
+	phaseModules:       "DONE! Stopped after the module labels.",
+	phaseEigengenes:    "DONE! Stopped after the module eigengenes.",
+	phaseMerge:         "DONE! Stopped after merging the modules.",
+	phaseMembership:    "DONE! Stopped after the module membership table.",
+	phaseHubs:          "DONE! Pipeline finished.",
+}
+
+// runNetworkPhases runs the phases after Phase 1 on expr up to and
+// including lastPhase (up to Phase 8 for a block) and writes their
+// matrices into dir. With fitSoftPower, the scale-free fit
+// is computed from this correlation matrix (see pickSoftPower).
+func runNetworkPhases(opts *pipelineOptions, lastPhase pipelinePhase, expr *wgcna.ExpressionMatrix, dir string, fitSoftPower bool) error {
+	log.Println("Phase 2: Correlation matrix & Adjacency matrix")
+	// PHASE2: Correlation matrix (Pearson or bicor)
+	// ---------------------------------------------------------
+	log.Printf("  (P2) uses a %d gene x %d sample matrix, %s network matrices",
+		expr.NumGenes(), expr.NumSamples(), opts.Network.Precision)
+	endPhase := opts.manifest.startPhase(opts.phaseLabel(dir, "correlation"))
+	correlationMatrix, err := correlate(opts, expr, opts.phaseLabel(dir, "correlation"))
+	if err != nil {
+		return fmt.Errorf("failed to run phase 2: %w", err)
+	}
+
+	if err := saveNetworkMatrix(opts, correlationMatrix, wgcna.KindCorrelation, filepath.Join(dir, matrixBaseName(wgcna.KindCorrelation))); err != nil {
+		// Log a warning if saving fails, but don't stop the program
+		log.Printf("warning: failed to save correlation matrix: %v", err)
+	}
+	endPhase()
+	if lastPhase == phaseCorrelate {
+		return nil
+	}
+	return runFromCorrelation(opts, lastPhase, correlationMatrix, expr, dir, fitSoftPower)
+}
+
+// correlate runs Phase 2 on expr through the phase cache; label names the
+// phase in the cache report.
+func correlate(opts *pipelineOptions, expr *wgcna.ExpressionMatrix, label string) (*wgcna.NetworkMatrix, error) {
+	params := []any{opts.Correlation, opts.Network.Precision}
+	return opts.cache.network(opts, wgcna.KindCorrelation, label, expr, params,
+		func() (*wgcna.NetworkMatrix, error) {
+			return wgcna.Correlate(expr, opts.correlationOptions())
+		})
+}
+
+// adjacency runs Phase 3 on a correlation matrix through the phase cache;
+// label names the phase in the cache report.
+func adjacency(opts *pipelineOptions, correlationMatrix *wgcna.NetworkMatrix, label string) (*wgcna.NetworkMatrix, error) {
+	return opts.cache.network(opts, wgcna.KindAdjacency, label, correlationMatrix, opts.adjacencyOptions(),
+		func() (*wgcna.NetworkMatrix, error) {
+			return wgcna.Adjacency(correlationMatrix, opts.adjacencyOptions())
+		})
+}
+
+// runFromCorrelation runs the phases after Phase 2 on a correlation matrix,
+// which it closes once the adjacency matrix is built (or, for a signed TOM
+// of an unsigned network, the TOM). expr is the
+// expression matrix of its genes, which the phases after Phase 7 need (nil
+// if the run stops before them).
+func runFromCorrelation(opts *pipelineOptions, lastPhase pipelinePhase, correlationMatrix *wgcna.NetworkMatrix,
+	expr *wgcna.ExpressionMatrix, dir string, fitSoftPower bool) error {
+	// Scale-free topology fit for the candidate powers (pickSoftThreshold)
+	// ---------------------------------------------------------
+	if fitSoftPower && (lastPhase == phaseSoftThreshold || opts.Network.AutoBeta) {
+		if err := pickSoftPower(opts, correlationMatrix); err != nil {
+			return err
+		}
+	}
+	if lastPhase == phaseSoftThreshold {
+		return nil
+	}
+
+	// PHASE 3: construct the Adjacency Matrix
+	// ---------------------------------------------------------
+	log.Println("Phase 3: Calculating Adjacency Matrix...")
+	log.Printf(" -> Applying Soft Thresholding with Beta = %.1f (%s network)", opts.Network.SoftPowerBeta, opts.Network.Type)
+	endPhase := opts.manifest.startPhase(opts.phaseLabel(dir, "adjacency"))
+
+	adjacencyMatrix, err := adjacency(opts, correlationMatrix, opts.phaseLabel(dir, "adjacency"))
+	if err != nil {
+		return fmt.Errorf("failed to build adjacency matrix: %w", err)
+	}
+	// Release the file of a disk-backed matrix as soon as it is no longer
+	// needed: the signed TOM of an unsigned network still needs the signs.
+	var signs *wgcna.NetworkMatrix
+	if opts.tomNeedsCorrelation() && lastPhase > phaseAdjacency {
+		signs = correlationMatrix
+	} else {
+		correlationMatrix.Close()
+	}
+	log.Printf(" -> Adjacency Matrix created. Size: %d x %d", adjacencyMatrix.Size(), adjacencyMatrix.Size())
+	//save the adjacency matrix
+	log.Println("Saving Adjacency Matrix to CSV...")
+	if err := saveNetworkMatrix(opts, adjacencyMatrix, wgcna.KindAdjacency, filepath.Join(dir, matrixBaseName(wgcna.KindAdjacency))); err != nil {
+		log.Printf("warning: failed to save adjacency matrix: %v", err)
+	}
+	endPhase()
+	if lastPhase == phaseAdjacency {
+		return nil
+	}
+	return runFromAdjacency(opts, lastPhase, adjacencyMatrix, signs, expr, dir)
+}
+
+// runFromAdjacency runs the phases after Phase 3 on an adjacency matrix,
+// which it closes once the TOM is built, like corr: the correlation matrix
+// the adjacency was built from, which only the signed TOM of an unsigned
+// network needs (nil otherwise). Without blocks, a run up to Phase 10
+// keeps the adjacency open for the connectivity instead.
+func runFromAdjacency(opts *pipelineOptions, lastPhase pipelinePhase, adjacencyMatrix, corr *wgcna.NetworkMatrix,
+	expr *wgcna.ExpressionMatrix, dir string) error {
+	// PHASE 4: Topological Overlap Matrix (TOM)
+	// ---------------------------------------------------------
+	log.Printf("Phase 4: Calculating Topological Overlap Matrix (%s TOM)...", opts.Network.TOMType)
+	if opts.tomNeedsCorrelation() && corr == nil {
+		return errors.New("a signed TOM of an unsigned network needs the signs of the correlations: resume from the correlation matrix instead")
+	}
+	endPhase := opts.manifest.startPhase(opts.phaseLabel(dir, "tom"))
+	// The TOM depends on the correlations too when it takes their signs.
+	params := []any{opts.Network.TOMType}
+	if corr != nil {
+		params = append(params, corr.Fingerprint())
+	}
+	tomMatrix, err := opts.cache.network(opts, wgcna.KindTOM, opts.phaseLabel(dir, "tom"), adjacencyMatrix,
+		params, func() (*wgcna.NetworkMatrix, error) {
+			return wgcna.TOM(adjacencyMatrix, opts.tomOptions(corr))
+		})
+	if err != nil {
+		return fmt.Errorf("failed to build TOM: %w", err)
+	}
+	if lastPhase >= phaseMembership && opts.blockLabels == nil {
+		opts.adjacency = adjacencyMatrix
+	} else {
+		adjacencyMatrix.Close()
+	}
+	if corr != nil {
+		corr.Close()
+	}
+	log.Printf(" -> TOM created. Size: %d x %d", tomMatrix.Size(), tomMatrix.Size())
+	log.Println("Saving TOM Matrix to CSV (This might be large)...")
+	if err := saveNetworkMatrix(opts, tomMatrix, wgcna.KindTOM, filepath.Join(dir, matrixBaseName(wgcna.KindTOM))); err != nil {
+		log.Printf("warning: failed to save TOM matrix: %v", err)
+	}
+	endPhase()
+	if lastPhase == phaseTOM {
+		return nil
+	}
+	return runFromTOM(opts, lastPhase, tomMatrix, expr, dir)
+}
+
+// runFromTOM runs Phase 5 on a TOM, which it closes once the dissimilarity
+// matrix is built, then the phases after it up to and including lastPhase.
+func runFromTOM(opts *pipelineOptions, lastPhase pipelinePhase, tomMatrix *wgcna.NetworkMatrix, expr *wgcna.ExpressionMatrix, dir string) error {
+	// PHASE 5: Prepare for Clustering (Dissimilarity)
+	// ---------------------------------------------------------
+	log.Println("Phase 5: Calculating Dissimilarity (1-TOM)...")
+	endPhase := opts.manifest.startPhase(opts.phaseLabel(dir, "dissimilarity"))
+	distMatrix, err := wgcna.Dissimilarity(tomMatrix)
+	if err != nil {
+		return fmt.Errorf("failed to build dissimilarity matrix: %w", err)
+	}
+	tomMatrix.Close()
+	defer distMatrix.Close()
+
+	distMatrix.Data.Apply(math.Sqrt)
+
+	// save Dissimilarity matrix for RShiny visualization.
+	finalFile := filepath.Join(dir, matrixBaseName(wgcna.KindDissimilarity))
+	log.Println("Saving Dissimilarity Matrix for clustering...")
+	if err := saveNetworkMatrix(opts, distMatrix, wgcna.KindDissimilarity, finalFile); err != nil {
+		return fmt.Errorf("failed to save final dissimilarity matrix: %w", err)
+	}
+	endPhase()
+	if lastPhase == phaseDissim {
+		return nil
+	}
+	return runFromDissimilarity(opts, lastPhase, distMatrix, expr, dir)
+}
+
+// Files written next to the dissimilarity matrix they come from.
+const (
+	// dendrogramFile holds the gene tree.
+	dendrogramFile = "gene_dendrogram.json"
+	// modulesFile holds the module of every gene, like clustering.py's.
+	modulesFile = "gene_modules.csv"
+)
+
+// runFromDissimilarity runs the phases after Phase 5 on the dissimilarity
+// matrix as saved (the caller closes it).
+func runFromDissimilarity(opts *pipelineOptions, lastPhase pipelinePhase, distMatrix *wgcna.NetworkMatrix, expr *wgcna.ExpressionMatrix, dir string) error {
+	// PHASE 6: Hierarchical clustering of the genes (R's hclust)
+	// ---------------------------------------------------------
+	log.Printf("Phase 6: Hierarchical clustering (%s linkage)...", opts.Clustering.Linkage)
+	endPhase := opts.manifest.startPhase(opts.phaseLabel(dir, "hclust"))
+	tree, err := wgcna.HierarchicalCluster(distMatrix, wgcna.Linkage(opts.Clustering.Linkage))
+	if err != nil {
+		return fmt.Errorf("failed to cluster the genes: %w", err)
+	}
+	treeFile := filepath.Join(dir, dendrogramFile)
+	if err := tree.WriteJSON(treeFile); err != nil {
+		return err
+	}
+	opts.manifest.addOutput(treeFile)
+	log.Printf(" -> Gene tree of %d genes saved to %s", tree.Size(), treeFile)
+	endPhase()
+	if lastPhase == phaseCluster {
+		return nil
+	}
+
+	// PHASE 7: Module detection (R's cutreeDynamic)
+	// ---------------------------------------------------------
+	log.Printf("Phase 7: Dynamic Tree Cut (%s, deepSplit %d, minimum module size %d)...",
+		opts.TreeCut.Method, opts.TreeCut.DeepSplit, opts.TreeCut.MinClusterSize)
+	endPhase = opts.manifest.startPhase(opts.phaseLabel(dir, "modules"))
+	labels, err := wgcna.CutTreeDynamic(tree, distMatrix, opts.treeCutOptions())
+	if err != nil {
+		return fmt.Errorf("failed to cut the gene tree: %w", err)
+	}
+	numModules, unassigned := 0, 0
+	for _, label := range labels {
+		numModules = max(numModules, label)
+		if label == wgcna.UnassignedModule {
+			unassigned++
+		}
+	}
+	log.Printf(" -> %d modules, %d of %d genes in none", numModules, unassigned, len(labels))
+	modules := filepath.Join(dir, modulesFile)
+	if err := wgcna.WriteModulesCSV(modules, tree.Labels, labels); err != nil {
+		return fmt.Errorf("failed to save the modules: %w", err)
+	}
+	opts.manifest.addOutput(modules)
+	endPhase()
+	if lastPhase == phaseModules {
+		return nil
+	}
+	return runFromModules(opts, lastPhase, expr, tree.Labels, labels, dir)
+}
+
+// Files written next to the modules they describe.
+const (
+	// eigengenesFile holds the eigengene x sample table.
+	eigengenesFile = "module_eigengenes.csv"
+	// varianceExplainedFile holds the size of every module and the
+	// fraction of its variance its eigengene explains.
+	varianceExplainedFile = "module_variance_explained.csv"
+)
+
+// runFromModules runs the phases after Phase 7 on the module labels of
+// genes; expr must hold those genes in the same order.
+func runFromModules(opts *pipelineOptions, lastPhase pipelinePhase, expr *wgcna.ExpressionMatrix, genes []string, labels []int, dir string) error {
+	if expr == nil || !slices.Equal(expr.Genes, genes) {
+		return fmt.Errorf("the module eigengenes need the expression matrix of the %d clustered genes", len(genes))
+	}
+
+	// PHASE 8: Module eigengenes (R's moduleEigengenes)
+	// ---------------------------------------------------------
+	log.Println("Phase 8: Module eigengenes...")
+	endPhase := opts.manifest.startPhase(opts.phaseLabel(dir, "eigengenes"))
+	if _, err := writeEigengenes(opts, expr, labels, opts.eigengeneOptions(), dir, ""); err != nil {
+		return err
+	}
+	endPhase()
+	if opts.blockLabels != nil {
+		// In block mode, runBlockwise merges the modules of all blocks.
+		opts.blockLabels[dir] = labels
+		return nil
+	}
+	if lastPhase == phaseEigengenes {
+		return nil
+	}
+	modules := make([]blockModule, len(labels))
+	for g, label := range labels {
+		modules[g] = blockModule{1, label}
+	}
+	return runMerge(opts, lastPhase, expr, modules, dir)
+}
+
+// writeEigengenes computes the eigengenes of the modules of expr and saves
+// them, and their variance explained, into dir; suffix is appended to the
+// file names.
+func writeEigengenes(opts *pipelineOptions, expr *wgcna.ExpressionMatrix, labels []int, eigenOpts wgcna.EigengeneOptions,
+	dir, suffix string) (*wgcna.Eigengenes, error) {
+	eigengenes, err := wgcna.ModuleEigengenes(expr, labels, eigenOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute the module eigengenes: %w", err)
+	}
+	log.Printf(" -> %d eigengenes over %d samples", len(eigengenes.Modules), len(eigengenes.Samples))
+	for _, out := range []struct {
+		name  string
+		write func(string) error
+	}{
+		{eigengenesFile, eigengenes.WriteCSV},
+		{varianceExplainedFile, eigengenes.WriteVarianceExplainedCSV},
+	} {
+		path := filepath.Join(dir, strings.TrimSuffix(out.name, ".csv")+suffix+".csv")
+		if err := out.write(path); err != nil {
+			return nil, fmt.Errorf("failed to save %s: %w", path, err)
+		}
+		opts.manifest.addOutput(path)
+	}
+	return eigengenes, nil
+}
+
+// Files written by the module merging.
+const (
+	// mergedModulesFile holds the merged module and colour of every gene.
+	mergedModulesFile = "gene_modules_merged.csv"
+	// moduleMergeFile maps every module of Phase 7 to its merged module.
+	moduleMergeFile = "module_merge.csv"
+	// mergedSuffix names the eigengene tables of the merged modules.
+	mergedSuffix = "_merged"
+)
+
+// blockModule is a module of Phase 7: its label in the gene_modules.csv of
+// a block (block 1 without blocks).
+type blockModule struct {
+	block, label int
+}
+
+// runMerge runs Phase 9 on the Phase 7 modules of every gene of expr,
+// given by modules[g], and writes the merged modules into dir.
+func runMerge(opts *pipelineOptions, lastPhase pipelinePhase, expr *wgcna.ExpressionMatrix, modules []blockModule, dir string) error {
+	// PHASE 9: Merge modules with similar eigengenes (R's mergeCloseModules)
+	// ---------------------------------------------------------
+	log.Printf("Phase 9: Merging modules with eigengene dissimilarity <= %g...", opts.Merge.CutHeight)
+	endPhase := opts.manifest.startPhase("merge")
+	// Number the modules of all blocks together; genes in no module stay
+	// in none.
+	labels := make([]int, len(modules))
+	number := make(map[blockModule]int)
+	for g, m := range modules {
+		if m.label == wgcna.UnassignedModule {
+			continue
+		}
+		if _, ok := number[m]; !ok {
+			number[m] = len(number) + 1
+		}
+		labels[g] = number[m]
+	}
+	merge, err := wgcna.MergeCloseModules(expr, labels, opts.mergeOptions())
+	if err != nil {
+		return fmt.Errorf("failed to merge the modules: %w", err)
+	}
+	numMerged := 0
+	for _, label := range merge.Labels {
+		numMerged = max(numMerged, label)
+	}
+	log.Printf(" -> %d modules merged into %d (%d rounds)", len(number), numMerged, merge.Iterations)
+
+	mergedFile := filepath.Join(dir, mergedModulesFile)
+	if err := wgcna.WriteModuleColorsCSV(mergedFile, expr.Genes, merge.Labels); err != nil {
+		return fmt.Errorf("failed to save the merged modules: %w", err)
+	}
+	opts.manifest.addOutput(mergedFile)
+	mapFile := filepath.Join(dir, moduleMergeFile)
+	if err := writeModuleMerge(mapFile, modules, merge.Labels); err != nil {
+		return fmt.Errorf("failed to save the module mapping: %w", err)
+	}
+	opts.manifest.addOutput(mapFile)
+
+	eigenOpts := opts.eigengeneOptions()
+	eigenOpts.ColorNames = true
+	eigengenes, err := writeEigengenes(opts, expr, merge.Labels, eigenOpts, dir, mergedSuffix)
+	if err != nil {
+		return err
+	}
+	endPhase()
+	if lastPhase == phaseMerge {
+		return nil
+	}
+	return runMembership(opts, lastPhase, expr, merge.Labels, eigengenes, dir)
+}
+
+// membershipFile holds the kME and connectivity table of the merged modules.
+const membershipFile = "module_membership.csv"
+
+// runMembership runs Phase 10 on the merged modules of the genes of expr
+// and their eigengenes.
+func runMembership(opts *pipelineOptions, lastPhase pipelinePhase, expr *wgcna.ExpressionMatrix, labels []int, eigengenes *wgcna.Eigengenes, dir string) error {
+	// PHASE 10: Module membership and connectivity (R's signedKME and
+	// intramodularConnectivity)
+	// ---------------------------------------------------------
+	log.Println("Phase 10: Module membership (kME) and intramodular connectivity...")
+	endPhase := opts.manifest.startPhase("membership")
+	membership, err := wgcna.ModuleMembershipOf(expr, eigengenes)
+	if err != nil {
+		return fmt.Errorf("failed to compute the module membership: %w", err)
+	}
+	log.Printf(" -> Connectivity in the %s network with beta = %g", opts.Network.Type, opts.Network.SoftPowerBeta)
+	connectivity, err := moduleConnectivity(opts, expr, labels)
+	if err != nil {
+		return fmt.Errorf("failed to compute the connectivity: %w", err)
+	}
+	path := filepath.Join(dir, membershipFile)
+	if err := wgcna.WriteModuleMembershipCSV(path, labels, membership, connectivity); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	opts.manifest.addOutput(path)
+	log.Printf(" -> kME of %d genes against %d eigengenes saved to %s", len(labels), len(eigengenes.Names), path)
+	endPhase()
+	if lastPhase == phaseMembership {
+		return nil
+	}
+	return runHubs(opts, expr, labels, membership, connectivity, dir)
+}
+
+// moduleConnectivity computes the connectivity of Phase 10 from the Phase 3
+// adjacency of the genes of expr: the matrix itself if this run built it
+// and kept it open, otherwise that of every block in block mode (genes in
+// different blocks are not connected), or of all the genes without blocks,
+// built again through the phase cache. labels[g] is the merged module of
+// gene g.
+func moduleConnectivity(opts *pipelineOptions, expr *wgcna.ExpressionMatrix, labels []int) (*wgcna.Connectivity, error) {
+	if adjacencyMatrix := opts.adjacency; adjacencyMatrix != nil {
+		opts.adjacency = nil
+		defer adjacencyMatrix.Close()
+		return wgcna.IntramodularConnectivity(adjacencyMatrix, labels)
+	}
+	blocks, dirs := opts.blocks, make([]string, len(opts.blocks))
+	for b := range blocks {
+		dirs[b] = opts.outputPath(fmt.Sprintf("block_%d", b+1))
+	}
+	if blocks == nil {
+		all := make([]int, expr.NumGenes())
+		for g := range all {
+			all[g] = g
+		}
+		blocks, dirs = [][]int{all}, []string{opts.Output.Dir}
+	}
+
+	n := expr.NumGenes()
+	c := &wgcna.Connectivity{
+		Genes:   expr.Genes,
+		KTotal:  make([]float64, n),
+		KWithin: make([]float64, n),
+		KOut:    make([]float64, n),
+		KDiff:   make([]float64, n),
+	}
+	for b, block := range blocks {
+		log.Printf("  (P10) adjacency of %d genes for the connectivity", len(block))
+		correlationMatrix, err := correlate(opts, expr.Subset(block), opts.phaseLabel(dirs[b], "connectivity/correlation"))
+		if err != nil {
+			return nil, err
+		}
+		adjacencyMatrix, err := adjacency(opts, correlationMatrix, opts.phaseLabel(dirs[b], "connectivity/adjacency"))
+		correlationMatrix.Close()
+		if err != nil {
+			return nil, err
+		}
+		blockLabels := make([]int, len(block))
+		for k, g := range block {
+			blockLabels[k] = labels[g]
+		}
+		k, err := wgcna.IntramodularConnectivity(adjacencyMatrix, blockLabels)
+		adjacencyMatrix.Close()
+		if err != nil {
+			return nil, err
+		}
+		for i, g := range block {
+			c.KTotal[g], c.KWithin[g], c.KOut[g], c.KDiff[g] = k.KTotal[i], k.KWithin[i], k.KOut[i], k.KDiff[i]
+		}
+	}
+	return c, nil
+}
+
+// hubGenesFile holds the hub genes of every module.
+const hubGenesFile = "hub_genes.csv"
+
+// runHubs runs Phase 11 on the kME and connectivity of the genes of
+// Phase 10. expr is only needed for the gene significance, when
+// hubs.traits is set.
+func runHubs(opts *pipelineOptions, expr *wgcna.ExpressionMatrix, labels []int, membership *wgcna.ModuleMembership,
+	connectivity *wgcna.Connectivity, dir string) error {
+	// PHASE 11: Hub genes (the Shiny app's hub table)
+	// ---------------------------------------------------------
+	top := "every gene"
+	if opts.Hubs.TopN > 0 {
+		top = fmt.Sprintf("top %d genes", opts.Hubs.TopN)
+	}
+	log.Printf("Phase 11: Hub genes (%s of every module by %s)...", top, opts.Hubs.Ranking)
+	defer opts.manifest.startPhase("hubs")()
+	var gs, gsPValue []float64
+	if opts.Hubs.Traits != "" {
+		traits, err := wgcna.ReadTraitsCSV(opts.Hubs.Traits)
+		if err != nil {
+			return fmt.Errorf("failed to load the traits: %w", err)
+		}
+		name := opts.Hubs.Trait
+		if name == "" {
+			if len(traits.Names) != 1 {
+				return fmt.Errorf("%s has %d traits; choose one with hubs.trait: %s", opts.Hubs.Traits, len(traits.Names),
+					strings.Join(traits.Names, ", "))
+			}
+			name = traits.Names[0]
+		}
+		trait, err := traits.Trait(name, expr.Samples)
+		if err != nil {
+			return fmt.Errorf("%s: %w", opts.Hubs.Traits, err)
+		}
+		known := 0
+		for _, v := range trait {
+			if !math.IsNaN(v) {
+				known++
+			}
+		}
+		if known < len(trait) {
+			log.Printf("warning: %s has no %s for %d of the %d samples; they are left out of the gene significance",
+				opts.Hubs.Traits, name, len(trait)-known, len(trait))
+		}
+		if gs, gsPValue, err = wgcna.GeneSignificance(expr, trait); err != nil {
+			return fmt.Errorf("failed to compute the gene significance for %s: %w", name, err)
+		}
+		log.Printf(" -> Gene significance for %s over %d samples", name, known)
+	}
+	hubs, err := wgcna.HubGenes(labels, membership, connectivity, gs, gsPValue, opts.hubOptions())
+	if err != nil {
+		return fmt.Errorf("failed to pick the hub genes: %w", err)
+	}
+	path := filepath.Join(dir, hubGenesFile)
+	if err := wgcna.WriteHubGenesCSV(path, hubs, gs != nil); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	opts.manifest.addOutput(path)
+	modules := make(map[int]bool)
+	for _, h := range hubs {
+		modules[h.Module] = true
+	}
+	log.Printf(" -> %d hub genes of %d modules saved to %s", len(hubs), len(modules), path)
+	return nil
+}
+
+// runBlockwise splits the genes into blocks of at most max_block_size
+// co-expressed genes (projective k-means, as in R's blockwiseModules) and
+// runs Phases 2-8 on every block, writing each block's matrices into
+// <out>/block_<k>. Genes in different blocks are never compared, which
+// bounds every matrix by the block size. The scale-free fit, if needed,
+// is computed on the largest block.
+func runBlockwise(opts *pipelineOptions, lastPhase pipelinePhase, expr *wgcna.ExpressionMatrix) error {
+	log.Printf("Block mode: splitting %d genes into blocks of at most %d genes", expr.NumGenes(), opts.Blocks.MaxBlockSize)
+	endPhase := opts.manifest.startPhase("blocks")
+	blocks, err := wgcna.ProjectiveKMeans(expr, opts.blockOptions())
+	if err != nil {
+		return fmt.Errorf("failed to pre-cluster genes into blocks: %w", err)
+	}
+	blocksFile := opts.outputPath("gene_blocks.csv")
+	if err := wgcna.WriteGeneBlocksCSV(blocksFile, expr.Genes, blocks); err != nil {
+		return err
+	}
+	opts.manifest.addOutput(blocksFile)
+	endPhase()
+
+	if lastPhase == phaseSoftThreshold || opts.Network.AutoBeta {
+		log.Printf("Fitting the scale-free topology on the largest block (%d genes)", len(blocks[0]))
+		corr, err := correlate(opts, expr.Subset(blocks[0]), opts.phaseLabel(opts.outputPath("block_1"), "correlation"))
+		if err != nil {
+			return fmt.Errorf("failed to run phase 2: %w", err)
+		}
+		if err := pickSoftPower(opts, corr); err != nil {
+			return err
+		}
+		corr.Close()
+		if lastPhase == phaseSoftThreshold {
+			return nil
+		}
+	}
+
+	opts.blockLabels = make(map[string][]int)
+	opts.blocks = blocks
+	defer func() { opts.blockLabels, opts.blocks = nil, nil }()
+	for b, block := range blocks {
+		dir := opts.outputPath(fmt.Sprintf("block_%d", b+1))
+		log.Printf("Block %d/%d: %d genes -> %s", b+1, len(blocks), len(block), dir)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create block directory %s: %w", dir, err)
+		}
+		if err := runNetworkPhases(opts, lastPhase, expr.Subset(block), dir, false); err != nil {
+			return fmt.Errorf("block %d: %w", b+1, err)
+		}
+	}
+	if lastPhase < phaseMerge {
+		return nil
+	}
+
+	// Modules of different blocks may have similar eigengenes: merge them
+	// all together. The labels of a block follow the order of its genes.
+	modules := make([]blockModule, expr.NumGenes())
+	for b, block := range blocks {
+		labels := opts.blockLabels[opts.outputPath(fmt.Sprintf("block_%d", b+1))]
+		for k, g := range block {
+			modules[g] = blockModule{b + 1, labels[k]}
+		}
+	}
+	return runMerge(opts, lastPhase, expr, modules, opts.Output.Dir)
+}
+
+// pickSoftPower writes the scale-free fit table and, with auto_beta,
+// replaces the configured beta by the lowest power reaching the target R^2.
+// The resolved configuration is written again so it records the beta used.
+func pickSoftPower(opts *pipelineOptions, correlationMatrix *wgcna.NetworkMatrix) error {
+	log.Println("Choosing the soft-thresholding power (scale-free topology fit)...")
+	defer opts.manifest.startPhase("soft-threshold")()
+	fits, err := wgcna.PickSoftThreshold(correlationMatrix, opts.softThresholdOptions())
+	if err != nil {
+		return fmt.Errorf("failed to fit scale-free topology: %w", err)
+	}
+	if err := wgcna.WriteSoftThresholdCSV(opts.outputPath("soft_threshold.csv"), fits); err != nil {
+		log.Printf("warning: failed to save soft-threshold table: %v", err)
+	} else {
+		opts.manifest.addOutput(opts.outputPath("soft_threshold.csv"))
+	}
+	if !opts.Network.AutoBeta {
+		return nil
+	}
+
+	power, ok := wgcna.ChooseSoftPower(fits, opts.Network.TargetRSquared)
+	if !ok {
+		log.Printf("warning: no candidate power reaches signed R^2 %.2f, keeping beta = %g",
+			opts.Network.TargetRSquared, opts.Network.SoftPowerBeta)
+		return nil
+	}
+	log.Printf(" -> Lowest power reaching signed R^2 %.2f: beta = %g", opts.Network.TargetRSquared, power)
+	opts.Network.SoftPowerBeta = power
+	return writeRunConfig(*opts)
+}
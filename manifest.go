@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+// manifestFile is the machine-readable record of a run, written into the
+// output directory when the run ends (also when it fails).
+const manifestFile = "manifest.json"
+
+// memorySampleInterval is how often the peak memory of the running phases
+// is sampled.
+const memorySampleInterval = 50 * time.Millisecond
+
+// runManifest records where a run's outputs came from: the inputs and
+// their checksums, the parameters, the Phase 1 gene counts, the time and
+// memory of every phase, and the outputs and their checksums.
+type runManifest struct {
+	Command    string    `json:"command"`
+	Args       []string  `json:"args"`
+	GoVersion  string    `json:"go_version"`
+	Revision   string    `json:"vcs_revision,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Seconds    float64   `json:"seconds"`
+	// Status is "ok" or "failed", with the error in Error.
+	Status     string             `json:"status"`
+	Error      string             `json:"error,omitempty"`
+	Inputs     []fileRecord       `json:"inputs"`
+	Parameters pipelineOptions    `json:"parameters"`
+	Filters    *wgcna.FilterStats `json:"filters,omitempty"`
+	Phases     []*phaseRecord     `json:"phases"`
+	// MaxRSSBytes is the peak resident set size of the whole process.
+	MaxRSSBytes int64        `json:"max_rss_bytes,omitempty"`
+	Outputs     []fileRecord `json:"outputs"`
+
+	mu      sync.Mutex
+	active  []*phaseRecord
+	outputs map[string]bool
+	stop    chan struct{}
+}
+
+// fileRecord is an input or output file and its SHA-256.
+type fileRecord struct {
+	Role   string `json:"role,omitempty"`
+	Path   string `json:"path"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// phaseRecord is the wall time and peak memory of one phase. PeakHeapBytes
+// is the Go heap; PeakRSSBytes the resident memory of the process, which
+// also counts memory-mapped matrices (Linux only).
+type phaseRecord struct {
+	Name          string  `json:"name"`
+	Seconds       float64 `json:"seconds"`
+	PeakHeapBytes uint64  `json:"peak_heap_bytes"`
+	PeakRSSBytes  int64   `json:"peak_rss_bytes,omitempty"`
+	// Cache is the phase cache result, if the cache is enabled.
+	Cache string `json:"cache,omitempty"`
+
+	start time.Time
+}
+
+// newRunManifest starts recording a run and the memory sampler.
+func newRunManifest(command string, args []string) *runManifest {
+	m := &runManifest{
+		Command:   command,
+		Args:      args,
+		GoVersion: runtime.Version(),
+		StartedAt: time.Now(),
+		outputs:   make(map[string]bool),
+		stop:      make(chan struct{}),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				m.Revision = setting.Value
+			}
+		}
+	}
+	go m.sampleMemory()
+	return m
+}
+
+// startPhase starts timing a phase and returns the function that ends it.
+// Phases may nest (the GTF parsing runs inside the preprocessing).
+func (m *runManifest) startPhase(name string) (end func()) {
+	if m == nil {
+		return func() {}
+	}
+	phase := &phaseRecord{Name: name, start: time.Now()}
+	m.mu.Lock()
+	m.Phases = append(m.Phases, phase)
+	m.active = append(m.active, phase)
+	m.mu.Unlock()
+	m.sample()
+	return func() { m.endPhase(phase) }
+}
+
+func (m *runManifest) endPhase(phase *phaseRecord) {
+	m.sample()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, p := range m.active {
+		if p == phase {
+			m.active = append(m.active[:k], m.active[k+1:]...)
+			phase.Seconds = time.Since(phase.start).Seconds()
+			return
+		}
+	}
+}
+
+// setFilters records the Phase 1 gene counts.
+func (m *runManifest) setFilters(stats *wgcna.FilterStats) {
+	if m != nil {
+		m.Filters = stats
+	}
+}
+
+// addOutput records a file written by the run.
+func (m *runManifest) addOutput(path string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.outputs[path] {
+		m.outputs[path] = true
+		m.Outputs = append(m.Outputs, fileRecord{Path: path})
+	}
+}
+
+// sampleMemory samples the memory of the running phases until finish.
+func (m *runManifest) sampleMemory() {
+	ticker := time.NewTicker(memorySampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+// sample raises the peak memory of every running phase to the current use.
+func (m *runManifest) sample() {
+	heap := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(heap)
+	rss := readProcStatus("VmRSS")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, phase := range m.active {
+		if heap[0].Value.Kind() == metrics.KindUint64 {
+			phase.PeakHeapBytes = max(phase.PeakHeapBytes, heap[0].Value.Uint64())
+		}
+		phase.PeakRSSBytes = max(phase.PeakRSSBytes, rss)
+	}
+}
+
+// finish stops the sampler, ends the phases still running (after an
+// error), and records the outcome, the cache results and the checksums.
+func (m *runManifest) finish(opts pipelineOptions, runErr error) {
+	close(m.stop)
+	m.mu.Lock()
+	active := append([]*phaseRecord(nil), m.active...)
+	m.mu.Unlock()
+	for _, phase := range active {
+		m.endPhase(phase)
+	}
+
+	m.FinishedAt = time.Now()
+	m.Seconds = m.FinishedAt.Sub(m.StartedAt).Seconds()
+	m.Status = "ok"
+	if runErr != nil {
+		m.Status, m.Error = "failed", runErr.Error()
+	}
+	m.Parameters = opts
+	m.MaxRSSBytes = readProcStatus("VmHWM")
+	if opts.cache != nil {
+		for _, r := range opts.cache.results {
+			for _, phase := range m.Phases {
+				if phase.Name == r.phase {
+					phase.Cache = r.status
+				}
+			}
+		}
+	}
+
+	hash := hashFile
+	if opts.cache != nil {
+		hash = opts.cache.fileHash // already computed for the cache keys
+	}
+	inputs := []fileRecord{{Role: "gct", Path: opts.Inputs.GCTFile}, {Role: "gtf", Path: opts.Inputs.GTFFile}}
+	if opts.Inputs.ResumeFrom != "" {
+		inputs = []fileRecord{{Role: "resume_from", Path: opts.Inputs.ResumeFrom}}
+	}
+	m.Inputs = inputs
+	for _, records := range [][]fileRecord{m.Inputs, m.Outputs} {
+		for k := range records {
+			if err := records[k].checksum(hash); err != nil {
+				log.Printf("warning: manifest: %v", err)
+			}
+		}
+	}
+}
+
+// checksum fills in the size and SHA-256 of the file.
+func (r *fileRecord) checksum(hash func(string) (string, error)) error {
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return err
+	}
+	r.Bytes = info.Size()
+	r.SHA256, err = hash(r.Path)
+	return err
+}
+
+// write saves the manifest as indented JSON.
+func (m *runManifest) write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// readProcStatus returns a "kB" field of /proc/self/status in bytes, or 0
+// where that file does not exist.
+func readProcStatus(field string) int64 {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
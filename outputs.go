@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+// formatsFor returns the output formats of one kind of matrix: its entry
+// in output.matrix_formats, or output.formats.
+func (o pipelineOptions) formatsFor(kind wgcna.MatrixKind) []string {
+	if formats, ok := o.Output.MatrixFormats[string(kind)]; ok {
+		return formats
+	}
+	return o.Output.Formats
+}
+
+// matrixBaseName is the file name, without extension, of a network matrix.
+func matrixBaseName(kind wgcna.MatrixKind) string {
+	return string(kind) + "_matrix"
+}
+
+// saveExpressionMatrix writes the cleaned expression matrix in each of its
+// output formats. The CSV keeps the configured file name; the other formats
+// replace its extension.
+func saveExpressionMatrix(opts *pipelineOptions, expr *wgcna.ExpressionMatrix) error {
+	name := opts.Output.CleanMatrixFile
+	base := opts.outputPath(strings.TrimSuffix(name, filepath.Ext(name)))
+	for _, format := range opts.formatsFor(wgcna.KindExpression) {
+		path := base + "." + format
+		var err error
+		switch format {
+		case "csv":
+			path = opts.outputPath(name)
+			log.Println("Generating the matrix:", path)
+			err = expr.WriteCSV(path)
+		case "bin":
+			err = expr.WriteBinary(path, opts)
+		case "npy":
+			err = expr.WriteNPY(path)
+		case "npz":
+			err = expr.WriteNPZ(path)
+		case "rmat":
+			err = expr.WriteRMatrix(path)
+		}
+		if err != nil {
+			return err
+		}
+		opts.recordOutput(path, format)
+	}
+	return nil
+}
+
+// saveNetworkMatrix writes a network matrix in each of its output formats,
+// as base plus the format's extension (base is e.g. <out>/tom_matrix).
+// Binary files carry the resolved run configuration in their header.
+func saveNetworkMatrix(opts *pipelineOptions, m *wgcna.NetworkMatrix, kind wgcna.MatrixKind, base string) error {
+	for _, format := range opts.formatsFor(kind) {
+		path := base + "." + format
+		var err error
+		switch format {
+		case "csv":
+			err = m.WriteCSV(path)
+		case "bin":
+			err = m.WriteBinary(path, kind, opts)
+		case "npy":
+			err = m.WriteNPY(path)
+		case "npz":
+			err = m.WriteNPZ(path)
+		case "rmat":
+			err = m.WriteRMatrix(path)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", format, err)
+		}
+		opts.recordOutput(path, format)
+	}
+	return nil
+}
+
+// recordOutput adds a written matrix file, and the descriptor of an .rmat
+// file, to the run manifest.
+func (o pipelineOptions) recordOutput(path, format string) {
+	o.manifest.addOutput(path)
+	if format == "rmat" {
+		o.manifest.addOutput(path + ".txt")
+	}
+}
+
+// writeModuleMerge saves what became of every module of Phase 7, given the
+// module of every gene before (modules) and after (merged) Phase 9, with
+// the columns Block, Old_Label, Genes, New_Label and New_Color.
+func writeModuleMerge(path string, modules []blockModule, merged []int) error {
+	genes := make(map[blockModule]int)
+	newLabel := make(map[blockModule]int)
+	var old []blockModule
+	for g, m := range modules {
+		if genes[m] == 0 {
+			old = append(old, m)
+		}
+		genes[m]++
+		newLabel[m] = merged[g]
+	}
+	sort.Slice(old, func(i, j int) bool {
+		if old[i].block != old[j].block {
+			return old[i].block < old[j].block
+		}
+		return old[i].label < old[j].label
+	})
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write([]string{"Block", "Old_Label", "Genes", "New_Label", "New_Color"})
+	for _, m := range old {
+		w.Write([]string{
+			strconv.Itoa(m.block),
+			strconv.Itoa(m.label),
+			strconv.Itoa(genes[m]),
+			strconv.Itoa(newLabel[m]),
+			wgcna.ModuleColor(newLabel[m]),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
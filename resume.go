@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+// A run resumes from a saved artifact (inputs.resume_from): the clean
+// expression matrix, or the correlation, adjacency, TOM or dissimilarity
+// matrix of an earlier run, written as .bin or .csv. The phases up to the one that
+// produced the artifact are skipped, so e.g.
+//
+//	wgcna dissim -config old/run_config.json -resume-from old/correlation_matrix.bin -beta 8 -out new
+//
+// only rebuilds the adjacency, TOM and dissimilarity matrices. Every
+// parameter the artifact depends on must match the current run; those of
+// the later phases may change. The hub genes can also be picked again from
+// the kME table of Phase 10 (module_membership.csv), e.g. with other
+// thresholds:
+//
+//	wgcna hubs -config old/run_config.json -resume-from old/module_membership.csv -min-kme 0.8 -out new
+
+// artifactPhases maps the kinds of matrix a run can resume from to the
+// phase that produced them.
+var artifactPhases = map[wgcna.MatrixKind]pipelinePhase{
+	wgcna.KindExpression:    phasePreprocess,
+	wgcna.KindCorrelation:   phaseCorrelate,
+	wgcna.KindAdjacency:     phaseAdjacency,
+	wgcna.KindTOM:           phaseTOM,
+	wgcna.KindDissimilarity: phaseDissim,
+	kindMembership:          phaseMembership,
+}
+
+// kindMembership marks the kME table of Phase 10, which is not a matrix
+// file but can be resumed from.
+const kindMembership wgcna.MatrixKind = "membership"
+
+// resumeArtifact describes the file a run resumes from.
+type resumeArtifact struct {
+	path   string
+	kind   wgcna.MatrixKind
+	format string // "bin" or "csv"
+	// params is the configuration of the run that wrote the artifact, or
+	// nil if it was not recorded.
+	params *pipelineOptions
+}
+
+// inspectArtifact finds out what inputs.resume_from holds without loading
+// the matrix. A .bin file names its kind and parameters in its header; a
+// CSV is recognised by its file name, and its parameters are read from the
+// run_config.json next to it (or in the parent directory, for a block).
+func inspectArtifact(opts pipelineOptions) (*resumeArtifact, error) {
+	path := opts.Inputs.ResumeFrom
+	art := &resumeArtifact{path: path, format: strings.TrimPrefix(filepath.Ext(path), ".")}
+	switch art.format {
+	case "bin":
+		header, err := wgcna.ReadBinaryHeader(path)
+		if err != nil {
+			return nil, err
+		}
+		art.kind = header.Kind
+		if len(header.Params) > 0 {
+			art.params = new(pipelineOptions)
+			if err := json.Unmarshal(header.Params, art.params); err != nil {
+				return nil, fmt.Errorf("%s: invalid parameters in header: %w", path, err)
+			}
+		}
+	case "csv":
+		name := filepath.Base(path)
+		for _, kind := range []wgcna.MatrixKind{wgcna.KindCorrelation, wgcna.KindAdjacency, wgcna.KindTOM, wgcna.KindDissimilarity} {
+			if name == matrixBaseName(kind)+".csv" {
+				art.kind = kind
+			}
+		}
+		if name == opts.Output.CleanMatrixFile || name == outputMatrixFile {
+			art.kind = wgcna.KindExpression
+		}
+		if name == membershipFile {
+			art.kind = kindMembership
+		}
+		if art.kind == "" {
+			return nil, fmt.Errorf("%s: cannot tell which matrix this CSV holds from its name; resume from the .bin output or use the name the pipeline wrote", path)
+		}
+		params, err := readArtifactRunConfig(filepath.Dir(path))
+		if err != nil {
+			return nil, err
+		}
+		art.params = params
+	default:
+		return nil, fmt.Errorf("%s: can only resume from a .bin or .csv matrix", path)
+	}
+	if _, ok := artifactPhases[art.kind]; !ok {
+		return nil, fmt.Errorf("%s: cannot resume from a %s matrix (valid: expression, correlation, adjacency, tom, dissimilarity, membership)", path, art.kind)
+	}
+	return art, nil
+}
+
+// readArtifactRunConfig reads the run_config.json of the run that wrote
+// the files in dir; it returns nil if there is none.
+func readArtifactRunConfig(dir string) (*pipelineOptions, error) {
+	candidates := []string{dir}
+	if strings.HasPrefix(filepath.Base(dir), "block_") {
+		candidates = append(candidates, filepath.Dir(dir))
+	}
+	for _, candidate := range candidates {
+		path := filepath.Join(candidate, runConfigFile)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var params pipelineOptions
+		if err := json.Unmarshal(data, &params); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return &params, nil
+	}
+	return nil, nil
+}
+
+// checkResumeArtifact checks, before the run configuration is written,
+// that the run can resume from inputs.resume_from: the command must run
+// at least one phase after the artifact's, and the parameters the artifact
+// depends on must match opts.
+func checkResumeArtifact(opts pipelineOptions, lastPhase pipelinePhase) error {
+	art, err := inspectArtifact(opts)
+	if err != nil {
+		return err
+	}
+	phase := artifactPhases[art.kind]
+	if lastPhase <= phase {
+		return fmt.Errorf("%s holds the %s matrix: this command has nothing left to compute", art.path, art.kind)
+	}
+	if opts.Network.AutoBeta && phase >= phaseAdjacency {
+		return fmt.Errorf("network.auto_beta needs the correlation matrix, but %s holds the %s matrix", art.path, art.kind)
+	}
+
+	if art.params == nil {
+		log.Printf("warning: %s records no parameters; they cannot be checked against this run", art.path)
+		return nil
+	}
+	var problems []error
+	want := upstreamParams(*art.params, phase)
+	for k, got := range upstreamParams(opts, phase) {
+		if fmt.Sprint(got.value) != fmt.Sprint(want[k].value) {
+			problems = append(problems, fmt.Errorf("%s is %v for %s but %v in this run", got.name, want[k].value, art.path, got.value))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("parameters do not match the %s matrix to resume from (pass its run configuration with -config):\n%w",
+			art.kind, errors.Join(problems...))
+	}
+	return nil
+}
+
+// namedParam is a parameter and its value, named as in run_config.json.
+type namedParam struct {
+	name  string
+	value any
+}
+
+// upstreamParams lists the parameters the output of phase depends on.
+func upstreamParams(o pipelineOptions, phase pipelinePhase) []namedParam {
+	params := []namedParam{
+		{"filter.low_expression_threshold", o.Filter.LowExpressionThreshold},
+		{"filter.low_variance_percentile", o.Filter.LowVariancePercentile},
+	}
+	if phase >= phaseCorrelate {
+		params = append(params,
+			namedParam{"correlation.method", o.Correlation.Method},
+			namedParam{"correlation.max_p_outliers", o.Correlation.MaxPOutliers},
+			namedParam{"correlation.pearson_fallback", o.Correlation.PearsonFallback},
+			namedParam{"network.precision", o.Network.Precision},
+			namedParam{"blocks.max_block_size", o.Blocks.MaxBlockSize},
+			namedParam{"blocks.preclustering_centers", o.Blocks.PreclusteringCenters},
+			namedParam{"blocks.seed", o.Blocks.Seed},
+		)
+	}
+	if phase >= phaseAdjacency {
+		params = append(params,
+			namedParam{"network.type", o.Network.Type},
+			namedParam{"network.beta", o.Network.SoftPowerBeta},
+		)
+	}
+	if phase >= phaseTOM {
+		params = append(params, namedParam{"network.tom_type", o.Network.TOMType})
+	}
+	if phase >= phaseCluster {
+		params = append(params, namedParam{"clustering.linkage", o.Clustering.Linkage})
+	}
+	if phase >= phaseModules {
+		params = append(params,
+			namedParam{"tree_cut.method", o.TreeCut.Method},
+			namedParam{"tree_cut.deep_split", o.TreeCut.DeepSplit},
+			namedParam{"tree_cut.min_cluster_size", o.TreeCut.MinClusterSize},
+			namedParam{"tree_cut.cut_height", o.TreeCut.CutHeight},
+			namedParam{"tree_cut.pam_stage", o.TreeCut.PAMStage},
+			namedParam{"tree_cut.pam_respects_dendro", o.TreeCut.PAMRespectsDendro},
+		)
+	}
+	if phase >= phaseEigengenes {
+		params = append(params, namedParam{"eigengenes.exclude_grey", o.Eigengenes.ExcludeGrey})
+	}
+	if phase >= phaseMerge {
+		params = append(params, namedParam{"merge.cut_height", o.Merge.CutHeight})
+	}
+	return params
+}
+
+// resumePipeline loads inputs.resume_from and runs the phases after it up
+// to and including lastPhase. A network matrix is continued on its own,
+// even in block mode: resuming from block_<k>/tom_matrix.bin redoes that
+// block only.
+func resumePipeline(opts *pipelineOptions, lastPhase pipelinePhase) error {
+	art, err := inspectArtifact(*opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("Resuming from %s (%s matrix)", art.path, art.kind)
+	endPhase := opts.manifest.startPhase("resume")
+
+	if art.kind == wgcna.KindExpression {
+		var expr *wgcna.ExpressionMatrix
+		if art.format == "bin" {
+			expr, _, err = wgcna.ReadExpressionMatrix(art.path)
+		} else {
+			expr, err = wgcna.ReadExpressionCSV(art.path)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", art.path, err)
+		}
+		log.Printf(" -> Loaded %d genes x %d samples", expr.NumGenes(), expr.NumSamples())
+		opts.manifest.setFilters(expr.Stats)
+		endPhase()
+		return runFromExpression(opts, lastPhase, expr)
+	}
+	if art.kind == kindMembership {
+		labels, membership, connectivity, err := wgcna.ReadModuleMembershipCSV(art.path)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", art.path, err)
+		}
+		log.Printf(" -> Loaded the kME of %d genes against %d eigengenes", len(membership.Genes), len(membership.Eigengenes))
+		// Only the gene significance needs the expression.
+		var expr *wgcna.ExpressionMatrix
+		if opts.Hubs.Traits != "" {
+			if expr, err = resumeExpression(art, membership.Genes); err != nil {
+				return err
+			}
+		}
+		endPhase()
+		return runHubs(opts, expr, labels, membership, connectivity, opts.Output.Dir)
+	}
+
+	var m *wgcna.NetworkMatrix
+	if art.format == "bin" {
+		m, _, err = wgcna.ReadNetworkMatrix(art.path, opts.matrixStorage())
+	} else {
+		m, err = wgcna.ReadNetworkCSV(art.path, wgcna.Precision(opts.Network.Precision), opts.matrixStorage())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", art.path, err)
+	}
+	log.Printf(" -> Loaded %d x %d %s matrix", m.Size(), m.Size(), m.Data.Precision())
+	if err := checkUpstreamGenes(art, m.Genes); err != nil {
+		m.Close()
+		return err
+	}
+	var expr *wgcna.ExpressionMatrix
+	if lastPhase >= phaseEigengenes {
+		if expr, err = resumeExpression(art, m.Genes); err != nil {
+			m.Close()
+			return err
+		}
+	}
+	endPhase()
+
+	dir := opts.Output.Dir
+	switch art.kind {
+	case wgcna.KindCorrelation:
+		return runFromCorrelation(opts, lastPhase, m, expr, dir, true)
+	case wgcna.KindAdjacency:
+		return runFromAdjacency(opts, lastPhase, m, nil, expr, dir)
+	case wgcna.KindTOM:
+		return runFromTOM(opts, lastPhase, m, expr, dir)
+	default:
+		defer m.Close()
+		return runFromDissimilarity(opts, lastPhase, m, expr, dir)
+	}
+}
+
+// resumeExpression loads the clean expression matrix of the run that wrote
+// a network matrix, from the artifact's directory (or its parent, for a
+// block), and keeps the rows of genes in that order. The phases after
+// Phase 7 need it. Genes are matched by position when the artifact has all
+// the genes of the matrix, and otherwise by name.
+func resumeExpression(art *resumeArtifact, genes []string) (*wgcna.ExpressionMatrix, error) {
+	cleanMatrix := outputMatrixFile
+	if art.params != nil {
+		cleanMatrix = art.params.Output.CleanMatrixFile
+	}
+	dirs := []string{filepath.Dir(art.path)}
+	if strings.HasPrefix(filepath.Base(dirs[0]), "block_") {
+		dirs = append(dirs, filepath.Dir(dirs[0]))
+	}
+	for _, dir := range dirs {
+		for _, name := range []string{strings.TrimSuffix(cleanMatrix, filepath.Ext(cleanMatrix)) + ".bin", cleanMatrix} {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			var expr *wgcna.ExpressionMatrix
+			var err error
+			if filepath.Ext(path) == ".bin" {
+				expr, _, err = wgcna.ReadExpressionMatrix(path)
+			} else {
+				expr, err = wgcna.ReadExpressionCSV(path)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to load %s: %w", path, err)
+			}
+			log.Printf(" -> Expression of the %d genes loaded from %s", len(genes), path)
+			if slices.Equal(expr.Genes, genes) {
+				return expr, nil
+			}
+			// A block holds some of the genes: find their rows by name,
+			// which must then be unique.
+			row := make(map[string]int, expr.NumGenes())
+			for g, gene := range expr.Genes {
+				if _, dup := row[gene]; dup {
+					row[gene] = -1
+					continue
+				}
+				row[gene] = g
+			}
+			rows := make([]int, len(genes))
+			for k, gene := range genes {
+				g, ok := row[gene]
+				if !ok {
+					return nil, fmt.Errorf("gene %s of %s is not in %s", gene, art.path, path)
+				}
+				if g < 0 {
+					return nil, fmt.Errorf("gene %s of %s is listed more than once in %s, so its expression is ambiguous",
+						gene, art.path, path)
+				}
+				rows[k] = g
+			}
+			return expr.Subset(rows), nil
+		}
+	}
+	return nil, fmt.Errorf("the phases after Phase 7 need the clean expression matrix (%s), but it is not next to %s",
+		cleanMatrix, art.path)
+}
+
+// checkUpstreamGenes compares the genes of a network matrix with those of
+// the nearest upstream matrix written next to it by the same run (e.g. the
+// adjacency matrix for a TOM), which catches a matrix copied in from
+// another run.
+func checkUpstreamGenes(art *resumeArtifact, genes []string) error {
+	dir := filepath.Dir(art.path)
+	cleanMatrix := outputMatrixFile
+	if art.params != nil {
+		cleanMatrix = art.params.Output.CleanMatrixFile
+	}
+	type candidate struct {
+		name string
+		kind wgcna.MatrixKind
+	}
+	upstream := []candidate{
+		{strings.TrimSuffix(cleanMatrix, filepath.Ext(cleanMatrix)) + ".bin", wgcna.KindExpression},
+		{cleanMatrix, wgcna.KindExpression},
+	}
+	for _, kind := range []wgcna.MatrixKind{wgcna.KindCorrelation, wgcna.KindAdjacency, wgcna.KindTOM} {
+		if artifactPhases[kind] < artifactPhases[art.kind] {
+			upstream = append([]candidate{{matrixBaseName(kind) + ".bin", kind}, {matrixBaseName(kind) + ".csv", kind}}, upstream...)
+		}
+	}
+
+	for _, c := range upstream {
+		path := filepath.Join(dir, c.name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		upstreamGenes, err := readArtifactGenes(path, c.kind)
+		if err != nil {
+			return err
+		}
+		if !slices.Equal(genes, upstreamGenes) {
+			return fmt.Errorf("the genes of %s (%d) do not match those of %s (%d)", art.path, len(genes), path, len(upstreamGenes))
+		}
+		log.Printf(" -> Genes match %s", path)
+		return nil
+	}
+	log.Printf("warning: no upstream matrix next to %s; its genes cannot be checked", art.path)
+	return nil
+}
+
+// readArtifactGenes reads the row labels of a matrix of the given kind
+// written by the pipeline: from the header of a .bin file, the header row
+// of a network CSV, or the first column of an expression CSV.
+func readArtifactGenes(path string, kind wgcna.MatrixKind) ([]string, error) {
+	if filepath.Ext(path) == ".bin" {
+		header, err := wgcna.ReadBinaryHeader(path)
+		if err != nil {
+			return nil, err
+		}
+		return header.RowLabels, nil
+	}
+	if kind != wgcna.KindExpression {
+		return wgcna.ReadNetworkCSVGenes(path)
+	}
+	expr, err := wgcna.ReadExpressionCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	return expr.Genes, nil
+}
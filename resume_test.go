@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/QiyuYang-QYang/Parallelized-WGCNA-for-cancer-markers-clustering-and-discovery/wgcna"
+)
+
+// writeArtifact saves a network matrix of the given genes, whose (i, j)
+// entry is 1 on the diagonal and 0.1 (i + j) elsewhere, as
+// <dir>/<kind>_matrix.bin with opts in its header, and returns its path.
+func writeArtifact(t *testing.T, dir string, kind wgcna.MatrixKind, genes []string, opts pipelineOptions) string {
+	t.Helper()
+	m := wgcna.NewNetworkMatrix(genes)
+	for i := range genes {
+		for j := i; j < len(genes); j++ {
+			if i == j {
+				m.Set(i, j, 1)
+			} else {
+				m.Set(i, j, 0.1*float64(i+j))
+			}
+		}
+	}
+	path := filepath.Join(dir, matrixBaseName(kind)+".bin")
+	if err := m.WriteBinary(path, kind, opts); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUpstreamParams(t *testing.T) {
+	opts := defaultPipelineOptions()
+	names := func(phase pipelinePhase) []string {
+		var names []string
+		for _, p := range upstreamParams(opts, phase) {
+			names = append(names, p.name)
+		}
+		return names
+	}
+	tests := []struct {
+		phase       pipelinePhase
+		includes    []string
+		notIncludes []string
+	}{
+		{phasePreprocess, []string{"filter.low_expression_threshold"}, []string{"correlation.method", "network.beta"}},
+		{phaseCorrelate, []string{"correlation.method", "network.precision", "blocks.max_block_size"}, []string{"network.beta"}},
+		{phaseAdjacency, []string{"network.type", "network.beta"}, []string{"network.tom_type"}},
+		{phaseTOM, []string{"network.beta", "network.tom_type"}, []string{"clustering.linkage"}},
+		{phaseDissim, []string{"network.tom_type"}, []string{"clustering.linkage"}},
+		{phaseModules, []string{"clustering.linkage", "tree_cut.deep_split"}, []string{"eigengenes.exclude_grey"}},
+		{phaseMembership, []string{"eigengenes.exclude_grey", "merge.cut_height"}, []string{"hubs.min_kme"}},
+	}
+	for _, tt := range tests {
+		got := names(tt.phase)
+		for _, name := range tt.includes {
+			if !slices.Contains(got, name) {
+				t.Errorf("phase %d: %s is not an upstream parameter", tt.phase, name)
+			}
+		}
+		for _, name := range tt.notIncludes {
+			if slices.Contains(got, name) {
+				t.Errorf("phase %d: %s is an upstream parameter", tt.phase, name)
+			}
+		}
+	}
+}
+
+func TestCheckResumeArtifact(t *testing.T) {
+	dir := t.TempDir()
+	genes := []string{"A", "B", "C"}
+	written := defaultPipelineOptions()
+	tomPath := writeArtifact(t, dir, wgcna.KindTOM, genes, written)
+	corrPath := writeArtifact(t, dir, wgcna.KindCorrelation, genes, written)
+
+	tests := []struct {
+		name      string
+		from      string
+		lastPhase pipelinePhase
+		change    func(o *pipelineOptions)
+		wantErr   string // empty if the run can resume
+	}{
+		{"same parameters", tomPath, phaseHubs, func(o *pipelineOptions) {}, ""},
+		// Only the phases after the TOM use these.
+		{"later parameters", tomPath, phaseHubs, func(o *pipelineOptions) {
+			o.Clustering.Linkage = "complete"
+			o.TreeCut.DeepSplit = 4
+			o.Hubs.MinKME = 0.8
+		}, ""},
+		{"beta", tomPath, phaseHubs, func(o *pipelineOptions) { o.Network.SoftPowerBeta = 8 }, "network.beta is 6 for"},
+		{"filter", tomPath, phaseDissim, func(o *pipelineOptions) { o.Filter.LowVariancePercentile = 0.5 }, "filter.low_variance_percentile"},
+		{"TOM type", tomPath, phaseDissim, func(o *pipelineOptions) { o.Network.TOMType = "signed" }, "network.tom_type"},
+		// The correlation does not depend on beta, which may change.
+		{"beta after the correlation", corrPath, phaseTOM, func(o *pipelineOptions) { o.Network.SoftPowerBeta = 8 }, ""},
+		{"method", corrPath, phaseTOM, func(o *pipelineOptions) { o.Correlation.Method = "spearman" }, "correlation.method"},
+		{"nothing left to compute", tomPath, phaseTOM, func(o *pipelineOptions) {}, "nothing left to compute"},
+		{"auto beta", corrPath, phaseTOM, func(o *pipelineOptions) { o.Network.AutoBeta = true }, ""},
+		{"auto beta after the adjacency", tomPath, phaseDissim, func(o *pipelineOptions) { o.Network.AutoBeta = true }, "auto_beta"},
+	}
+	for _, tt := range tests {
+		opts := defaultPipelineOptions()
+		opts.Inputs.ResumeFrom = tt.from
+		tt.change(&opts)
+		err := checkResumeArtifact(opts, tt.lastPhase)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.wantErr != "" && err == nil:
+			t.Errorf("%s: no error", tt.name)
+		case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+			t.Errorf("%s: error %q does not mention %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// Every mismatch is reported at once.
+	opts := defaultPipelineOptions()
+	opts.Inputs.ResumeFrom = tomPath
+	opts.Network.SoftPowerBeta = 8
+	opts.Network.Type = "signed"
+	err := checkResumeArtifact(opts, phaseHubs)
+	if err == nil || !strings.Contains(err.Error(), "network.beta") || !strings.Contains(err.Error(), "network.type") {
+		t.Errorf("two changed parameters: %v", err)
+	}
+}
+
+func TestCheckResumeArtifactCSV(t *testing.T) {
+	// A CSV is recognised by its name and checked against the
+	// run_config.json next to it.
+	dir := t.TempDir()
+	written := defaultPipelineOptions()
+	written.Output.Dir = dir
+	if err := writeRunConfig(written); err != nil {
+		t.Fatal(err)
+	}
+	m := wgcna.NewNetworkMatrix([]string{"A", "B"})
+	m.Set(0, 0, 1)
+	m.Set(1, 1, 1)
+	path := filepath.Join(dir, "adjacency_matrix.csv")
+	if err := m.WriteCSV(path); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultPipelineOptions()
+	opts.Inputs.ResumeFrom = path
+	if err := checkResumeArtifact(opts, phaseTOM); err != nil {
+		t.Errorf("matching run_config.json: %v", err)
+	}
+	opts.Network.Type = "unsigned"
+	if err := checkResumeArtifact(opts, phaseTOM); err == nil || !strings.Contains(err.Error(), "network.type") {
+		t.Errorf("changed network.type: %v", err)
+	}
+
+	renamed := filepath.Join(dir, "my_matrix.csv")
+	if err := os.Rename(path, renamed); err != nil {
+		t.Fatal(err)
+	}
+	opts.Inputs.ResumeFrom = renamed
+	if err := checkResumeArtifact(opts, phaseTOM); err == nil {
+		t.Error("no error for a CSV of unknown name")
+	}
+}
+
+func TestCheckUpstreamGenes(t *testing.T) {
+	opts := defaultPipelineOptions()
+	tests := []struct {
+		name     string
+		upstream map[wgcna.MatrixKind][]string
+		wantErr  bool
+	}{
+		{"same genes", map[wgcna.MatrixKind][]string{wgcna.KindAdjacency: {"A", "B", "C"}}, false},
+		{"other order", map[wgcna.MatrixKind][]string{wgcna.KindAdjacency: {"A", "C", "B"}}, true},
+		{"other genes", map[wgcna.MatrixKind][]string{wgcna.KindCorrelation: {"A", "B", "D"}}, true},
+		// The nearest upstream matrix, the adjacency, decides.
+		{"nearest", map[wgcna.MatrixKind][]string{wgcna.KindAdjacency: {"A", "B", "C"}, wgcna.KindCorrelation: {"X"}}, false},
+		{"no upstream matrix", nil, false},
+		// A downstream matrix is not compared.
+		{"downstream", map[wgcna.MatrixKind][]string{wgcna.KindDissimilarity: {"X"}}, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for kind, genes := range tt.upstream {
+			writeArtifact(t, dir, kind, genes, opts)
+		}
+		art := &resumeArtifact{path: filepath.Join(dir, "tom_matrix.bin"), kind: wgcna.KindTOM, format: "bin", params: &opts}
+		err := checkUpstreamGenes(art, []string{"A", "B", "C"})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want an error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestResumeFromTOM(t *testing.T) {
+	// Resuming from a TOM runs Phase 5 only, which saves the distances
+	// sqrt(1 - TOM).
+	genes := []string{"A", "B", "C"}
+	written := defaultPipelineOptions()
+	tomPath := writeArtifact(t, t.TempDir(), wgcna.KindTOM, genes, written)
+
+	opts := defaultPipelineOptions()
+	opts.Inputs.ResumeFrom = tomPath
+	opts.Output.Dir = t.TempDir()
+	opts.Output.Formats = []string{"bin"}
+	if err := checkResumeArtifact(opts, phaseDissim); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPipeline(opts, phaseDissim); err != nil {
+		t.Fatal(err)
+	}
+	diss, header, err := wgcna.ReadNetworkMatrix(opts.outputPath("dissimilarity_matrix.bin"), wgcna.MatrixStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Kind != wgcna.KindDissimilarity || !slices.Equal(diss.Genes, genes) {
+		t.Fatalf("%s matrix of %v", header.Kind, diss.Genes)
+	}
+	for i := range genes {
+		for j := range genes {
+			want := math.Sqrt(1 - 0.1*float64(i+j))
+			if i == j {
+				want = 0
+			}
+			if got := diss.At(i, j); got < want-1e-12 || got > want+1e-12 {
+				t.Errorf("dissimilarity (%d, %d) = %v, want %v", i, j, got, want)
+			}
+		}
+	}
+	if _, err := os.Stat(opts.outputPath("tom_matrix.bin")); err == nil {
+		t.Error("the TOM was computed again")
+	}
+}
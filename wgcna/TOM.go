@@ -0,0 +1,154 @@
+package wgcna
+
+import (
+	"log"
+	"math"
+	"runtime"
+	"time"
+)
+
+// CalculateTOM computes the Topological Overlap Matrix (TOM)
+// from a symmetric adjacency matrix, R's *unsigned* TOM
+//
+//	WGCNA weighted TOM
+//
+//	 k_i        = sum_{u != i} |a_{iu}|
+//	 numerator  = sum_{u != i,j} a_{iu} * a_{ju} + a_{ij}
+//	 denominator= min(k_i, k_j) + 1 - |a_{ij}|
+//	 TOM_{ij}   = |numerator| / denominator
+//
+// TOM_{ii} = 1.0
+//
+// The absolute values only matter for the signed TOM, whose adjacencies
+// carry the signs of the correlations (see TOMOptions.Correlation); the
+// adjacencies built here are all >= 0.
+func CalculateTOM(adjMatrix *SymMatrix) (*SymMatrix, error) {
+	return calculateTOM(adjMatrix, nil, runtime.NumCPU())
+}
+
+// calculateTOM is CalculateTOM with an explicit number of worker
+// goroutines; if signs is not nil, every adjacency gets the sign of the
+// same entry of signs (the correlations), which gives the signed TOM.
+//
+// The shared-neighbour sums are the entries of the product A * A, which is
+// computed tile by tile like the correlation matrix (see blocked.go). The
+// full dot product sum_u a_iu a_ju also contains the terms u = i and u = j,
+// a_ii a_ij + a_ij a_jj, so they are subtracted afterwards instead of being
+// skipped with a branch in the inner loop. A is stored packed, so each
+// worker unpacks the two row panels of its tile into scratch buffers;
+// besides the output, the only extra memory is 2 x 64 full float64 rows
+// (3 x 64 with signs) and one tile per worker, which count against the
+// memory budget. The TOM has the precision and storage of A; a
+// disk-backed TOM is filled one tile at a time, so only the pages being
+// written need to be resident.
+func calculateTOM(adjMatrix, signs *SymMatrix, numCPU int) (*SymMatrix, error) {
+	numGenes := adjMatrix.Size()
+	log.Printf("Starting TOM calculation for %d genes...", numGenes)
+	startTime := time.Now()
+
+	// 1. connectivity：k_i = sum_{u != i} |a_{iu}|
+	k := make([]float64, numGenes)
+	var buf []float64
+	for i := 0; i < numGenes; i++ {
+		// row holds a_ii, a_i,i+1, ...: add each off-diagonal value to both genes.
+		row := adjMatrix.readUpper(i, buf)
+		buf = row[:0]
+		for offset, a := range row[1:] {
+			a = math.Abs(a)
+			k[i] += a
+			k[i+1+offset] += a
+		}
+	}
+	log.Println("...Connectivity (k) calculated.")
+
+	// 2. TOM matrix, stored like the adjacency matrix; the row panels of
+	// the workers count against the memory budget too.
+	inputs := []*SymMatrix{adjMatrix}
+	if signs != nil {
+		inputs = append(inputs, signs)
+	}
+	scratchBytes := int64(numCPU) * panelScratchBytes(numGenes, signs != nil)
+	tomMatrix, err := allocSymMatrixWithScratch(numGenes, adjMatrix.Precision(), adjMatrix.storage, scratchBytes, inputs...)
+	if err != nil {
+		return nil, err
+	}
+	diag := make([]float64, numGenes)
+	for i := range diag {
+		diag[i] = adjMatrix.At(i, i)
+	}
+
+	// 3. parallel calculation over tiles of A * A
+	tiles := upperTiles(numGenes, tileRows)
+	log.Printf("...Parallelizing TOM calculation using %d CPUs over %d tiles", numCPU, len(tiles))
+
+	scratch := make([]*panelScratch, numCPU)
+	for w := range scratch {
+		scratch[w] = newPanelScratch(numGenes)
+		if signs != nil {
+			scratch[w].withSigns(signs)
+		}
+	}
+	forEachTile(tiles, numCPU, func(w int, t tile) {
+		rowsI, rowsJ, acc := scratch[w].load(adjMatrix, t)
+		gramTile(rowsI, rowsJ, acc)
+		nj := t.J1 - t.J0
+		for i := t.I0; i < t.I1; i++ {
+			for j := max(t.J0, i); j < t.J1; j++ {
+				//TOM(i,i) = 1
+				if i == j {
+					tomMatrix.Set(i, j, 1.0)
+					continue
+				}
+				aij := rowsI[i-t.I0][j]
+
+				// numerator = sum_{u != i,j} a_{iu} a_{ju} + a_{ij}
+				shared := acc[(i-t.I0)*nj+(j-t.J0)] - aij*(diag[i]+diag[j])
+				tomMatrix.Set(i, j, topologicalOverlap(shared, aij, k[i], k[j]))
+			}
+		}
+	}, progressLogger("...TOM", len(tiles)))
+
+	duration := time.Since(startTime)
+	log.Printf("TOM calculation finished in %v", duration)
+
+	return tomMatrix, nil
+}
+
+// topologicalOverlap combines the shared-neighbour sum of genes i and j,
+// their adjacency and connectivities into TOM_ij, clamped to [0, 1].
+func topologicalOverlap(shared, aij, ki, kj float64) float64 {
+	numerator := math.Abs(shared + aij)
+
+	// denominator: min(k_i, k_j) + 1 - |a_{ij}|
+	denominator := min(ki, kj) + 1.0 - math.Abs(aij)
+
+	// TOM value
+	tomValue := 0.0
+	if denominator > 0 {
+		tomValue = numerator / denominator
+	}
+
+	// value =  [0,1]
+	if tomValue < 0 {
+		tomValue = 0
+	} else if tomValue > 1 {
+		tomValue = 1
+	}
+	return tomValue
+}
+
+// CalculateDissimilarity converts TOM into a dissimilarity matrix
+// via dist = 1 - TOM, stored like the TOM.
+func CalculateDissimilarity(tomMatrix *SymMatrix) (*SymMatrix, error) {
+	distMatrix, err := tomMatrix.allocLike()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range tomMatrix.data {
+		distMatrix.data[k] = 1.0 - v
+	}
+	for k, v := range tomMatrix.data32 {
+		distMatrix.data32[k] = 1.0 - v
+	}
+	return distMatrix, nil
+}
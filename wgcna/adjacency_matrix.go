@@ -0,0 +1,62 @@
+package wgcna
+
+import (
+	"fmt"
+	"math"
+)
+
+// CalculateAdjacencyMatrix constructs an adjacency matrix from a
+// correlation matrix using soft-thresholding power beta.
+// The formulas follow WGCNA's adjacency() function
+// (Langfelder & Horvath (2008) BMC Bioinformatics 9:559):
+//
+//	unsigned:      a_ij = |cor_ij|^beta
+//	signed:        a_ij = ((1 + cor_ij) / 2)^beta
+//	signed hybrid: a_ij = cor_ij^beta if cor_ij > 0, else 0
+//
+// Diagonal elements are 1.0 for every type. The result is stored with the
+// precision and storage of the correlation matrix, and is written row by
+// row, so a disk-backed result is streamed to its file.
+func CalculateAdjacencyMatrix(corrMatrix *SymMatrix, beta float64, networkType NetworkType) (*SymMatrix, error) {
+	if err := (AdjacencyOptions{Type: networkType, Beta: beta}).Validate(); err != nil {
+		return nil, err
+	}
+
+	numGenes := corrMatrix.Size()
+	adjMatrix, err := corrMatrix.allocLike()
+	if err != nil {
+		return nil, err
+	}
+
+	var corrBuf []float64
+	adjRow := make([]float64, numGenes)
+	for i := 0; i < numGenes; i++ {
+		corrRow := corrMatrix.readUpper(i, corrBuf)
+		corrBuf = corrRow[:0]
+
+		// readUpper starts at the diagonal
+		adjRow[0] = 1.0
+		for k := 1; k < len(corrRow); k++ {
+			adjRow[k] = math.Pow(adjacencyBase(corrRow[k], networkType), beta)
+		}
+		adjMatrix.writeUpper(i, adjRow[:len(corrRow)])
+	}
+	return adjMatrix, nil
+}
+
+// adjacencyBase is the similarity in [0, 1] that is raised to the power beta
+// for one correlation value.
+func adjacencyBase(corr float64, networkType NetworkType) float64 {
+	switch networkType {
+	case Unsigned:
+		return math.Abs(corr)
+	case Signed:
+		return (1 + corr) / 2
+	case SignedHybrid:
+		if corr > 0 {
+			return corr
+		}
+		return 0
+	}
+	panic(fmt.Sprintf("wgcna: unknown network type %q", networkType))
+}
@@ -0,0 +1,343 @@
+package wgcna
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Binary matrix files (.bin) store a matrix losslessly, much smaller and
+// faster to write and read than CSV. The layout is
+//
+//	offset 0   "WGCNAMAT"                 8-byte magic
+//	offset 8   uint32 version (1)         little-endian
+//	offset 12  uint32 header length H     little-endian
+//	offset 16  JSON header (BinaryHeader) H bytes, space-padded so the
+//	                                      payload starts at a multiple of 8
+//	offset 16+H payload                   little-endian float32 or float64
+//
+// The payload of a "full" matrix is rows x cols values in row-major order;
+// an "upper" matrix is symmetric and stores its upper triangle, diagonal
+// included, row by row (n(n+1)/2 values, the SymMatrix layout).
+const (
+	binaryMagic   = "WGCNAMAT"
+	binaryVersion = 1
+)
+
+// MatrixKind says what a matrix file contains.
+type MatrixKind string
+
+// Kinds of the matrices written by the pipeline.
+const (
+	KindExpression    MatrixKind = "expression"
+	KindCorrelation   MatrixKind = "correlation"
+	KindAdjacency     MatrixKind = "adjacency"
+	KindTOM           MatrixKind = "tom"
+	KindDissimilarity MatrixKind = "dissimilarity"
+)
+
+// Packings of the payload of a binary matrix file.
+const (
+	PackingFull  = "full"
+	PackingUpper = "upper"
+)
+
+// BinaryHeader is the JSON header of a binary matrix file.
+type BinaryHeader struct {
+	Kind    MatrixKind `json:"kind"`
+	Rows    int        `json:"rows"`
+	Cols    int        `json:"cols"`
+	Packing string     `json:"packing"`
+	// DType is the precision of the payload values.
+	DType     Precision `json:"dtype"`
+	RowLabels []string  `json:"row_labels"`
+	// ColLabels is omitted for symmetric matrices, whose columns are the rows.
+	ColLabels []string `json:"col_labels,omitempty"`
+	// Params are the pipeline parameters that produced the matrix, as given
+	// to the writer.
+	Params json.RawMessage `json:"params,omitempty"`
+	// FilterStats are the Phase 1 gene counts of an expression matrix.
+	FilterStats *FilterStats `json:"filter_stats,omitempty"`
+}
+
+// WriteBinary saves the matrix with its gene and sample labels. params, if
+// not nil, is stored as JSON in the header.
+func (e *ExpressionMatrix) WriteBinary(path string, params any) error {
+	header := BinaryHeader{
+		Kind:        KindExpression,
+		Rows:        e.NumGenes(),
+		Cols:        e.NumSamples(),
+		Packing:     PackingFull,
+		DType:       Float64,
+		RowLabels:   e.Genes,
+		ColLabels:   e.Samples,
+		FilterStats: e.Stats,
+	}
+	return writeBinaryFile(path, &header, params, func(w io.Writer) error {
+		for _, row := range e.Data {
+			if err := writeFloats(w, row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteBinary saves the packed matrix, in its storage precision, as the
+// given kind. params, if not nil, is stored as JSON in the header.
+func (m *NetworkMatrix) WriteBinary(path string, kind MatrixKind, params any) error {
+	if err := m.validateSquare(); err != nil {
+		return err
+	}
+	header := BinaryHeader{
+		Kind:      kind,
+		Rows:      m.Size(),
+		Cols:      m.Size(),
+		Packing:   PackingUpper,
+		DType:     m.Data.Precision(),
+		RowLabels: m.Genes,
+	}
+	return writeBinaryFile(path, &header, params, func(w io.Writer) error {
+		if m.Data.data32 != nil {
+			return writeFloats(w, m.Data.data32)
+		}
+		return writeFloats(w, m.Data.data)
+	})
+}
+
+// writeBinaryFile writes the magic, version and header, then lets
+// writePayload write the values.
+func writeBinaryFile(path string, header *BinaryHeader, params any, writePayload func(io.Writer) error) error {
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return fmt.Errorf("failed to encode parameters for %s: %w", path, err)
+		}
+		header.Params = raw
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("failed to encode header for %s: %w", path, err)
+	}
+	if pad := (16 + len(headerJSON)) % 8; pad != 0 {
+		headerJSON = append(headerJSON, bytes.Repeat([]byte{' '}, 8-pad)...)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create matrix file %s: %w", path, err)
+	}
+	defer file.Close()
+	w := bufio.NewWriterSize(file, 1<<20)
+
+	prefix := make([]byte, 16)
+	copy(prefix, binaryMagic)
+	binary.LittleEndian.PutUint32(prefix[8:], binaryVersion)
+	binary.LittleEndian.PutUint32(prefix[12:], uint32(len(headerJSON)))
+	if _, err := w.Write(prefix); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if _, err := w.Write(headerJSON); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := writePayload(w); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// writeFloats writes values little-endian, 4 bytes each for float32 and 8
+// for float64.
+func writeFloats[T float32 | float64](w io.Writer, values []T) error {
+	var zero T
+	size := int(binary.Size(zero))
+	buf := make([]byte, 0, 8192*size)
+	for start := 0; start < len(values); start += 8192 {
+		buf = buf[:0]
+		for _, v := range values[start:min(start+8192, len(values))] {
+			if size == 4 {
+				buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v)))
+			} else {
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(float64(v)))
+			}
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFloats fills values from little-endian data written by writeFloats.
+func readFloats[T float32 | float64](r io.Reader, values []T) error {
+	var zero T
+	size := int(binary.Size(zero))
+	buf := make([]byte, 8192*size)
+	for start := 0; start < len(values); start += 8192 {
+		chunk := values[start:min(start+8192, len(values))]
+		if _, err := io.ReadFull(r, buf[:len(chunk)*size]); err != nil {
+			return err
+		}
+		for k := range chunk {
+			if size == 4 {
+				chunk[k] = T(math.Float32frombits(binary.LittleEndian.Uint32(buf[4*k:])))
+			} else {
+				chunk[k] = T(math.Float64frombits(binary.LittleEndian.Uint64(buf[8*k:])))
+			}
+		}
+	}
+	return nil
+}
+
+// ReadBinaryHeader reads only the header of a binary matrix file.
+func ReadBinaryHeader(path string) (*BinaryHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readBinaryHeader(bufio.NewReader(file), path)
+}
+
+// readBinaryHeader reads and checks the magic, version and header.
+func readBinaryHeader(r io.Reader, path string) (*BinaryHeader, error) {
+	prefix := make([]byte, 16)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("%s: not a binary matrix file: %w", path, err)
+	}
+	if string(prefix[:8]) != binaryMagic {
+		return nil, fmt.Errorf("%s: not a binary matrix file", path)
+	}
+	if version := binary.LittleEndian.Uint32(prefix[8:]); version != binaryVersion {
+		return nil, fmt.Errorf("%s: unsupported binary matrix version %d", path, version)
+	}
+	headerJSON := make([]byte, binary.LittleEndian.Uint32(prefix[12:]))
+	if _, err := io.ReadFull(r, headerJSON); err != nil {
+		return nil, fmt.Errorf("%s: truncated header: %w", path, err)
+	}
+	var header BinaryHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%s: invalid header: %w", path, err)
+	}
+
+	switch {
+	case header.DType != Float64 && header.DType != Float32:
+		return nil, fmt.Errorf("%s: unknown dtype %q", path, header.DType)
+	case header.Rows < 0 || header.Cols < 0:
+		return nil, fmt.Errorf("%s: invalid dimensions %d x %d", path, header.Rows, header.Cols)
+	case len(header.RowLabels) != header.Rows:
+		return nil, fmt.Errorf("%s: %d row labels for %d rows", path, len(header.RowLabels), header.Rows)
+	}
+	switch header.Packing {
+	case PackingFull:
+		if len(header.ColLabels) != header.Cols {
+			return nil, fmt.Errorf("%s: %d column labels for %d columns", path, len(header.ColLabels), header.Cols)
+		}
+	case PackingUpper:
+		if header.Rows != header.Cols {
+			return nil, fmt.Errorf("%s: packed matrix is %d x %d, not square", path, header.Rows, header.Cols)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown packing %q", path, header.Packing)
+	}
+	return &header, nil
+}
+
+// ReadExpressionMatrix loads a matrix written by ExpressionMatrix.WriteBinary.
+func ReadExpressionMatrix(path string) (*ExpressionMatrix, *BinaryHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReaderSize(file, 1<<20)
+
+	header, err := readBinaryHeader(r, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.Packing != PackingFull {
+		return nil, nil, fmt.Errorf("%s: %s matrix is not an expression matrix", path, header.Kind)
+	}
+
+	expr := &ExpressionMatrix{Genes: header.RowLabels, Samples: header.ColLabels, Data: make([][]float64, header.Rows),
+		Stats: header.FilterStats}
+	row32 := make([]float32, header.Cols)
+	for g := range expr.Data {
+		expr.Data[g] = make([]float64, header.Cols)
+		if header.DType == Float32 {
+			err = readFloats(r, row32)
+			for s, v := range row32 {
+				expr.Data[g][s] = float64(v)
+			}
+		} else {
+			err = readFloats(r, expr.Data[g])
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: truncated payload: %w", path, err)
+		}
+	}
+	if err := expectEOF(r, path); err != nil {
+		return nil, nil, err
+	}
+	return expr, header, nil
+}
+
+// ReadNetworkMatrix loads a matrix written by NetworkMatrix.WriteBinary in
+// its stored precision. storage decides whether it is held in RAM or in a
+// memory-mapped file, as for a computed matrix.
+func ReadNetworkMatrix(path string, storage MatrixStorage) (*NetworkMatrix, *BinaryHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReaderSize(file, 1<<20)
+
+	header, err := readBinaryHeader(r, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.Packing != PackingUpper {
+		return nil, nil, fmt.Errorf("%s: %s matrix is not a symmetric network matrix", path, header.Kind)
+	}
+
+	data, err := allocSymMatrix(header.Rows, header.DType, storage)
+	if err != nil {
+		return nil, nil, err
+	}
+	if data.data32 != nil {
+		err = readFloats(r, data.data32)
+	} else {
+		err = readFloats(r, data.data)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: truncated payload: %w", path, err)
+	} else {
+		err = expectEOF(r, path)
+	}
+	if err != nil {
+		data.Close()
+		return nil, nil, err
+	}
+	return &NetworkMatrix{Genes: header.RowLabels, Data: data}, header, nil
+}
+
+// expectEOF reports trailing bytes after the payload, which mean the
+// header does not describe the file.
+func expectEOF(r io.Reader, path string) error {
+	var one [1]byte
+	if n, _ := r.Read(one[:]); n > 0 {
+		return errors.New(path + ": unexpected data after the payload")
+	}
+	return nil
+}
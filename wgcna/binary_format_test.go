@@ -0,0 +1,167 @@
+package wgcna
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// awkwardValues are values a text format would not keep exactly.
+var awkwardValues = []float64{
+	0, math.Copysign(0, -1), 1.0 / 3, -2.5e-310, math.SmallestNonzeroFloat64, math.MaxFloat64,
+	math.Inf(1), math.Inf(-1), math.NaN(), 0.1 + 0.2, -7,
+}
+
+// checkPayloadAligned fails the test unless the payload of a binary file
+// starts at a multiple of 8 bytes, right after the header.
+func checkPayloadAligned(t *testing.T, path string) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw[:8]) != binaryMagic || binary.LittleEndian.Uint32(raw[8:]) != binaryVersion {
+		t.Fatalf("%s starts with %q, version %d", path, raw[:8], binary.LittleEndian.Uint32(raw[8:]))
+	}
+	if start := 16 + binary.LittleEndian.Uint32(raw[12:]); start%8 != 0 {
+		t.Errorf("%s: the payload starts at byte %d, not a multiple of 8", path, start)
+	}
+}
+
+func TestExpressionMatrixBinaryRoundTrip(t *testing.T) {
+	expr := &ExpressionMatrix{
+		Genes:   []string{"TP53", "gene, with \"quotes\"", "ÄBC", "TP53"},
+		Samples: []string{"S-1", "S 2", "S\t3"},
+		Stats: &FilterStats{
+			Samples: 3, GenesInFile: 120, SkippedLines: 2, GenesWithLength: 100,
+			GenesAfterLowExpression: 40, GenesAfterLowVariance: 4,
+		},
+	}
+	for g := range expr.Genes {
+		row := make([]float64, len(expr.Samples))
+		for s := range row {
+			row[s] = awkwardValues[(g*len(row)+s)%len(awkwardValues)]
+		}
+		expr.Data = append(expr.Data, row)
+	}
+	path := filepath.Join(t.TempDir(), "expr.bin")
+	params := map[string]any{"beta": 6, "network": "unsigned"}
+	if err := expr.WriteBinary(path, params); err != nil {
+		t.Fatal(err)
+	}
+	checkPayloadAligned(t, path)
+
+	got, header, err := ReadExpressionMatrix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Genes, expr.Genes) || !slices.Equal(got.Samples, expr.Samples) {
+		t.Errorf("labels %v x %v, want %v x %v", got.Genes, got.Samples, expr.Genes, expr.Samples)
+	}
+	if !reflect.DeepEqual(got.Stats, expr.Stats) || !reflect.DeepEqual(header.FilterStats, expr.Stats) {
+		t.Errorf("filter stats %+v (header %+v), want %+v", got.Stats, header.FilterStats, expr.Stats)
+	}
+	if header.Kind != KindExpression || header.Rows != 4 || header.Cols != 3 || header.Packing != PackingFull || header.DType != Float64 {
+		t.Errorf("header %s %dx%d %s %s", header.Kind, header.Rows, header.Cols, header.Packing, header.DType)
+	}
+	wantParams, _ := json.Marshal(params)
+	if !bytes.Equal(header.Params, wantParams) {
+		t.Errorf("params %s, want %s", header.Params, wantParams)
+	}
+	for g := range expr.Data {
+		for s, want := range expr.Data[g] {
+			if math.Float64bits(got.Data[g][s]) != math.Float64bits(want) {
+				t.Errorf("value (%d, %d) = %v, want %v bit for bit", g, s, got.Data[g][s], want)
+			}
+		}
+	}
+
+	if _, _, err := ReadNetworkMatrix(path, MatrixStorage{}); err == nil {
+		t.Error("an expression matrix was read as a network matrix")
+	}
+}
+
+func TestNetworkMatrixBinaryRoundTrip(t *testing.T) {
+	genes := []string{"A", "B", "C", "A", "gène,E"}
+	for _, precision := range []Precision{Float64, Float32} {
+		m := &NetworkMatrix{Genes: genes, Data: newSymMatrixInMemory(len(genes), precision)}
+		k := 0
+		for i := range genes {
+			for j := i; j < len(genes); j++ {
+				m.Set(i, j, awkwardValues[k%len(awkwardValues)])
+				k++
+			}
+		}
+		path := filepath.Join(t.TempDir(), "tom.bin")
+		if err := m.WriteBinary(path, KindTOM, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkPayloadAligned(t, path)
+
+		got, header, err := ReadNetworkMatrix(path, MatrixStorage{})
+		if err != nil {
+			t.Fatalf("%s: %v", precision, err)
+		}
+		if !slices.Equal(got.Genes, genes) || got.Data.Precision() != precision {
+			t.Errorf("%s: genes %v in %s", precision, got.Genes, got.Data.Precision())
+		}
+		if header.Kind != KindTOM || header.Rows != 5 || header.Cols != 5 || header.Packing != PackingUpper ||
+			header.DType != precision || header.ColLabels != nil || header.Params != nil || header.FilterStats != nil {
+			t.Errorf("%s: header %+v", precision, header)
+		}
+		if precision == Float32 {
+			for k, want := range m.Data.data32 {
+				if math.Float32bits(got.Data.data32[k]) != math.Float32bits(want) {
+					t.Errorf("%s: packed value %d = %v, want %v bit for bit", precision, k, got.Data.data32[k], want)
+				}
+			}
+		} else {
+			for k, want := range m.Data.data {
+				if math.Float64bits(got.Data.data[k]) != math.Float64bits(want) {
+					t.Errorf("%s: packed value %d = %v, want %v bit for bit", precision, k, got.Data.data[k], want)
+				}
+			}
+		}
+
+		if _, _, err := ReadExpressionMatrix(path); err == nil {
+			t.Errorf("%s: a network matrix was read as an expression matrix", precision)
+		}
+	}
+}
+
+func TestReadBinaryRejectsDamagedFiles(t *testing.T) {
+	dir := t.TempDir()
+	m := NewNetworkMatrix([]string{"A", "B", "C"})
+	m.Set(0, 1, 0.5)
+	path := filepath.Join(dir, "adjacency.bin")
+	if err := m.WriteBinary(path, KindAdjacency, nil); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badVersion := slices.Clone(raw)
+	badVersion[8] = 2
+	for name, content := range map[string][]byte{
+		"truncated payload": raw[:len(raw)-1],
+		"trailing data":     append(slices.Clone(raw), 0),
+		"wrong magic":       append([]byte("WGCNAMAX"), raw[8:]...),
+		"newer version":     badVersion,
+		"truncated header":  raw[:20],
+	} {
+		damaged := filepath.Join(dir, "damaged.bin")
+		if err := os.WriteFile(damaged, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ReadNetworkMatrix(damaged, MatrixStorage{}); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package wgcna
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Tile sizes of the blocked matrix products. A tile of 64 rows by 512
+// columns of float64 is 256 KiB, so the two row panels of a tile product
+// stay in L2 cache while their dot products are accumulated.
+const (
+	tileRows = 64
+	tileCols = 512
+)
+
+// tile is a block of rows [I0, I1) x columns [J0, J1) of a symmetric
+// n x n result. Only tiles with I0 <= J0 are computed.
+type tile struct {
+	I0, I1, J0, J1 int
+}
+
+// upperTiles lists the tiles covering the upper triangle (diagonal
+// included) of an n x n matrix, row panel by row panel.
+func upperTiles(n, size int) []tile {
+	var tiles []tile
+	for i0 := 0; i0 < n; i0 += size {
+		i1 := min(i0+size, n)
+		for j0 := i0; j0 < n; j0 += size {
+			tiles = append(tiles, tile{I0: i0, I1: i1, J0: j0, J1: min(j0+size, n)})
+		}
+	}
+	return tiles
+}
+
+// forEachTile runs fn on every tile with numWorkers goroutines. Workers
+// take the next tile from a shared counter as soon as they finish one, so
+// cheap tiles near the diagonal do not leave workers idle.
+// fn gets the worker index so it can reuse per-worker scratch buffers.
+// progress, if not nil, is called with the number of finished tiles.
+func forEachTile(tiles []tile, numWorkers int, fn func(worker int, t tile), progress func(done int)) {
+	var next, done atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for {
+				t := int(next.Add(1)) - 1
+				if t >= len(tiles) {
+					return
+				}
+				fn(w, tiles[t])
+				if progress != nil {
+					progress(int(done.Add(1)))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// gramTile accumulates the dot products of every row of rowsI with every
+// row of rowsJ into acc, which must hold len(rowsI)*len(rowsJ) values
+// (acc[i*len(rowsJ)+j] = rowsI[i] . rowsJ[j]). The columns are walked in
+// blocks of tileCols so both row panels stay in cache.
+func gramTile(rowsI, rowsJ [][]float64, acc []float64) {
+	ni, nj := len(rowsI), len(rowsJ)
+	acc = acc[:ni*nj]
+	for k := range acc {
+		acc[k] = 0
+	}
+	width := len(rowsI[0])
+	for k0 := 0; k0 < width; k0 += tileCols {
+		k1 := min(k0+tileCols, width)
+		for i, rowI := range rowsI {
+			ri := rowI[k0:k1]
+			out := acc[i*nj : (i+1)*nj]
+			for j, rowJ := range rowsJ {
+				out[j] += dot(ri, rowJ[k0:k1])
+			}
+		}
+	}
+}
+
+// panelScratch holds one worker's unpacked row panels of a packed
+// symmetric matrix. The I panel is kept between tiles of the same row
+// panel, which forEachTile tends to hand out consecutively.
+type panelScratch struct {
+	panelI, panelJ [][]float64
+	loadedI        int
+	acc            []float64
+	// signs, if set, gives every unpacked value the sign of the same
+	// entry of signs, whose rows are unpacked into signPanel.
+	signs     *SymMatrix
+	signPanel [][]float64
+}
+
+func newPanelScratch(n int) *panelScratch {
+	s := &panelScratch{loadedI: -1, acc: make([]float64, tileRows*tileRows)}
+	s.panelI = make([][]float64, tileRows)
+	s.panelJ = make([][]float64, tileRows)
+	for r := 0; r < tileRows; r++ {
+		s.panelI[r] = make([]float64, n)
+		s.panelJ[r] = make([]float64, n)
+	}
+	return s
+}
+
+// panelScratchBytes is the memory of one worker's panelScratch for an
+// n x n matrix: two panels of tileRows full rows, a third one with
+// signs, and the tile accumulator.
+func panelScratchBytes(n int, signs bool) int64 {
+	panels := int64(2)
+	if signs {
+		panels++
+	}
+	return 8 * (panels*tileRows*int64(n) + tileRows*tileRows)
+}
+
+// withSigns makes load give the unpacked values the signs of signs.
+func (s *panelScratch) withSigns(signs *SymMatrix) *panelScratch {
+	s.signs = signs
+	s.signPanel = make([][]float64, tileRows)
+	for r := range s.signPanel {
+		s.signPanel[r] = make([]float64, signs.Size())
+	}
+	return s
+}
+
+// load unpacks the full rows of tile t from m and returns them with the
+// tile accumulator.
+func (s *panelScratch) load(m *SymMatrix, t tile) (rowsI, rowsJ [][]float64, acc []float64) {
+	if s.loadedI != t.I0 {
+		s.unpack(m, t.I0, t.I1, s.panelI)
+		s.loadedI = t.I0
+	}
+	rowsI = s.panelI[:t.I1-t.I0]
+	if t.J0 == t.I0 {
+		return rowsI, rowsI, s.acc
+	}
+	s.unpack(m, t.J0, t.J1, s.panelJ)
+	return rowsI, s.panelJ[:t.J1-t.J0], s.acc
+}
+
+// unpack unpacks rows i0..i1-1 of m into dst, with the signs of s.signs.
+func (s *panelScratch) unpack(m *SymMatrix, i0, i1 int, dst [][]float64) {
+	m.unpackRows(i0, i1, dst)
+	if s.signs == nil {
+		return
+	}
+	s.signs.unpackRows(i0, i1, s.signPanel)
+	for r, row := range dst[:i1-i0] {
+		for k, sign := range s.signPanel[r] {
+			if sign < 0 {
+				row[k] = -row[k]
+			}
+		}
+	}
+}
+
+// dot returns sum_k a[k] * b[k] with four independent accumulators,
+// which lets the CPU overlap the multiply-adds.
+func dot(a, b []float64) float64 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float64
+	k := 0
+	for ; k+4 <= len(a); k += 4 {
+		s0 += a[k] * b[k]
+		s1 += a[k+1] * b[k+1]
+		s2 += a[k+2] * b[k+2]
+		s3 += a[k+3] * b[k+3]
+	}
+	for ; k < len(a); k++ {
+		s0 += a[k] * b[k]
+	}
+	return (s0 + s1) + (s2 + s3)
+}
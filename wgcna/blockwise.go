@@ -0,0 +1,390 @@
+package wgcna
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// BlockOptions controls the pre-clustering of blockwise network
+// construction, the equivalent of the blocks of R WGCNA's blockwiseModules.
+type BlockOptions struct {
+	// MaxBlockSize is the largest number of genes in one block
+	// (blockwiseModules uses 5000).
+	MaxBlockSize int
+	// NumCenters is the number of k-means clusters that are packed into
+	// blocks; 0 means min(n/20, 100*n/MaxBlockSize), the default of
+	// blockwiseModules.
+	NumCenters int
+	// Type is the network type the blocks are built for: genes are assigned
+	// by |cor| to a centre for Unsigned networks and by cor otherwise.
+	Type NetworkType
+	// MaxIterations bounds the k-means loop; 0 means 100.
+	MaxIterations int
+	// Seed makes the random initial assignment reproducible.
+	Seed int64
+	// Workers is the number of goroutines; 0 means runtime.NumCPU().
+	Workers int
+}
+
+// Validate checks the block size and the network type.
+func (o BlockOptions) Validate() error {
+	if o.MaxBlockSize < 2 {
+		return fmt.Errorf("max block size must be at least 2, got %d", o.MaxBlockSize)
+	}
+	if o.NumCenters < 0 {
+		return fmt.Errorf("number of pre-clustering centres must be >= 0, got %d", o.NumCenters)
+	}
+	return (AdjacencyOptions{Type: o.Type, Beta: 1}).Validate()
+}
+
+// ProjectiveKMeans splits the genes of expr into blocks of at most
+// opts.MaxBlockSize genes, so that co-expressed genes end up in the same
+// block. It follows the projective k-means of R WGCNA:
+//
+//  1. genes are standardized and randomly assigned to NumCenters clusters;
+//  2. the centre of a cluster is its first principal component (the
+//     direction in sample space that best explains its genes), and every
+//     gene moves to the centre it is most correlated with, until no gene
+//     moves;
+//  3. clusters larger than MaxBlockSize are split, then the two clusters
+//     with the most correlated centres are merged as long as the merged
+//     cluster fits in a block.
+//
+// Blocks are returned largest first, each as ascending row indices of expr.
+func ProjectiveKMeans(expr *ExpressionMatrix, opts BlockOptions) ([][]int, error) {
+	if err := expr.Validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	numGenes := expr.NumGenes()
+	if numGenes == 0 {
+		return nil, errors.New("expression matrix is empty")
+	}
+	if numGenes <= opts.MaxBlockSize {
+		all := make([]int, numGenes)
+		for g := range all {
+			all[g] = g
+		}
+		return [][]int{all}, nil
+	}
+
+	numCenters := opts.NumCenters
+	if numCenters == 0 {
+		numCenters = min(numGenes/20, 100*numGenes/opts.MaxBlockSize)
+	}
+	numCenters = max(1, min(numCenters, numGenes))
+	maxIterations := opts.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = 100
+	}
+	unsigned := opts.Type == Unsigned
+	numWorkers := workerCount(opts.Workers)
+
+	// Standardized rows: the correlation of two genes, or of a gene and a
+	// unit-length centre, is a dot product.
+	z := make([][]float64, numGenes)
+	for g, row := range expr.Data {
+		z[g] = pearsonRow(row)
+	}
+
+	log.Printf("  (blocks) Projective k-means of %d genes with %d centres...", numGenes, numCenters)
+	rng := rand.New(rand.NewSource(opts.Seed))
+	assignment := make([]int, numGenes)
+	for r, g := range rng.Perm(numGenes) {
+		assignment[g] = r % numCenters
+	}
+
+	centers := make([][]float64, numCenters)
+	iteration := 0
+	for ; iteration < maxIterations; iteration++ {
+		members := groupMembers(assignment, numCenters)
+		for c := range centers {
+			centers[c] = clusterCenter(z, members[c], centers[c], unsigned)
+		}
+		if moved := assignToCenters(z, centers, assignment, unsigned, numWorkers); moved == 0 {
+			break
+		}
+	}
+	log.Printf("  (blocks) ...k-means stopped after %d iterations", min(iteration+1, maxIterations))
+
+	var clusters []blockCluster
+	for c, members := range groupMembers(assignment, numCenters) {
+		if len(members) == 0 {
+			continue
+		}
+		clusters = append(clusters, splitCluster(z, members, centers[c], opts.MaxBlockSize, unsigned)...)
+	}
+	blocks := mergeClusters(z, clusters, opts.MaxBlockSize, unsigned)
+
+	sort.SliceStable(blocks, func(a, b int) bool {
+		if len(blocks[a]) != len(blocks[b]) {
+			return len(blocks[a]) > len(blocks[b])
+		}
+		return blocks[a][0] < blocks[b][0]
+	})
+	log.Printf("  (blocks) %d genes in %d blocks (largest %d genes)", numGenes, len(blocks), len(blocks[0]))
+	return blocks, nil
+}
+
+// blockCluster is a set of genes with its unit-length centre.
+type blockCluster struct {
+	members []int
+	center  []float64
+}
+
+// groupMembers lists the genes of every cluster in ascending order.
+func groupMembers(assignment []int, numClusters int) [][]int {
+	members := make([][]int, numClusters)
+	for g, c := range assignment {
+		members[c] = append(members[c], g)
+	}
+	return members
+}
+
+// clusterCenter returns the unit-length first principal component of the
+// rows z[members], found by power iteration starting from start. For
+// signed networks it is oriented so that the members correlate positively
+// with it on average. An empty cluster gets a zero centre, which no gene
+// prefers over a real one.
+func clusterCenter(z [][]float64, members []int, start []float64, unsigned bool) []float64 {
+	width := len(z[0])
+	v := make([]float64, width)
+	if len(members) == 0 {
+		return v
+	}
+	if len(start) == width && dot(start, start) > 0 {
+		copy(v, start)
+	} else {
+		for _, g := range members {
+			for k, x := range z[g] {
+				v[k] += x
+			}
+		}
+		if dot(v, v) == 0 {
+			copy(v, z[members[0]])
+		}
+	}
+	v = normalizeLength(v)
+
+	next := make([]float64, width)
+	for iteration := 0; iteration < 50; iteration++ {
+		for k := range next {
+			next[k] = 0
+		}
+		for _, g := range members {
+			d := dot(z[g], v)
+			for k, x := range z[g] {
+				next[k] += d * x
+			}
+		}
+		if dot(next, next) == 0 {
+			// Every member is constant.
+			return v
+		}
+		next = normalizeLength(next)
+		converged := math.Abs(dot(next, v)) > 1-1e-12
+		v, next = next, v
+		if converged {
+			break
+		}
+	}
+
+	if !unsigned {
+		total := 0.0
+		for _, g := range members {
+			total += dot(z[g], v)
+		}
+		if total < 0 {
+			for k := range v {
+				v[k] = -v[k]
+			}
+		}
+	}
+	return v
+}
+
+// assignToCenters moves every gene to its most similar centre and returns
+// the number of genes that moved. Genes are processed in panels of
+// tileRows, each panel's similarities being one gramTile product.
+func assignToCenters(z, centers [][]float64, assignment []int, unsigned bool, numWorkers int) int {
+	var tiles []tile
+	for g0 := 0; g0 < len(z); g0 += tileRows {
+		tiles = append(tiles, tile{I0: g0, I1: min(g0+tileRows, len(z)), J0: 0, J1: len(centers)})
+	}
+	scratch := make([][]float64, numWorkers)
+	for w := range scratch {
+		scratch[w] = make([]float64, tileRows*len(centers))
+	}
+	movedBy := make([]int, numWorkers)
+	forEachTile(tiles, numWorkers, func(w int, t tile) {
+		acc := scratch[w]
+		gramTile(z[t.I0:t.I1], centers, acc)
+		for g := t.I0; g < t.I1; g++ {
+			similarities := acc[(g-t.I0)*len(centers) : (g-t.I0+1)*len(centers)]
+			best, bestSimilarity := assignment[g], math.Inf(-1)
+			for c, s := range similarities {
+				if unsigned {
+					s = math.Abs(s)
+				}
+				if s > bestSimilarity {
+					best, bestSimilarity = c, s
+				}
+			}
+			if best != assignment[g] {
+				assignment[g] = best
+				movedBy[w]++
+			}
+		}
+	}, nil)
+
+	moved := 0
+	for _, m := range movedBy {
+		moved += m
+	}
+	return moved
+}
+
+// splitCluster cuts a cluster larger than maxSize into equal parts, genes
+// ordered by their similarity to the centre, so the most central genes
+// stay together.
+func splitCluster(z [][]float64, members []int, center []float64, maxSize int, unsigned bool) []blockCluster {
+	if len(members) <= maxSize {
+		return []blockCluster{{members: members, center: center}}
+	}
+	similarity := func(g int) float64 {
+		s := dot(z[g], center)
+		if unsigned {
+			s = math.Abs(s)
+		}
+		return s
+	}
+	ordered := append([]int(nil), members...)
+	sort.SliceStable(ordered, func(a, b int) bool { return similarity(ordered[a]) > similarity(ordered[b]) })
+
+	numParts := (len(ordered) + maxSize - 1) / maxSize
+	parts := make([]blockCluster, numParts)
+	for p := range parts {
+		part := append([]int(nil), ordered[p*len(ordered)/numParts:(p+1)*len(ordered)/numParts]...)
+		sort.Ints(part)
+		parts[p] = blockCluster{members: part, center: clusterCenter(z, part, center, unsigned)}
+	}
+	return parts
+}
+
+// mergeClusters repeatedly merges the two clusters with the most similar
+// centres whose combined size is at most maxSize, and returns the members
+// of the remaining clusters.
+func mergeClusters(z [][]float64, clusters []blockCluster, maxSize int, unsigned bool) [][]int {
+	similarity := func(a, b []float64) float64 {
+		s := dot(a, b)
+		if unsigned {
+			s = math.Abs(s)
+		}
+		return s
+	}
+	// sim[a][b] for b < a; merged-away clusters have nil members.
+	sim := make([][]float64, len(clusters))
+	for a := range clusters {
+		sim[a] = make([]float64, a)
+		for b := 0; b < a; b++ {
+			sim[a][b] = similarity(clusters[a].center, clusters[b].center)
+		}
+	}
+
+	for {
+		bestA, bestB, best := -1, -1, math.Inf(-1)
+		for a := range clusters {
+			if clusters[a].members == nil {
+				continue
+			}
+			for b := 0; b < a; b++ {
+				if clusters[b].members == nil || len(clusters[a].members)+len(clusters[b].members) > maxSize {
+					continue
+				}
+				if sim[a][b] > best {
+					bestA, bestB, best = a, b, sim[a][b]
+				}
+			}
+		}
+		if bestA < 0 {
+			break
+		}
+
+		merged := append(append([]int(nil), clusters[bestB].members...), clusters[bestA].members...)
+		sort.Ints(merged)
+		clusters[bestB] = blockCluster{members: merged, center: clusterCenter(z, merged, clusters[bestB].center, unsigned)}
+		clusters[bestA].members = nil
+		for other := range clusters {
+			if other == bestB || clusters[other].members == nil {
+				continue
+			}
+			s := similarity(clusters[bestB].center, clusters[other].center)
+			if other < bestB {
+				sim[bestB][other] = s
+			} else {
+				sim[other][bestB] = s
+			}
+		}
+	}
+
+	var blocks [][]int
+	for _, c := range clusters {
+		if c.members != nil {
+			blocks = append(blocks, c.members)
+		}
+	}
+	return blocks
+}
+
+// Subset returns the matrix restricted to the given gene rows, in that
+// order. The rows share memory with e.
+func (e *ExpressionMatrix) Subset(rows []int) *ExpressionMatrix {
+	sub := &ExpressionMatrix{
+		Genes:   make([]string, len(rows)),
+		Samples: e.Samples,
+		Data:    make([][]float64, len(rows)),
+	}
+	for r, g := range rows {
+		sub.Genes[r] = e.Genes[g]
+		sub.Data[r] = e.Data[g]
+	}
+	return sub
+}
+
+// WriteGeneBlocksCSV saves the block of every gene (numbered from 1,
+// largest block first) in the original gene order.
+func WriteGeneBlocksCSV(filePath string, genes []string, blocks [][]int) error {
+	blockOf := make([]int, len(genes))
+	for b, block := range blocks {
+		for _, g := range block {
+			blockOf[g] = b + 1
+		}
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create block file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	if err := writer.Write([]string{"gene_id", "block"}); err != nil {
+		return fmt.Errorf("failed to write block header: %w", err)
+	}
+	for g, gene := range genes {
+		if err := writer.Write([]string{gene, strconv.Itoa(blockOf[g])}); err != nil {
+			return fmt.Errorf("failed to write block row: %w", err)
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
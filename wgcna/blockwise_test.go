@@ -0,0 +1,216 @@
+package wgcna
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// plantedGroups returns genes that follow orthogonal profiles of 8
+// samples plus a little noise: group k has sizes[k] genes following
+// profile profiles[k], negated if negated[k]. group[g] is the group of
+// gene g.
+func plantedGroups(sizes, profiles []int, negated []bool) (expr *ExpressionMatrix, group []int) {
+	walsh := [][]float64{
+		{1, 1, 1, 1, -1, -1, -1, -1},
+		{1, 1, -1, -1, 1, 1, -1, -1},
+		{1, -1, 1, -1, 1, -1, 1, -1},
+	}
+	rng := rand.New(rand.NewSource(3))
+	expr = &ExpressionMatrix{Samples: []string{"S1", "S2", "S3", "S4", "S5", "S6", "S7", "S8"}}
+	for k, size := range sizes {
+		weight := 1.0
+		if negated[k] {
+			weight = -1
+		}
+		for i := 0; i < size; i++ {
+			row := make([]float64, len(expr.Samples))
+			for s := range row {
+				row[s] = 5 + weight*walsh[profiles[k]][s] + 0.2*rng.NormFloat64()
+			}
+			expr.Genes = append(expr.Genes, fmt.Sprintf("G%d", len(expr.Genes)+1))
+			expr.Data = append(expr.Data, row)
+			group = append(group, k)
+		}
+	}
+	// Interleave the groups, so that no block is a run of rows by chance.
+	order := rng.Perm(len(expr.Genes))
+	shuffled := expr.Subset(order)
+	shuffledGroup := make([]int, len(order))
+	for r, g := range order {
+		shuffledGroup[r] = group[g]
+	}
+	return shuffled, shuffledGroup
+}
+
+// checkBlocks fails the test unless every gene is in exactly one block of
+// at most maxSize genes, listed in ascending order, with the blocks
+// largest first.
+func checkBlocks(t *testing.T, name string, blocks [][]int, numGenes, maxSize int) {
+	t.Helper()
+	seen := make([]int, numGenes)
+	for b, block := range blocks {
+		if len(block) > maxSize {
+			t.Errorf("%s: block %d has %d genes, more than %d", name, b+1, len(block), maxSize)
+		}
+		if b > 0 && len(block) > len(blocks[b-1]) {
+			t.Errorf("%s: block %d is larger than block %d", name, b+1, b)
+		}
+		if !slices.IsSorted(block) {
+			t.Errorf("%s: block %d is not in ascending order: %v", name, b+1, block)
+		}
+		for _, g := range block {
+			seen[g]++
+		}
+	}
+	for g, n := range seen {
+		if n != 1 {
+			t.Errorf("%s: gene %d is in %d blocks", name, g, n)
+		}
+	}
+}
+
+// blockGroups returns the sorted groups of the genes of every block.
+func blockGroups(blocks [][]int, group []int) [][]int {
+	groups := make([][]int, len(blocks))
+	for b, block := range blocks {
+		for _, g := range block {
+			if !slices.Contains(groups[b], group[g]) {
+				groups[b] = append(groups[b], group[g])
+			}
+		}
+		slices.Sort(groups[b])
+	}
+	return groups
+}
+
+func TestProjectiveKMeansSeparatesGroups(t *testing.T) {
+	// Two co-expressed groups of 20 genes in blocks of at most 20: each
+	// group must be a block, whatever the number of centres.
+	expr, group := plantedGroups([]int{20, 20}, []int{0, 1}, []bool{false, false})
+	for _, numCenters := range []int{2, 4, 7} {
+		name := fmt.Sprintf("%d centres", numCenters)
+		blocks, err := ProjectiveKMeans(expr, BlockOptions{MaxBlockSize: 20, NumCenters: numCenters, Type: Signed, Seed: 1, Workers: 2})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkBlocks(t, name, blocks, expr.NumGenes(), 20)
+		if got := blockGroups(blocks, group); len(got) != 2 || len(got[0]) != 1 || len(got[1]) != 1 || got[0][0] == got[1][0] {
+			t.Errorf("%s: the blocks hold the groups %v, want one group each", name, got)
+		}
+	}
+
+	// A block size that fits neither group still covers every gene once.
+	blocks, err := ProjectiveKMeans(expr, BlockOptions{MaxBlockSize: 7, Type: Signed, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks(t, "blocks of 7", blocks, expr.NumGenes(), 7)
+	for b, groups := range blockGroups(blocks, group) {
+		if len(groups) != 1 {
+			t.Errorf("blocks of 7: block %d mixes the groups %v", b+1, groups)
+		}
+	}
+}
+
+func TestProjectiveKMeansUnsigned(t *testing.T) {
+	// Groups 0 and 1 follow the same profile with opposite signs, group 2
+	// another one, 10 genes each in blocks of at most 20. By |cor|, groups
+	// 0 and 1 are one cluster; by cor they are the least similar, so group
+	// 0 or 1 goes with group 2 instead.
+	expr, group := plantedGroups([]int{10, 10, 10}, []int{0, 0, 1}, []bool{false, true, false})
+	tests := []struct {
+		networkType NetworkType
+		want        [][]int
+	}{
+		{Unsigned, [][]int{{0, 1}, {2}}},
+		{Signed, nil},
+	}
+	for _, tt := range tests {
+		blocks, err := ProjectiveKMeans(expr, BlockOptions{MaxBlockSize: 20, NumCenters: 3, Type: tt.networkType, Seed: 1})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.networkType, err)
+		}
+		checkBlocks(t, string(tt.networkType), blocks, expr.NumGenes(), 20)
+		got := blockGroups(blocks, group)
+		if tt.want != nil {
+			if !slices.EqualFunc(got, tt.want, slices.Equal[[]int]) {
+				t.Errorf("%s: the blocks hold the groups %v, want %v", tt.networkType, got, tt.want)
+			}
+			continue
+		}
+		for b, groups := range got {
+			if slices.Contains(groups, 0) && slices.Contains(groups, 1) {
+				t.Errorf("%s: block %d holds the opposite groups 0 and 1", tt.networkType, b+1)
+			}
+		}
+	}
+}
+
+func TestSplitCluster(t *testing.T) {
+	// Genes on the unit circle, whose correlations with the centre (1, 0)
+	// are their first coordinates. The 5 genes are cut into 3 parts of 1,
+	// 2 and 2 genes, most similar first.
+	coordinates := []float64{0.1, -0.9, 0.5, 0.8, -0.3}
+	z := make([][]float64, len(coordinates))
+	for g, x := range coordinates {
+		z[g] = []float64{x, math.Sqrt(1 - x*x)}
+	}
+	members := []int{0, 1, 2, 3, 4}
+	tests := []struct {
+		unsigned bool
+		want     [][]int
+	}{
+		// |cor|: 0.9 (gene 1), 0.8 (3), 0.5 (2), 0.3 (4), 0.1 (0).
+		{true, [][]int{{1}, {2, 3}, {0, 4}}},
+		// cor: 0.8 (3), 0.5 (2), 0.1 (0), -0.3 (4), -0.9 (1).
+		{false, [][]int{{3}, {0, 2}, {1, 4}}},
+	}
+	for _, tt := range tests {
+		parts := splitCluster(z, members, []float64{1, 0}, 2, tt.unsigned)
+		var got [][]int
+		for _, p := range parts {
+			got = append(got, p.members)
+			assertClose(t, fmt.Sprintf("unsigned %v: length of the centre of %v", tt.unsigned, p.members), dot(p.center, p.center), 1, 1e-12)
+		}
+		if !slices.EqualFunc(got, tt.want, slices.Equal[[]int]) {
+			t.Errorf("unsigned %v: parts = %v, want %v", tt.unsigned, got, tt.want)
+		}
+	}
+	if parts := splitCluster(z, members, []float64{1, 0}, 5, true); len(parts) != 1 || !slices.Equal(parts[0].members, members) {
+		t.Errorf("a cluster that fits is split into %v", parts)
+	}
+}
+
+func TestMergeClusters(t *testing.T) {
+	// One gene per cluster, at its centre: genes 0 and 1 are opposite,
+	// gene 2 is orthogonal to both. By |cor| genes 0 and 1 are the most
+	// similar; by cor they are the least, and the first pair at cor 0,
+	// genes 0 and 2, merges instead. Blocks hold at most 2 genes.
+	z := [][]float64{{1, 0}, {-1, 0}, {0, 1}}
+	tests := []struct {
+		unsigned bool
+		want     [][]int
+	}{
+		{true, [][]int{{0, 1}, {2}}},
+		{false, [][]int{{0, 2}, {1}}},
+	}
+	for _, tt := range tests {
+		clusters := make([]blockCluster, len(z))
+		for g := range z {
+			clusters[g] = blockCluster{members: []int{g}, center: z[g]}
+		}
+		if got := mergeClusters(z, clusters, 2, tt.unsigned); !slices.EqualFunc(got, tt.want, slices.Equal[[]int]) {
+			t.Errorf("unsigned %v: blocks = %v, want %v", tt.unsigned, got, tt.want)
+		}
+	}
+
+	// When the size allows, every cluster ends in one block.
+	z = append(z, []float64{0.6, 0.8}, []float64{0.8, 0.6})
+	clusters := []blockCluster{{[]int{0, 4}, z[0]}, {[]int{2}, z[2]}, {[]int{1, 3}, z[3]}}
+	if got := mergeClusters(z, clusters, 5, true); len(got) != 1 || !slices.Equal(got[0], []int{0, 1, 2, 3, 4}) {
+		t.Errorf("blocks = %v, want [[0 1 2 3 4]]", got)
+	}
+}
@@ -0,0 +1,189 @@
+package wgcna
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+)
+
+// prepareCorrelationRows turns every gene row into a vector u such that
+// the correlation of genes i and j is sum_k u_i[k] * u_j[k].
+// This is the per-gene statistics step of Phase 2; the pairwise step
+// only computes dot products, whatever the method.
+func prepareCorrelationRows(matrix [][]float64, opts CorrelationOptions) ([][]float64, error) {
+	opts = opts.withDefaults()
+	if opts.Method == Kendall && len(matrix) > 0 && len(matrix[0]) > KendallMaxSamples {
+		return nil, fmt.Errorf("kendall correlation is limited to %d samples, got %d (use spearman)",
+			KendallMaxSamples, len(matrix[0]))
+	}
+	normalized := make([][]float64, len(matrix))
+	fallbacks := 0
+	for i, row := range matrix {
+		switch opts.Method {
+		case Bicor:
+			u, ok := bicorRow(row, opts.MaxPOutliers)
+			if !ok {
+				fallbacks++
+				if opts.PearsonFallback == FallbackIndividual {
+					u = pearsonRow(row)
+				} else {
+					// A zero row correlates 0 with every gene.
+					u = make([]float64, len(row))
+				}
+			}
+			normalized[i] = u
+		case Spearman:
+			normalized[i] = pearsonRow(averageRanks(row))
+		case Kendall:
+			normalized[i] = kendallRow(row)
+		default:
+			normalized[i] = pearsonRow(row)
+		}
+	}
+	if fallbacks > 0 {
+		if opts.PearsonFallback == FallbackIndividual {
+			log.Printf("  (P2) %d genes have zero median absolute deviation; using Pearson for them", fallbacks)
+		} else {
+			log.Printf("  (P2) warning: %d genes have zero median absolute deviation; their correlations are set to 0", fallbacks)
+		}
+	}
+	return normalized, nil
+}
+
+// pearsonRow centres x by its mean and scales it to unit length.
+// A constant row becomes all zeros.
+func pearsonRow(x []float64) []float64 {
+	u := make([]float64, len(x))
+	m := mean(x)
+	for k, v := range x {
+		u[k] = v - m
+	}
+	return normalizeLength(u)
+}
+
+// bicorRow computes the biweight midcorrelation weights of x as in WGCNA:
+//
+//	u_k = (x_k - med) / (9 * mad)
+//	w_k = (1 - u_k^2)^2 if |u_k| < 1, else 0
+//	x~_k = (x_k - med) * w_k, scaled to unit length
+//
+// mad is the raw median absolute deviation. When maxPOutliers < 1 and more
+// than that fraction of samples on one side of the median would get zero
+// weight, that side's 9*mad is widened to the distance from the median to the
+// maxPOutliers (or 1-maxPOutliers) quantile.
+// ok is false if mad is zero; the caller then falls back to Pearson.
+func bicorRow(x []float64, maxPOutliers float64) (u []float64, ok bool) {
+	sorted := append([]float64(nil), x...)
+	sort.Float64s(sorted)
+	med := median(sorted)
+
+	deviations := make([]float64, len(x))
+	for k, v := range x {
+		deviations[k] = math.Abs(v - med)
+	}
+	sort.Float64s(deviations)
+	mad := median(deviations)
+	if mad == 0 {
+		return nil, false
+	}
+
+	lowerScale, upperScale := 9*mad, 9*mad
+	if maxPOutliers < 1 {
+		if d := med - quantile(sorted, maxPOutliers); d > lowerScale {
+			lowerScale = d
+		}
+		if d := quantile(sorted, 1-maxPOutliers) - med; d > upperScale {
+			upperScale = d
+		}
+	}
+
+	u = make([]float64, len(x))
+	for k, v := range x {
+		scale := upperScale
+		if v < med {
+			scale = lowerScale
+		}
+		uk := (v - med) / scale
+		if math.Abs(uk) >= 1 {
+			continue
+		}
+		w := (1 - uk*uk) * (1 - uk*uk)
+		u[k] = (v - med) * w
+	}
+	return normalizeLength(u), true
+}
+
+// averageRanks returns the 1-based ranks of x; tied values share the
+// average of the ranks they span (R's rank(ties.method = "average")).
+func averageRanks(x []float64) []float64 {
+	order := make([]int, len(x))
+	for k := range order {
+		order[k] = k
+	}
+	sort.SliceStable(order, func(a, b int) bool { return x[order[a]] < x[order[b]] })
+
+	ranks := make([]float64, len(x))
+	for start := 0; start < len(order); {
+		end := start + 1
+		for end < len(order) && x[order[end]] == x[order[start]] {
+			end++
+		}
+		// Positions start..end-1 hold ranks start+1..end.
+		avg := float64(start+1+end) / 2
+		for k := start; k < end; k++ {
+			ranks[order[k]] = avg
+		}
+		start = end
+	}
+	return ranks
+}
+
+// kendallRow returns the vector of signs sgn(x_k - x_l) over all sample
+// pairs k < l, scaled to unit length. The dot product of two such vectors is
+//
+//	sum_{k<l} sgn(x_k - x_l) sgn(y_k - y_l) / sqrt((n0 - n1)(n0 - n2))
+//
+// which is Kendall's tau-b, because the squared length of a sign vector is
+// the number of untied pairs n0 - n1 (or n0 - n2).
+func kendallRow(x []float64) []float64 {
+	u := make([]float64, 0, len(x)*(len(x)-1)/2)
+	for k := 0; k < len(x); k++ {
+		for l := k + 1; l < len(x); l++ {
+			u = append(u, sign(x[k]-x[l]))
+		}
+	}
+	return normalizeLength(u)
+}
+
+// normalizeLength scales u in place to unit Euclidean length.
+// An all-zero vector is returned unchanged.
+func normalizeLength(u []float64) []float64 {
+	sumSq := 0.0
+	for _, v := range u {
+		sumSq += v * v
+	}
+	if sumSq == 0 {
+		return u
+	}
+	inv := 1 / math.Sqrt(sumSq)
+	for k := range u {
+		u[k] *= inv
+	}
+	return u
+}
+
+// quantile returns the p-quantile of an already sorted slice,
+// with linear interpolation (R's default type 7).
+func quantile(sorted []float64, p float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	h := float64(n-1) * p
+	lo := int(math.Floor(h))
+	if lo >= n-1 {
+		return sorted[n-1]
+	}
+	return sorted[lo] + (h-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
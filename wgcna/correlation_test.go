@@ -0,0 +1,256 @@
+package wgcna
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestCorrelateMatchesReference(t *testing.T) {
+	// Sizes below, at and across the 64-gene tiles.
+	for _, genes := range []int{1, 5, tileRows, tileRows + 1, 2*tileRows + 7} {
+		expr := syntheticExpression(genes, 23, 4, int64(genes))
+		// A constant gene correlates 0 with every other gene.
+		for s := range expr.Data[0] {
+			expr.Data[0][s] = 3
+		}
+		got, err := Correlate(expr, CorrelationOptions{Method: Pearson, Workers: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := referenceCorrelation(expr.Data)
+		if diff := maxAbsDiff(want, got); diff > 1e-12 {
+			t.Errorf("%d genes: max |Correlate - reference| = %g", genes, diff)
+		}
+	}
+}
+
+func BenchmarkCorrelate(b *testing.B) {
+	expr := syntheticExpression(1000, 200, 8, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Correlate(expr, CorrelationOptions{Method: Pearson}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCorrelateReference(b *testing.B) {
+	expr := syntheticExpression(1000, 200, 8, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		referenceCorrelation(expr.Data)
+	}
+}
+
+func TestBicorRow(t *testing.T) {
+	// x = (1, 2, 3, 4, 100) has median 3 and MAD 1, so u = (x - 3) / 9: 100
+	// is an outlier with weight 0, and the others get (1 - u^2)^2, which
+	// is a = (77/81)^2 at distance 2 and b = (80/81)^2 at distance 1.
+	a, b := math.Pow(77.0/81, 2), math.Pow(80.0/81, 2)
+	norm := math.Sqrt(4*a*a + 2*b*b)
+	want := []float64{-2 * a / norm, -b / norm, 0, b / norm, 0}
+	u, ok := bicorRow([]float64{1, 2, 3, 4, 100}, 1)
+	if !ok {
+		t.Fatal("MAD of (1, 2, 3, 4, 100) is zero")
+	}
+	for k := range want {
+		assertClose(t, "bicor weights of (1, 2, 3, 4, 100)", u[k], want[k], 1e-12)
+	}
+}
+
+func TestBicorRowMaxPOutliers(t *testing.T) {
+	// x = (0, ..., 6, 50, 60, 70) has median 4.5 and MAD 3, so 9 * MAD = 27
+	// leaves the 3 largest of 10 samples with weight 0. With maxPOutliers
+	// 0.1 the upper scale widens to the 0.9 quantile, 61 (type 7: 60 + 0.1
+	// * 10), less the median: 56.5, which keeps 50 and 60. The lower side
+	// has no outliers and keeps 27.
+	x := []float64{0, 1, 2, 3, 4, 5, 6, 50, 60, 70}
+	for _, tt := range []struct {
+		maxPOutliers, upperScale float64
+	}{
+		{1, 27},
+		{0.1, 56.5},
+	} {
+		want := make([]float64, len(x))
+		for k, v := range x {
+			d := v - 4.5
+			scale := tt.upperScale
+			if d < 0 {
+				scale = 27
+			}
+			if u := d / scale; math.Abs(u) < 1 {
+				want[k] = d * (1 - u*u) * (1 - u*u)
+			}
+		}
+		want = normalizeLength(want)
+		u, ok := bicorRow(x, tt.maxPOutliers)
+		if !ok {
+			t.Fatal("MAD is zero")
+		}
+		for k := range want {
+			assertClose(t, fmt.Sprintf("maxPOutliers %v: weight %d", tt.maxPOutliers, k), u[k], want[k], 1e-12)
+		}
+		if kept := u[7] != 0 && u[8] != 0; kept != (tt.maxPOutliers < 1) || u[9] != 0 {
+			t.Errorf("maxPOutliers %v: weights of 50, 60 and 70 are %v", tt.maxPOutliers, u[7:])
+		}
+	}
+}
+
+func TestCorrelateBicor(t *testing.T) {
+	// y = (2, 4, 6, 8, 10) has median 6 and MAD 2: its weights are those
+	// of x = (1, 2, 3, 4, 100) (see TestBicorRow) without the outlier,
+	// (-4a, -2b, 0, 2b, 4a), so bicor(x, y) = (8a^2 + 4b^2) /
+	// sqrt((4a^2 + 2b^2) (32a^2 + 8b^2)). The other genes have a zero
+	// MAD: with the individual fallback they correlate by Pearson (1 with
+	// each other), and with none they correlate 0 with every other gene.
+	expr := &ExpressionMatrix{
+		Genes:   []string{"X", "Y", "Z", "W"},
+		Samples: []string{"S1", "S2", "S3", "S4", "S5"},
+		Data: [][]float64{
+			{1, 2, 3, 4, 100},
+			{2, 4, 6, 8, 10},
+			{5, 5, 5, 5, 9},
+			{1, 1, 1, 1, 3},
+		},
+	}
+	a2, b2 := math.Pow(77.0/81, 4), math.Pow(80.0/81, 4)
+	xy := (8*a2 + 4*b2) / math.Sqrt((4*a2+2*b2)*(32*a2+8*b2))
+	// With the fallback, Z and W are mixed with the bicor weights of X
+	// and Y.
+	zxBicor := dot(pearsonRow(expr.Data[2]), must(bicorRow(expr.Data[0], 1)))
+	zyBicor := dot(pearsonRow(expr.Data[2]), must(bicorRow(expr.Data[1], 1)))
+	tests := []struct {
+		fallback PearsonFallback
+		want     [][]float64
+	}{
+		{FallbackIndividual, [][]float64{
+			{1, xy, zxBicor, zxBicor},
+			{xy, 1, zyBicor, zyBicor},
+			{zxBicor, zyBicor, 1, 1},
+			{zxBicor, zyBicor, 1, 1},
+		}},
+		{FallbackNone, [][]float64{
+			{1, xy, 0, 0},
+			{xy, 1, 0, 0},
+			{0, 0, 1, 0},
+			{0, 0, 0, 1},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := Correlate(expr, CorrelationOptions{Method: Bicor, PearsonFallback: tt.fallback})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range tt.want {
+			for j := range tt.want[i] {
+				assertClose(t, fmt.Sprintf("%s fallback: bicor(%s, %s)", tt.fallback, expr.Genes[i], expr.Genes[j]),
+					got.At(i, j), tt.want[i][j], 1e-12)
+			}
+		}
+	}
+}
+
+// must returns the weights of bicorRow, which must not fall back.
+func must(u []float64, ok bool) []float64 {
+	if !ok {
+		panic("bicorRow fell back to Pearson")
+	}
+	return u
+}
+
+func TestAverageRanks(t *testing.T) {
+	// rank(x, ties.method = "average") in R.
+	tests := []struct {
+		x, want []float64
+	}{
+		{[]float64{3, 1, 4, 1, 5}, []float64{3, 1.5, 4, 1.5, 5}},
+		{[]float64{10, 20, 10, 30, 20, 10}, []float64{2, 4.5, 2, 6, 4.5, 2}},
+		{[]float64{2, 2, 2}, []float64{2, 2, 2}},
+		{[]float64{-1, 0.5}, []float64{1, 2}},
+		{nil, []float64{}},
+	}
+	for _, tt := range tests {
+		if got := averageRanks(tt.x); !slices.Equal(got, tt.want) {
+			t.Errorf("averageRanks(%v) = %v, want %v", tt.x, got, tt.want)
+		}
+	}
+}
+
+func TestKendallRow(t *testing.T) {
+	// The signs of x_k - x_l over the pairs (1,2), (1,3), (2,3), ...; a tie
+	// is 0 and does not count in the length.
+	tests := []struct {
+		x, want []float64
+	}{
+		{[]float64{1, 2, 2}, []float64{-1 / math.Sqrt2, -1 / math.Sqrt2, 0}},
+		{[]float64{3, 1, 2}, []float64{1 / math.Sqrt(3), 1 / math.Sqrt(3), -1 / math.Sqrt(3)}},
+		{[]float64{4, 4, 4}, []float64{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		got := kendallRow(tt.x)
+		if len(got) != len(tt.want) {
+			t.Fatalf("kendallRow(%v) = %v, want %v", tt.x, got, tt.want)
+		}
+		for k := range tt.want {
+			assertClose(t, fmt.Sprintf("kendallRow(%v)[%d]", tt.x, k), got[k], tt.want[k], 1e-15)
+		}
+	}
+}
+
+func TestCorrelateRanksWithTies(t *testing.T) {
+	// cor(x, y, method = "spearman") is the Pearson correlation of the
+	// average ranks; cor(x, y, method = "kendall") is tau-b = S /
+	// sqrt((n0 - n1)(n0 - n2)), with S the concordant minus the discordant
+	// pairs, n0 the pairs and n1, n2 the pairs tied in x and in y.
+	tests := []struct {
+		x, y              []float64
+		spearman, kendall float64
+	}{
+		// Ranks (1, 2.5, 2.5, 4) and (1, 3, 2, 4): 4.5 / sqrt(4.5 * 5).
+		// S = 5 (the pair tied in x counts 0), n1 = 1: 5 / sqrt(5 * 6).
+		{[]float64{1, 2, 2, 3}, []float64{1, 3, 2, 4}, 3 / math.Sqrt(10), 5 / math.Sqrt(30)},
+		// One concordant and one discordant pair; the rest are tied.
+		{[]float64{1, 1, 2, 2}, []float64{1, 2, 1, 2}, 0, 0},
+		// y = 6 - x: the ties match, so both are -1.
+		{[]float64{1, 2, 3, 3, 5}, []float64{5, 4, 3, 3, 1}, -1, -1},
+		// Ranks (2, 2, 2, 4, 5) and (3, 2, 4.5, 4.5, 1), centred (-1, -1,
+		// -1, 1, 2) and (0, -1, 1.5, 1.5, -2): -3 / sqrt(8 * 9.5). Of the 10
+		// pairs, 3 are tied in x and 1 in y; 2 are concordant and 4
+		// discordant: -2 / sqrt(7 * 9).
+		{[]float64{1, 1, 1, 2, 3}, []float64{2, 1, 3, 3, 0}, -3 / math.Sqrt(76), -2 / math.Sqrt(63)},
+	}
+	for _, tt := range tests {
+		expr := &ExpressionMatrix{Genes: []string{"X", "Y"}, Data: [][]float64{tt.x, tt.y}}
+		for s := range tt.x {
+			expr.Samples = append(expr.Samples, fmt.Sprintf("S%d", s+1))
+		}
+		for _, method := range []struct {
+			method CorrelationMethod
+			want   float64
+		}{
+			{Spearman, tt.spearman},
+			{Kendall, tt.kendall},
+		} {
+			got, err := Correlate(expr, CorrelationOptions{Method: method.method})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertClose(t, fmt.Sprintf("cor(%v, %v, method = %q)", tt.x, tt.y, method.method), got.At(0, 1), method.want, 1e-12)
+		}
+	}
+}
+
+func TestKendallMaxSamples(t *testing.T) {
+	for _, samples := range []int{KendallMaxSamples, KendallMaxSamples + 1} {
+		expr := syntheticExpression(3, samples, 1, 1)
+		_, err := Correlate(expr, CorrelationOptions{Method: Kendall})
+		if tooMany := samples > KendallMaxSamples; (err != nil) != tooMany {
+			t.Errorf("%d samples: error %v", samples, err)
+		}
+		if _, err := Correlate(expr, CorrelationOptions{Method: Spearman}); err != nil {
+			t.Errorf("%d samples, spearman: %v", samples, err)
+		}
+	}
+}
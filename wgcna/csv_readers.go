@@ -0,0 +1,152 @@
+package wgcna
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// The CSV readers load the matrices written by ExpressionMatrix.WriteCSV
+// and NetworkMatrix.WriteCSV, so a run can resume from a CSV output.
+// Those files hold 6 decimals; the .bin format (see binary_format.go)
+// resumes without any rounding.
+
+// ReadExpressionCSV loads a gene x sample matrix written by
+// ExpressionMatrix.WriteCSV: a gene_id column, then one column per sample.
+func ReadExpressionCSV(path string) (*ExpressionMatrix, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(bufio.NewReaderSize(file, 1<<20))
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read header: %w", path, err)
+	}
+	expr := &ExpressionMatrix{Samples: append([]string(nil), header[1:]...)}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		row, err := parseCSVValues(record[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: gene %s: %w", path, record[0], err)
+		}
+		expr.Genes = append(expr.Genes, record[0])
+		expr.Data = append(expr.Data, row)
+	}
+	if err := expr.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return expr, nil
+}
+
+// ReadNetworkCSV loads a symmetric matrix written by NetworkMatrix.WriteCSV
+// with the given precision and storage (as for a computed matrix). The
+// column labels must repeat the row labels, and the values must be
+// symmetric.
+func ReadNetworkCSV(path string, precision Precision, storage MatrixStorage) (*NetworkMatrix, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(bufio.NewReaderSize(file, 1<<20))
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read header: %w", path, err)
+	}
+	genes := append([]string(nil), header[1:]...)
+	data, err := allocSymMatrix(len(genes), precision, storage)
+	if err != nil {
+		return nil, err
+	}
+	m := &NetworkMatrix{Genes: genes, Data: data}
+	if err := readNetworkRows(reader, m); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// ReadNetworkCSVGenes reads only the gene labels of a network CSV.
+func ReadNetworkCSVGenes(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header, err := csv.NewReader(bufio.NewReader(file)).Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read header: %w", path, err)
+	}
+	return header[1:], nil
+}
+
+// readNetworkRows fills m from the data rows of a network CSV.
+func readNetworkRows(reader *csv.Reader, m *NetworkMatrix) error {
+	n := m.Size()
+	for i := 0; ; i++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			if i != n {
+				return fmt.Errorf("%d rows for %d columns", i, n)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if i >= n {
+			return fmt.Errorf("more rows than the %d columns", n)
+		}
+		if record[0] != m.Genes[i] {
+			return fmt.Errorf("row %d is %s but column %d is %s", i+1, record[0], i+1, m.Genes[i])
+		}
+		row, err := parseCSVValues(record[1:])
+		if err != nil {
+			return fmt.Errorf("gene %s: %w", record[0], err)
+		}
+		// The lower triangle was stored from earlier rows; it must match.
+		for j := 0; j < i; j++ {
+			if !sameStoredValue(m.Data, row[j], m.At(j, i)) {
+				return fmt.Errorf("not symmetric: (%s, %s) is %v but (%s, %s) is %v",
+					m.Genes[i], m.Genes[j], row[j], m.Genes[j], m.Genes[i], m.At(j, i))
+			}
+		}
+		m.Data.writeUpper(i, row[i:])
+	}
+}
+
+// sameStoredValue reports whether v, once stored in m, equals stored.
+func sameStoredValue(m *SymMatrix, v, stored float64) bool {
+	if m.Precision() == Float32 {
+		return float32(v) == float32(stored)
+	}
+	return v == stored
+}
+
+// parseCSVValues parses one row of numbers.
+func parseCSVValues(fields []string) ([]float64, error) {
+	values := make([]float64, len(fields))
+	for k, field := range fields {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", field)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,10 @@
+// Package wgcna holds the computational core of the WGCNA-PLUMBER pipeline:
+// GTF/GCT parsing and TPM normalization, the correlation, adjacency and
+// topological overlap matrices, the gene dendrogram and its Dynamic Tree
+// Cut into modules, the module eigengenes, the merging of close modules,
+// module membership (kME), intramodular connectivity and hub genes, and
+// the CSV writers used between phases.
+//
+// The wgcna command in the repository root and cmd/build-gct are thin
+// wrappers around this package.
+package wgcna
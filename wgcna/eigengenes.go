@@ -0,0 +1,253 @@
+package wgcna
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// EigengeneOptions controls ModuleEigengenes.
+type EigengeneOptions struct {
+	// ExcludeGrey leaves out the eigengene of the genes in no module
+	// (UnassignedModule), like moduleEigengenes(excludeGrey = TRUE).
+	ExcludeGrey bool
+	// ColorNames names the eigengenes after the module colours (MEgrey,
+	// MEturquoise, ...; see ModuleColor) instead of the labels.
+	ColorNames bool
+	// Workers is the number of goroutines; 0 means runtime.NumCPU().
+	Workers int
+}
+
+// Eigengenes are the module eigengenes of an expression matrix: the first
+// principal component of the standardized expression of each module's
+// genes, one value per sample.
+type Eigengenes struct {
+	Samples []string
+	// Modules are the module labels in increasing order; UnassignedModule
+	// comes first unless it was excluded.
+	Modules []int
+	// Names[k] is the name of the eigengene of module Modules[k].
+	Names []string
+	// Sizes[k] is the number of genes of module Modules[k].
+	Sizes []int
+	// Values[k][s] is the eigengene of module Modules[k] in sample s. Every
+	// eigengene has mean 0 and unit length, like R's svd(...)$u[, 1].
+	Values [][]float64
+	// VarianceExplained[k] is the fraction of the variance of module
+	// Modules[k] its eigengene explains: the mean squared correlation of
+	// the eigengene with the module's genes.
+	VarianceExplained []float64
+}
+
+// EigengeneName names the eigengene of a module label as R does for
+// numeric labels ("ME0" for the genes in no module, "ME1", ...).
+func EigengeneName(label int) string {
+	return "ME" + strconv.Itoa(label)
+}
+
+// ModuleEigengenes computes the eigengene of every module, like WGCNA's
+// moduleEigengenes(expr, colors = labels) with its defaults. labels[g] is
+// the module of gene g of expr (a CutTreeDynamic result, for instance).
+//
+// The genes of a module are centred and scaled to unit variance, and the
+// eigengene is the first left singular vector of that gene x sample matrix,
+// found by power iteration. Its sign is chosen as WGCNA's align = "along
+// average" does: it correlates positively with the average standardized
+// expression of the module. Genes of zero variance weigh nothing and are
+// left out of the variance explained.
+func ModuleEigengenes(expr *ExpressionMatrix, labels []int, opts EigengeneOptions) (*Eigengenes, error) {
+	if err := expr.Validate(); err != nil {
+		return nil, err
+	}
+	if len(labels) != expr.NumGenes() {
+		return nil, fmt.Errorf("%d module labels for %d genes", len(labels), expr.NumGenes())
+	}
+	members := make(map[int][]int)
+	for g, label := range labels {
+		if label < 0 {
+			return nil, fmt.Errorf("gene %s has module label %d; labels must be >= 0", expr.Genes[g], label)
+		}
+		if label == UnassignedModule && opts.ExcludeGrey {
+			continue
+		}
+		members[label] = append(members[label], g)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no module to compute an eigengene for")
+	}
+
+	e := &Eigengenes{Samples: expr.Samples}
+	for label := range members {
+		e.Modules = append(e.Modules, label)
+	}
+	sort.Ints(e.Modules)
+	e.Names = make([]string, len(e.Modules))
+	for k, label := range e.Modules {
+		e.Names[k] = EigengeneName(label)
+		if opts.ColorNames {
+			e.Names[k] = "ME" + ModuleColor(label)
+		}
+	}
+	e.Sizes = make([]int, len(e.Modules))
+	e.Values = make([][]float64, len(e.Modules))
+	e.VarianceExplained = make([]float64, len(e.Modules))
+
+	modules := make(chan int, len(e.Modules))
+	for k := range e.Modules {
+		modules <- k
+	}
+	close(modules)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workerCount(opts.Workers), len(e.Modules)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range modules {
+				genes := members[e.Modules[k]]
+				z := make([][]float64, len(genes))
+				for i, g := range genes {
+					z[i] = pearsonRow(expr.Data[g])
+				}
+				e.Sizes[k] = len(genes)
+				e.Values[k], e.VarianceExplained[k] = eigengene(z)
+			}
+		}()
+	}
+	wg.Wait()
+	return e, nil
+}
+
+// Power iteration stops once the eigengene moves less than
+// eigengeneTolerance, or after eigengeneMaxIterations.
+const (
+	eigengeneTolerance     = 1e-10
+	eigengeneMaxIterations = 10000
+)
+
+// eigengene returns the first principal component of the rows of z
+// (centred, unit length or all zero), aligned with their sum, and the mean
+// squared correlation of the non-zero rows with it.
+func eigengene(z [][]float64) (pc []float64, varExplained float64) {
+	width := len(z[0])
+	// The sum of the rows is the average standardized expression, up to a
+	// positive factor, and the starting point of the iteration.
+	average := make([]float64, width)
+	for _, row := range z {
+		for s, x := range row {
+			average[s] += x
+		}
+	}
+	v := append([]float64(nil), average...)
+	if dot(v, v) == 0 {
+		for _, row := range z {
+			if dot(row, row) > 0 {
+				copy(v, row)
+				break
+			}
+		}
+	}
+	if dot(v, v) == 0 {
+		// Every gene of the module is constant.
+		return v, 0
+	}
+	v = normalizeLength(v)
+
+	next := make([]float64, width)
+	for iteration := 0; iteration < eigengeneMaxIterations; iteration++ {
+		for s := range next {
+			next[s] = 0
+		}
+		for _, row := range z {
+			d := dot(row, v)
+			for s, x := range row {
+				next[s] += d * x
+			}
+		}
+		next = normalizeLength(next)
+		change := 0.0
+		for s := range next {
+			change += (next[s] - v[s]) * (next[s] - v[s])
+		}
+		v, next = next, v
+		if math.Sqrt(change) < eigengeneTolerance {
+			break
+		}
+	}
+	if dot(average, v) < 0 {
+		for s := range v {
+			v[s] = -v[s]
+		}
+	}
+
+	// v and the rows are centred and of unit length, so their dot product
+	// is their correlation.
+	var sum float64
+	var n int
+	for _, row := range z {
+		if dot(row, row) == 0 {
+			continue
+		}
+		r := dot(row, v)
+		sum += r * r
+		n++
+	}
+	return v, sum / float64(n)
+}
+
+// WriteCSV saves the eigengenes as an eigengene x sample table: an
+// Eigengene column with their names and one column per sample. In R,
+// t(read.csv(path, row.names = 1)) gives the MEs data frame of
+// moduleEigengenes.
+func (e *Eigengenes) WriteCSV(filePath string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write(append([]string{"Eigengene"}, e.Samples...))
+	row := make([]string, len(e.Samples)+1)
+	for k, values := range e.Values {
+		row[0] = e.Names[k]
+		for s, v := range values {
+			row[s+1] = strconv.FormatFloat(v, 'f', 6, 64)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// WriteVarianceExplainedCSV saves the size of every module and the
+// fraction of its variance the eigengene explains (moduleEigengenes'
+// varExplained), with the columns Module_Label, Eigengene, Genes and
+// Variance_Explained.
+func (e *Eigengenes) WriteVarianceExplainedCSV(filePath string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write([]string{"Module_Label", "Eigengene", "Genes", "Variance_Explained"})
+	for k, label := range e.Modules {
+		w.Write([]string{
+			strconv.Itoa(label),
+			e.Names[k],
+			strconv.Itoa(e.Sizes[k]),
+			strconv.FormatFloat(e.VarianceExplained[k], 'f', 6, 64),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
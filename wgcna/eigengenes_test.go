@@ -0,0 +1,134 @@
+package wgcna
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestModuleEigengenesHandComputed(t *testing.T) {
+	// Every gene of modules 1 and 2 is a multiple of u = (-3, -1, 1, 3) /
+	// sqrt(20) after standardization, so the eigengene is +-u and explains
+	// all the variance; the majority of the genes of module 2 decrease, so
+	// its eigengene does too. The genes of module 3 correlate by 0.8: the
+	// eigengene is their normalized sum, which explains (1 + 0.8) / 2 of
+	// the variance. The constant gene of module 0 is left out of the
+	// variance explained, and module 4 has no variance at all.
+	expr := &ExpressionMatrix{
+		Genes:   []string{"A", "B", "C", "D", "E", "F", "G", "H", "K", "L", "M"},
+		Samples: []string{"S1", "S2", "S3", "S4"},
+		Data: [][]float64{
+			{1, 2, 3, 4},
+			{2, 4, 6, 8},
+			{4, 3, 2, 1},
+			{8, 6, 4, 2},
+			{5, 4, 3, 2},
+			{0, 1, 2, 3},
+			{1, 2, 3, 4},
+			{1, 3, 2, 4},
+			{3, 3, 3, 3},
+			{9, 10, 11, 12},
+			{7, 7, 7, 7},
+		},
+	}
+	labels := []int{1, 1, 1, 2, 2, 2, 3, 3, 0, 0, 4}
+	u := []float64{-3 / math.Sqrt(20), -1 / math.Sqrt(20), 1 / math.Sqrt(20), 3 / math.Sqrt(20)}
+	want := []struct {
+		size   int
+		values []float64
+		ve     float64
+	}{
+		{2, u, 1},
+		{3, u, 1},
+		{3, []float64{u[3], u[2], u[1], u[0]}, 1},
+		{2, []float64{-1 / math.Sqrt2, 0, 0, 1 / math.Sqrt2}, 0.9},
+		{1, []float64{0, 0, 0, 0}, 0},
+	}
+
+	e, err := ModuleEigengenes(expr, labels, EigengeneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(e.Modules, []int{0, 1, 2, 3, 4}) || !slices.Equal(e.Names, []string{"ME0", "ME1", "ME2", "ME3", "ME4"}) {
+		t.Fatalf("modules = %v, names = %v", e.Modules, e.Names)
+	}
+	for k, w := range want {
+		if e.Sizes[k] != w.size {
+			t.Errorf("%s: %d genes, want %d", e.Names[k], e.Sizes[k], w.size)
+		}
+		for s := range w.values {
+			assertClose(t, fmt.Sprintf("%s[%d]", e.Names[k], s), e.Values[k][s], w.values[s], 1e-9)
+		}
+		assertClose(t, e.Names[k]+" variance explained", e.VarianceExplained[k], w.ve, 1e-12)
+	}
+
+	e, err = ModuleEigengenes(expr, labels, EigengeneOptions{ExcludeGrey: true, ColorNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(e.Modules, []int{1, 2, 3, 4}) || e.Names[0] != "ME"+ModuleColor(1) {
+		t.Errorf("without grey: modules = %v, names = %v", e.Modules, e.Names)
+	}
+}
+
+func TestModuleEigengenesArePrincipalComponents(t *testing.T) {
+	// On noisy data the eigengene must still be a centred unit vector, an
+	// eigenvector of the module's sample x sample covariance whose
+	// eigenvalue is the variance explained times the module size, and
+	// aligned with the module's average.
+	expr := syntheticExpression(60, 15, 3, 7)
+	labels := make([]int, expr.NumGenes())
+	for g := range labels {
+		labels[g] = g % 4
+	}
+	e, err := ModuleEigengenes(expr, labels, EigengeneOptions{Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, label := range e.Modules {
+		v := e.Values[k]
+		var z [][]float64
+		for g := range labels {
+			if labels[g] == label {
+				z = append(z, pearsonRow(expr.Data[g]))
+			}
+		}
+		var sum float64
+		for _, x := range v {
+			sum += x
+		}
+		assertClose(t, e.Names[k]+" mean", sum/float64(len(v)), 0, 1e-12)
+		assertClose(t, e.Names[k]+" length", math.Sqrt(dot(v, v)), 1, 1e-12)
+
+		cov := make([]float64, len(v))
+		average := make([]float64, len(v))
+		for _, row := range z {
+			d := dot(row, v)
+			for s, x := range row {
+				cov[s] += d * x
+				average[s] += x
+			}
+		}
+		lambda := dot(cov, v)
+		for s := range v {
+			assertClose(t, fmt.Sprintf("%s: (Z'Z v - lambda v)[%d]", e.Names[k], s), cov[s]-lambda*v[s], 0, 1e-8)
+		}
+		assertClose(t, e.Names[k]+" variance explained", e.VarianceExplained[k], lambda/float64(len(z)), 1e-12)
+		if dot(average, v) < 0 {
+			t.Errorf("%s points away from the module's average", e.Names[k])
+		}
+	}
+}
+
+func TestModuleEigengenesRejectsBadLabels(t *testing.T) {
+	expr := syntheticExpression(4, 5, 1, 1)
+	for _, labels := range [][]int{{1, 1, 1}, {1, -1, 1, 1}} {
+		if _, err := ModuleEigengenes(expr, labels, EigengeneOptions{}); err == nil {
+			t.Errorf("labels %v: no error", labels)
+		}
+	}
+	if _, err := ModuleEigengenes(expr, []int{0, 0, 0, 0}, EigengeneOptions{ExcludeGrey: true}); err == nil {
+		t.Error("only grey genes with ExcludeGrey: no error")
+	}
+}
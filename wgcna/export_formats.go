@@ -0,0 +1,263 @@
+package wgcna
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Export formats for downstream tools that cannot read the binary .bin
+// format directly:
+//
+//   - .npy: the dense matrix as a NumPy array (np.load, or np.load with
+//     mmap_mode="r" to map it);
+//   - .npz: an uncompressed NumPy archive with the dense matrix as "matrix"
+//     and the labels as "genes" (and "samples" for the expression matrix);
+//   - .rmat: the dense matrix as raw little-endian values in column-major
+//     order, which R can read with readBin or map with the mmap package,
+//     plus a .rmat.txt text descriptor with the dimensions, the value type
+//     and the labels.
+//
+// Network matrices are expanded from their packed storage row by row, so
+// the full matrix is never held in memory.
+
+// rowSource streams the rows of a rows x cols matrix to fn.
+type rowSource struct {
+	rows, cols int
+	dtype      Precision
+	forEach    func(fn func(i int, row []float64) error) error
+}
+
+func networkRows(m *NetworkMatrix) rowSource {
+	return rowSource{rows: m.Size(), cols: m.Size(), dtype: m.Data.Precision(), forEach: m.Data.forEachRow}
+}
+
+func expressionRows(e *ExpressionMatrix) rowSource {
+	return rowSource{rows: e.NumGenes(), cols: e.NumSamples(), dtype: Float64,
+		forEach: func(fn func(i int, row []float64) error) error {
+			for i, row := range e.Data {
+				if err := fn(i, row); err != nil {
+					return err
+				}
+			}
+			return nil
+		}}
+}
+
+// WriteNPY saves the dense matrix as a NumPy .npy file.
+func (m *NetworkMatrix) WriteNPY(path string) error {
+	if err := m.validateSquare(); err != nil {
+		return err
+	}
+	return writeFile(path, func(w io.Writer) error { return writeNPYMatrix(w, networkRows(m)) })
+}
+
+// WriteNPZ saves the dense matrix and the gene labels as a NumPy .npz archive.
+func (m *NetworkMatrix) WriteNPZ(path string) error {
+	if err := m.validateSquare(); err != nil {
+		return err
+	}
+	return writeNPZ(path, networkRows(m), map[string][]string{"genes": m.Genes})
+}
+
+// WriteRMatrix saves the dense matrix in the R-mappable .rmat layout.
+func (m *NetworkMatrix) WriteRMatrix(path string) error {
+	if err := m.validateSquare(); err != nil {
+		return err
+	}
+	// Symmetric, so the row-major rows are also the column-major columns.
+	if err := writeFile(path, func(w io.Writer) error { return writeRawRows(w, networkRows(m)) }); err != nil {
+		return err
+	}
+	return writeRMatrixDescriptor(path, m.Size(), m.Size(), m.Data.Precision(), m.Genes, m.Genes)
+}
+
+// WriteNPY saves the gene x sample matrix as a NumPy .npy file.
+func (e *ExpressionMatrix) WriteNPY(path string) error {
+	return writeFile(path, func(w io.Writer) error { return writeNPYMatrix(w, expressionRows(e)) })
+}
+
+// WriteNPZ saves the matrix and its gene and sample labels as a NumPy .npz archive.
+func (e *ExpressionMatrix) WriteNPZ(path string) error {
+	return writeNPZ(path, expressionRows(e), map[string][]string{"genes": e.Genes, "samples": e.Samples})
+}
+
+// WriteRMatrix saves the gene x sample matrix in the R-mappable .rmat layout.
+func (e *ExpressionMatrix) WriteRMatrix(path string) error {
+	err := writeFile(path, func(w io.Writer) error {
+		// Column-major: sample by sample.
+		column := make([]float64, e.NumGenes())
+		for s := 0; s < e.NumSamples(); s++ {
+			for g, row := range e.Data {
+				column[g] = row[s]
+			}
+			if err := writeFloats(w, column); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeRMatrixDescriptor(path, e.NumGenes(), e.NumSamples(), Float64, e.Genes, e.Samples)
+}
+
+// writeFile creates path and writes it through a buffer.
+func writeFile(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer file.Close()
+	w := bufio.NewWriterSize(file, 1<<20)
+	if err := write(w); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// writeRawRows writes every row as little-endian values of the source's dtype.
+func writeRawRows(w io.Writer, src rowSource) error {
+	row32 := make([]float32, src.cols)
+	return src.forEach(func(i int, row []float64) error {
+		if src.dtype == Float32 {
+			for k, v := range row {
+				row32[k] = float32(v)
+			}
+			return writeFloats(w, row32)
+		}
+		return writeFloats(w, row)
+	})
+}
+
+// writeNPYHeader writes the magic, version and header dictionary of a
+// C-order .npy array, padded so the data starts at a multiple of 64 bytes.
+func writeNPYHeader(w io.Writer, descr string, shape ...int) error {
+	dims := make([]string, len(shape))
+	for k, d := range shape {
+		dims[k] = fmt.Sprint(d)
+	}
+	shapeText := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		shapeText += ","
+	}
+	dict := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", descr, shapeText)
+
+	// Version 1.0 has a 2-byte header length, 2.0 a 4-byte one.
+	prefixLen, major := 10, byte(1)
+	if len(dict)+1+prefixLen+64 > math.MaxUint16 {
+		prefixLen, major = 12, 2
+	}
+	total := (prefixLen + len(dict) + 1 + 63) / 64 * 64
+	dict += strings.Repeat(" ", total-prefixLen-len(dict)-1) + "\n"
+
+	var header bytes.Buffer
+	header.WriteString("\x93NUMPY")
+	header.Write([]byte{major, 0})
+	if major == 1 {
+		binary.Write(&header, binary.LittleEndian, uint16(len(dict)))
+	} else {
+		binary.Write(&header, binary.LittleEndian, uint32(len(dict)))
+	}
+	header.WriteString(dict)
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+// npyDescr is the NumPy dtype of a precision.
+func npyDescr(p Precision) string {
+	if p == Float32 {
+		return "<f4"
+	}
+	return "<f8"
+}
+
+// writeNPYMatrix writes a rows x cols .npy array.
+func writeNPYMatrix(w io.Writer, src rowSource) error {
+	if err := writeNPYHeader(w, npyDescr(src.dtype), src.rows, src.cols); err != nil {
+		return err
+	}
+	return writeRawRows(w, src)
+}
+
+// writeNPYStrings writes labels as a 1-d NumPy unicode array ('<U n'),
+// UTF-32 code points padded to the longest label.
+func writeNPYStrings(w io.Writer, labels []string) error {
+	width := 1
+	for _, label := range labels {
+		width = max(width, utf8.RuneCountInString(label))
+	}
+	if err := writeNPYHeader(w, fmt.Sprintf("<U%d", width), len(labels)); err != nil {
+		return err
+	}
+	buf := make([]byte, 4*width)
+	for _, label := range labels {
+		for k := range buf {
+			buf[k] = 0
+		}
+		k := 0
+		for _, r := range label {
+			binary.LittleEndian.PutUint32(buf[4*k:], uint32(r))
+			k++
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNPZ writes an uncompressed .npz archive holding matrix.npy and one
+// string array per entry of labels.
+func writeNPZ(path string, src rowSource, labels map[string][]string) error {
+	return writeFile(path, func(w io.Writer) error {
+		archive := zip.NewWriter(w)
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: "matrix.npy", Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if err := writeNPYMatrix(entry, src); err != nil {
+			return err
+		}
+		for _, name := range []string{"genes", "samples"} {
+			if _, ok := labels[name]; !ok {
+				continue
+			}
+			entry, err := archive.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: zip.Store})
+			if err != nil {
+				return err
+			}
+			if err := writeNPYStrings(entry, labels[name]); err != nil {
+				return err
+			}
+		}
+		return archive.Close()
+	})
+}
+
+// writeRMatrixDescriptor writes <path>.txt: "rows cols dtype" on the first
+// line, then one row label per line, then one column label per line.
+func writeRMatrixDescriptor(path string, rows, cols int, dtype Precision, rowLabels, colLabels []string) error {
+	return writeFile(path+".txt", func(w io.Writer) error {
+		if _, err := fmt.Fprintf(w, "%d %d %s\n", rows, cols, dtype); err != nil {
+			return err
+		}
+		for _, label := range append(append([]string(nil), rowLabels...), colLabels...) {
+			if _, err := fmt.Fprintln(w, label); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
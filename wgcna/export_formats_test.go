@@ -0,0 +1,262 @@
+package wgcna
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// npyHeaderPattern matches the header dictionary writeNPYHeader writes.
+var npyHeaderPattern = regexp.MustCompile(`^\{'descr': '([^']*)', 'fortran_order': (True|False), 'shape': \(([0-9, ]*)\), \} *\n$`)
+
+// parseNPY checks the framing of a .npy file, as np.load reads it, and
+// returns its dtype, shape and data.
+func parseNPY(t *testing.T, name string, raw []byte) (descr string, shape []int, data []byte) {
+	t.Helper()
+	if len(raw) < 10 || string(raw[:6]) != "\x93NUMPY" || raw[7] != 0 {
+		t.Fatalf("%s: not a .npy file: % x", name, raw[:min(len(raw), 10)])
+	}
+	var prefix, start int
+	switch raw[6] {
+	case 1:
+		prefix = 10
+		start = prefix + int(binary.LittleEndian.Uint16(raw[8:]))
+	case 2:
+		prefix = 12
+		start = prefix + int(binary.LittleEndian.Uint32(raw[8:]))
+	default:
+		t.Fatalf("%s: version %d.%d", name, raw[6], raw[7])
+	}
+	if start%64 != 0 {
+		t.Errorf("%s: the data starts at byte %d, not a multiple of 64", name, start)
+	}
+	if start > len(raw) {
+		t.Fatalf("%s: header of %d bytes in a file of %d", name, start, len(raw))
+	}
+	dict := string(raw[prefix:start])
+	match := npyHeaderPattern.FindStringSubmatch(dict)
+	if match == nil {
+		t.Fatalf("%s: header %q", name, dict)
+	}
+	if match[2] != "False" {
+		t.Errorf("%s: fortran_order %s", name, match[2])
+	}
+	for _, d := range strings.Split(match[3], ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			n, err := strconv.Atoi(d)
+			if err != nil {
+				t.Fatalf("%s: shape (%s)", name, match[3])
+			}
+			shape = append(shape, n)
+		}
+	}
+	return match[1], shape, raw[start:]
+}
+
+// decodeNPYStrings decodes the data of a '<U width' array.
+func decodeNPYStrings(data []byte, width int) []string {
+	var labels []string
+	for ; len(data) >= 4*width; data = data[4*width:] {
+		var runes []rune
+		for k := 0; k < width; k++ {
+			if r := rune(binary.LittleEndian.Uint32(data[4*k:])); r != 0 {
+				runes = append(runes, r)
+			}
+		}
+		labels = append(labels, string(runes))
+	}
+	return labels
+}
+
+// decodeFloats decodes little-endian float64 ("<f8") or float32 ("<f4") values.
+func decodeFloats(data []byte, descr string) []float64 {
+	var values []float64
+	if descr == "<f4" {
+		for k := 0; k+4 <= len(data); k += 4 {
+			values = append(values, float64(math.Float32frombits(binary.LittleEndian.Uint32(data[k:]))))
+		}
+		return values
+	}
+	for k := 0; k+8 <= len(data); k += 8 {
+		values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(data[k:])))
+	}
+	return values
+}
+
+// exportNetwork returns a 3-gene network matrix whose entry (i, j) is
+// 10 i + j for i <= j, so the expanded matrix is
+//
+//	0  1  2
+//	1 11 12
+//	2 12 22
+func exportNetwork(precision Precision) (*NetworkMatrix, []float64) {
+	m := &NetworkMatrix{Genes: []string{"TP53", "gène", "BRCA1"}, Data: newSymMatrixInMemory(3, precision)}
+	for i := 0; i < 3; i++ {
+		for j := i; j < 3; j++ {
+			m.Set(i, j, float64(10*i+j))
+		}
+	}
+	return m, []float64{0, 1, 2, 1, 11, 12, 2, 12, 22}
+}
+
+func TestNetworkMatrixWriteNPY(t *testing.T) {
+	for _, precision := range []Precision{Float64, Float32} {
+		m, want := exportNetwork(precision)
+		path := filepath.Join(t.TempDir(), "tom.npy")
+		if err := m.WriteNPY(path); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descr, shape, data := parseNPY(t, path, raw)
+		if raw[6] != 1 {
+			t.Errorf("%s: version %d.0 for a small header", precision, raw[6])
+		}
+		if descr != npyDescr(precision) || !slices.Equal(shape, []int{3, 3}) {
+			t.Errorf("%s: dtype %s, shape %v", precision, descr, shape)
+		}
+		if len(data) != 9*precision.bytes() {
+			t.Errorf("%s: %d bytes of data, want %d", precision, len(data), 9*precision.bytes())
+		}
+		if got := decodeFloats(data, descr); !slices.Equal(got, want) {
+			t.Errorf("%s: values %v, want %v", precision, got, want)
+		}
+	}
+}
+
+func TestNPYHeaderVersion2(t *testing.T) {
+	// A header dictionary longer than 65,535 bytes needs version 2.0, with
+	// a 4-byte length; 1-d shapes keep their trailing comma.
+	var buf bytes.Buffer
+	descr := "<U" + strings.Repeat("9", 70000)
+	if err := writeNPYHeader(&buf, descr, 5); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	gotDescr, shape, data := parseNPY(t, "long header", raw)
+	if raw[6] != 2 || gotDescr != descr || !slices.Equal(shape, []int{5}) || len(data) != 0 {
+		t.Errorf("version %d.0, shape %v, %d bytes after the header", raw[6], shape, len(data))
+	}
+	if !strings.Contains(string(raw), "'shape': (5,)") {
+		t.Error("the 1-d shape has no trailing comma")
+	}
+}
+
+func TestWriteNPZ(t *testing.T) {
+	m, wantMatrix := exportNetwork(Float32)
+	expr := &ExpressionMatrix{
+		Genes:   []string{"A", "gène-with-a-long-name"},
+		Samples: []string{"S1", "S2", "Σ3"},
+		Data:    [][]float64{{1, 2, 3}, {4, 5, 6}},
+	}
+	tests := []struct {
+		name    string
+		write   func(path string) error
+		descr   string
+		shape   []int
+		values  []float64
+		entries map[string][]string
+	}{
+		{"network", m.WriteNPZ, "<f4", []int{3, 3}, wantMatrix,
+			map[string][]string{"genes": m.Genes}},
+		{"expression", expr.WriteNPZ, "<f8", []int{2, 3}, []float64{1, 2, 3, 4, 5, 6},
+			map[string][]string{"genes": expr.Genes, "samples": expr.Samples}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.name+".npz")
+		if err := tt.write(path); err != nil {
+			t.Fatal(err)
+		}
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		defer archive.Close()
+
+		wantNames := []string{"matrix.npy", "genes.npy"}
+		if len(tt.entries) == 2 {
+			wantNames = append(wantNames, "samples.npy")
+		}
+		var names []string
+		for _, f := range archive.File {
+			names = append(names, f.Name)
+			if f.Method != zip.Store {
+				t.Errorf("%s: %s is compressed with method %d", tt.name, f.Name, f.Method)
+			}
+			r, err := f.Open()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			raw, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			name := tt.name + " " + f.Name
+			descr, shape, data := parseNPY(t, name, raw)
+			if f.Name == "matrix.npy" {
+				if descr != tt.descr || !slices.Equal(shape, tt.shape) {
+					t.Errorf("%s: dtype %s, shape %v, want %s %v", name, descr, shape, tt.descr, tt.shape)
+				}
+				if got := decodeFloats(data, descr); !slices.Equal(got, tt.values) {
+					t.Errorf("%s: values %v, want %v", name, got, tt.values)
+				}
+				continue
+			}
+			// The width is the longest label in code points, not bytes.
+			labels := tt.entries[strings.TrimSuffix(f.Name, ".npy")]
+			width := 0
+			for _, label := range labels {
+				width = max(width, len([]rune(label)))
+			}
+			if descr != fmt.Sprintf("<U%d", width) || !slices.Equal(shape, []int{len(labels)}) || len(data) != 4*width*len(labels) {
+				t.Errorf("%s: dtype %s, shape %v, %d bytes of data, want <U%d of %d labels", name, descr, shape, len(data), width, len(labels))
+			}
+			if got := decodeNPYStrings(data, width); !slices.Equal(got, labels) {
+				t.Errorf("%s: labels %q, want %q", name, got, labels)
+			}
+		}
+		if !slices.Equal(names, wantNames) {
+			t.Errorf("%s: entries %v, want %v", tt.name, names, wantNames)
+		}
+	}
+}
+
+func TestWriteRMatrix(t *testing.T) {
+	// readBin fills an R matrix column by column.
+	expr := &ExpressionMatrix{
+		Genes:   []string{"A", "B"},
+		Samples: []string{"S1", "S2", "S3"},
+		Data:    [][]float64{{1, 2, 3}, {4, 5, 6}},
+	}
+	path := filepath.Join(t.TempDir(), "expr.rmat")
+	if err := expr.WriteRMatrix(path); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decodeFloats(raw, "<f8"), []float64{1, 4, 2, 5, 3, 6}; !slices.Equal(got, want) {
+		t.Errorf("values %v, want %v", got, want)
+	}
+	descriptor, err := os.ReadFile(path + ".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2 3 float64\nA\nB\nS1\nS2\nS3\n"; string(descriptor) != want {
+		t.Errorf("descriptor %q, want %q", descriptor, want)
+	}
+}
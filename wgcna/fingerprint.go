@@ -0,0 +1,44 @@
+package wgcna
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// Fingerprint returns the SHA-256 hash of the genes, samples and values,
+// which identifies the content of the matrix (e.g. as a cache key).
+func (e *ExpressionMatrix) Fingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "expression %d %d\n", e.NumGenes(), e.NumSamples())
+	writeLabels(h, e.Genes)
+	writeLabels(h, e.Samples)
+	for _, row := range e.Data {
+		writeFloats(h, row)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Fingerprint returns the SHA-256 hash of the genes, the precision and the
+// stored values. Matrices with the same values in different precisions
+// have different fingerprints.
+func (m *NetworkMatrix) Fingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "network %d %s\n", m.Size(), m.Data.Precision())
+	writeLabels(h, m.Genes)
+	if m.Data.data32 != nil {
+		writeFloats(h, m.Data.data32)
+	} else {
+		writeFloats(h, m.Data.data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeLabels writes each label with its length, so that no two label
+// lists produce the same bytes.
+func writeLabels(w io.Writer, labels []string) {
+	for _, label := range labels {
+		fmt.Fprintf(w, "%d:%s", len(label), label)
+	}
+}
@@ -0,0 +1,57 @@
+package wgcna
+
+import "testing"
+
+// networkPhases runs the correlation, adjacency, TOM and dissimilarity of
+// expr with the given storage precision.
+func networkPhases(tb testing.TB, expr *ExpressionMatrix, precision Precision) []*NetworkMatrix {
+	tb.Helper()
+	corr, err := Correlate(expr, CorrelationOptions{Precision: precision})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	adj, err := Adjacency(corr, DefaultAdjacencyOptions())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tom, err := TOM(adj, TOMOptions{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dissim, err := Dissimilarity(tom)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return []*NetworkMatrix{corr, adj, tom, dissim}
+}
+
+func TestFloat32ErrorBound(t *testing.T) {
+	// Only storage is single precision, so every value is off by its own
+	// rounding plus that of its input (amplified by at most beta in the
+	// adjacency): below half a unit of the 6 decimals of the CSVs.
+	const bound = 5e-7
+	expr := syntheticExpression(2*tileRows+11, 40, 5, 3)
+	want := networkPhases(t, expr, Float64)
+	got := networkPhases(t, expr, Float32)
+	for p, name := range []string{"correlation", "adjacency", "tom", "dissimilarity"} {
+		if got[p].Data.Precision() != Float32 {
+			t.Errorf("%s is stored in %s, want float32", name, got[p].Data.Precision())
+		}
+		diff := maxAbsDiff(want[p].Data.Dense(), got[p])
+		t.Logf("%s: max |float32 - float64| = %.2g", name, diff)
+		if diff > bound {
+			t.Errorf("%s: max |float32 - float64| = %g, want <= %g", name, diff, bound)
+		}
+	}
+}
+
+func BenchmarkNetworkPhases(b *testing.B) {
+	expr := syntheticExpression(1000, 200, 8, 1)
+	for _, precision := range Precisions {
+		b.Run(string(precision), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				networkPhases(b, expr, precision)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package wgcna
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// Linkage selects how hierarchical clustering measures the distance
+// between two clusters. The names match the method argument of R's hclust.
+type Linkage string
+
+const (
+	// AverageLinkage is the mean distance between the genes of the two
+	// clusters (UPGMA), the linkage WGCNA uses for gene trees.
+	AverageLinkage Linkage = "average"
+	// CompleteLinkage is the largest distance between their genes.
+	CompleteLinkage Linkage = "complete"
+	// SingleLinkage is the smallest distance between their genes.
+	SingleLinkage Linkage = "single"
+	// WardLinkage is Ward's minimum variance criterion on the unsquared
+	// dissimilarities, R's "ward.D2" (scipy's "ward"): merge heights are the
+	// square root of the Lance-Williams update of squared distances.
+	WardLinkage Linkage = "ward.D2"
+)
+
+// Linkages lists every supported linkage.
+var Linkages = []Linkage{AverageLinkage, CompleteLinkage, SingleLinkage, WardLinkage}
+
+// Dendrogram is a hierarchical clustering of genes, laid out exactly like
+// R's hclust object so that it can be handed to R as is:
+//
+//   - Merge[k] are the two clusters joined at step k+1: a negative entry
+//     -i is gene i (1-based), a positive entry j the cluster formed at step
+//     j. Genes come before clusters, and the smaller index first.
+//   - Height[k] is the dissimilarity at which step k+1 joins them; heights
+//     never decrease.
+//   - Order lists the genes (1-based) in the left-to-right order of the
+//     plotted tree.
+type Dendrogram struct {
+	Labels []string  `json:"labels"`
+	Merge  [][2]int  `json:"merge"`
+	Height []float64 `json:"height"`
+	Order  []int     `json:"order"`
+	Method Linkage   `json:"method"`
+}
+
+// Size returns the number of genes (leaves).
+func (d *Dendrogram) Size() int { return len(d.Labels) }
+
+// HierarchicalCluster builds the agglomerative clustering of the genes of
+// a dissimilarity matrix (the output of Dissimilarity), like R's
+// hclust(as.dist(dist), method = linkage).
+//
+// It uses the nearest-neighbour chain algorithm: follow nearest neighbours
+// from any cluster until two clusters are each other's nearest neighbour,
+// merge them, and continue from the rest of the chain. For the four
+// linkages here that yields the same tree as always merging the globally
+// closest pair, in O(n^2) time instead of O(n^3). Distances to a merged
+// cluster follow the Lance-Williams updates on a float64 copy of dist,
+// which counts against the memory budget of dist's storage.
+//
+// Merges at exactly equal heights may be listed in a different order
+// than R's, which can swap equivalent branches.
+func HierarchicalCluster(dist *NetworkMatrix, linkage Linkage) (*Dendrogram, error) {
+	if err := dist.validateSquare(); err != nil {
+		return nil, err
+	}
+	switch linkage {
+	case AverageLinkage, CompleteLinkage, SingleLinkage, WardLinkage:
+	default:
+		return nil, fmt.Errorf("unknown linkage %q", linkage)
+	}
+	n := dist.Size()
+	work, err := allocSymMatrix(n, Float64, dist.Data.storage, dist.Data)
+	if err != nil {
+		return nil, err
+	}
+	defer work.Close()
+	var buf []float64
+	for i := 0; i < n; i++ {
+		row := dist.Data.readUpper(i, buf)
+		for k, v := range row[1:] {
+			if math.IsNaN(v) || v < 0 {
+				return nil, fmt.Errorf("dissimilarity of %s and %s is %v; it must be a number >= 0",
+					dist.Genes[i], dist.Genes[i+1+k], v)
+			}
+		}
+		work.writeUpper(i, row)
+		buf = row
+	}
+	if linkage == WardLinkage {
+		work.Apply(func(v float64) float64 { return v * v })
+	}
+
+	steps := nnChain(work, linkage)
+	if linkage == WardLinkage {
+		for k := range steps {
+			steps[k].height = math.Sqrt(steps[k].height)
+		}
+	}
+	return newDendrogram(dist.Genes, steps, linkage), nil
+}
+
+// chainStep is one merge found by nnChain: the clusters represented by
+// genes a and b, joined at height.
+type chainStep struct {
+	a, b   int
+	height float64
+}
+
+// nnChain runs the nearest-neighbour chain on d, which it overwrites. A
+// cluster is represented by its lowest-numbered gene; the steps are
+// returned in the order they were found, which is not sorted by height.
+func nnChain(d *SymMatrix, linkage Linkage) []chainStep {
+	n := d.Size()
+	size := make([]float64, n)
+	// alive lists the representatives of the current clusters in ascending
+	// order, which makes ties break the same way in every run.
+	alive := make([]int, n)
+	for i := range alive {
+		size[i] = 1
+		alive[i] = i
+	}
+	steps := make([]chainStep, 0, max(n-1, 0))
+	chain := make([]int, 0, n)
+	for len(alive) > 1 {
+		if len(chain) == 0 {
+			chain = append(chain, alive[0])
+		}
+		// Extend the chain until its last two clusters are reciprocal
+		// nearest neighbours. On ties the previous cluster wins, which
+		// guarantees that the chain stops.
+		var a, b int
+		var best float64
+		for {
+			a = chain[len(chain)-1]
+			b, best = -1, math.Inf(1)
+			if len(chain) > 1 {
+				b = chain[len(chain)-2]
+				best = d.At(a, b)
+			}
+			for _, x := range alive {
+				if x == a {
+					continue
+				}
+				if v := d.At(a, x); v < best {
+					b, best = x, v
+				}
+			}
+			if len(chain) > 1 && b == chain[len(chain)-2] {
+				break
+			}
+			chain = append(chain, b)
+		}
+		chain = chain[:len(chain)-2]
+
+		keep, drop := min(a, b), max(a, b)
+		steps = append(steps, chainStep{keep, drop, best})
+		na, nb := size[a], size[b]
+		for _, k := range alive {
+			if k == a || k == b {
+				continue
+			}
+			da, db := d.At(a, k), d.At(b, k)
+			var v float64
+			switch linkage {
+			case AverageLinkage:
+				v = (na*da + nb*db) / (na + nb)
+			case CompleteLinkage:
+				v = max(da, db)
+			case SingleLinkage:
+				v = min(da, db)
+			case WardLinkage:
+				nk := size[k]
+				v = ((na+nk)*da + (nb+nk)*db - nk*best) / (na + nb + nk)
+			}
+			d.Set(keep, k, v)
+		}
+		size[keep] = na + nb
+		pos := sort.SearchInts(alive, drop)
+		alive = append(alive[:pos], alive[pos+1:]...)
+	}
+	return steps
+}
+
+// newDendrogram sorts the steps by height and numbers them the way R's
+// hclust does.
+func newDendrogram(genes []string, steps []chainStep, linkage Linkage) *Dendrogram {
+	n := len(genes)
+	// A stable sort keeps a cluster before the merges that use it, even at
+	// equal heights, since nnChain found it first.
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].height < steps[j].height })
+
+	d := &Dendrogram{
+		Labels: genes,
+		Merge:  make([][2]int, len(steps)),
+		Height: make([]float64, len(steps)),
+		Method: linkage,
+	}
+	// node[r] is the R number of the cluster represented by gene r.
+	node := make([]int, n)
+	for i := range node {
+		node[i] = -(i + 1)
+	}
+	for k, s := range steps {
+		x, y := node[s.a], node[s.b]
+		if (x > 0 && y < 0) || (x < 0 && y < 0 && x < y) || (x > 0 && y > 0 && x > y) {
+			x, y = y, x
+		}
+		d.Merge[k] = [2]int{x, y}
+		d.Height[k] = s.height
+		node[s.a] = k + 1
+	}
+	d.Order = dendrogramOrder(d.Merge, n)
+	return d
+}
+
+// dendrogramOrder lists the leaves from left to right: each merge puts
+// its first cluster left of its second, as in R.
+func dendrogramOrder(merge [][2]int, n int) []int {
+	if n == 1 {
+		return []int{1}
+	}
+	order := make([]int, 0, n)
+	stack := []int{len(merge)}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if node < 0 {
+			order = append(order, -node)
+			continue
+		}
+		pair := merge[node-1]
+		stack = append(stack, pair[1], pair[0])
+	}
+	return order
+}
+
+// WriteJSON saves the dendrogram as a JSON object with the fields of R's
+// hclust object; in R,
+//
+//	structure(jsonlite::fromJSON(path), class = "hclust")
+//
+// gives a tree that plot, cutree and cutreeDynamic accept.
+func (d *Dendrogram) WriteJSON(path string) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// ReadDendrogram loads a dendrogram written by WriteJSON.
+func ReadDendrogram(path string) (*Dendrogram, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var d Dendrogram
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	n := d.Size()
+	if n == 0 || len(d.Merge) != n-1 || len(d.Height) != n-1 || len(d.Order) != n {
+		return nil, fmt.Errorf("%s: %d labels need %d merges, heights and %d order entries, got %d, %d and %d",
+			path, n, max(n-1, 0), n, len(d.Merge), len(d.Height), len(d.Order))
+	}
+	return &d, nil
+}
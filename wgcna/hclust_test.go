@@ -0,0 +1,109 @@
+package wgcna
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+// lineDistances returns the dissimilarity matrix of points on a line,
+// like R's dist(x).
+func lineDistances(x []float64) *NetworkMatrix {
+	genes := make([]string, len(x))
+	for i := range genes {
+		genes[i] = fmt.Sprintf("G%d", i+1)
+	}
+	dist := NewNetworkMatrix(genes)
+	for i := range x {
+		for j := range x {
+			dist.Set(i, j, math.Abs(x[i]-x[j]))
+		}
+	}
+	return dist
+}
+
+func TestHierarchicalClusterMatchesR(t *testing.T) {
+	// The expected trees are those of hclust(dist(x), method): a
+	// singleton is -gene, a cluster is the step that formed it, a
+	// singleton comes before a cluster, and the smaller number comes
+	// first otherwise. The points have no tied distances, so the tree is
+	// unique.
+	line := []float64{1, 2, 4, 8, 13}
+	tests := []struct {
+		x       []float64
+		linkage Linkage
+		merge   [][2]int
+		height  []float64
+		order   []int
+	}{
+		{
+			x:       line,
+			linkage: SingleLinkage,
+			merge:   [][2]int{{-1, -2}, {-3, 1}, {-4, 2}, {-5, 3}},
+			height:  []float64{1, 2, 4, 5},
+			order:   []int{5, 4, 3, 1, 2},
+		},
+		{
+			x:       line,
+			linkage: CompleteLinkage,
+			merge:   [][2]int{{-1, -2}, {-3, 1}, {-4, -5}, {2, 3}},
+			height:  []float64{1, 3, 5, 12},
+			order:   []int{3, 1, 2, 4, 5},
+		},
+		{
+			// {1,2,4} to {8,13}: (7+6+4+12+11+9)/6.
+			x:       line,
+			linkage: AverageLinkage,
+			merge:   [][2]int{{-1, -2}, {-3, 1}, {-4, -5}, {2, 3}},
+			height:  []float64{1, 2.5, 5, 49.0 / 6},
+			order:   []int{3, 1, 2, 4, 5},
+		},
+		{
+			// sqrt(2 na nb / (na + nb)) times the distance of the
+			// centroids: 1.5 to 4, then 7/3 to 10.5.
+			x:       line,
+			linkage: WardLinkage,
+			merge:   [][2]int{{-1, -2}, {-3, 1}, {-4, -5}, {2, 3}},
+			height:  []float64{1, math.Sqrt(4.0/3) * 2.5, 5, math.Sqrt(12.0/5) * (10.5 - 7.0/3)},
+			order:   []int{3, 1, 2, 4, 5},
+		},
+		{
+			// The same points as the average case, in another order.
+			x:       []float64{8, 1, 13, 4, 2},
+			linkage: AverageLinkage,
+			merge:   [][2]int{{-2, -5}, {-4, 1}, {-1, -3}, {2, 3}},
+			height:  []float64{1, 2.5, 5, 49.0 / 6},
+			order:   []int{4, 2, 5, 1, 3},
+		},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s %v", tt.linkage, tt.x)
+		tree, err := HierarchicalCluster(lineDistances(tt.x), tt.linkage)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !slices.Equal(tree.Merge, tt.merge) {
+			t.Errorf("%s: merge = %v, want %v", name, tree.Merge, tt.merge)
+		}
+		if !slices.Equal(tree.Order, tt.order) {
+			t.Errorf("%s: order = %v, want %v", name, tree.Order, tt.order)
+		}
+		if len(tree.Height) != len(tt.height) {
+			t.Fatalf("%s: %d heights, want %d", name, len(tree.Height), len(tt.height))
+		}
+		for k := range tt.height {
+			assertClose(t, fmt.Sprintf("%s: height[%d]", name, k), tree.Height[k], tt.height[k], 1e-12)
+		}
+	}
+}
+
+func TestHierarchicalClusterSingleGene(t *testing.T) {
+	tree, err := HierarchicalCluster(lineDistances([]float64{3}), AverageLinkage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Merge) != 0 || !slices.Equal(tree.Order, []int{1}) {
+		t.Errorf("merge = %v, order = %v; want no merges and order [1]", tree.Merge, tree.Order)
+	}
+}
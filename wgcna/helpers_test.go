@@ -0,0 +1,82 @@
+package wgcna
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// TestMain silences the progress logs of the phases unless -v is given.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// syntheticExpression returns a genes x samples matrix whose genes follow
+// one of modules latent profiles (a quarter of them negatively) plus
+// noise, so that the network has modules; the same seed gives the same
+// matrix.
+func syntheticExpression(genes, samples, modules int, seed int64) *ExpressionMatrix {
+	rng := rand.New(rand.NewSource(seed))
+	profiles := make([][]float64, modules)
+	for m := range profiles {
+		profiles[m] = make([]float64, samples)
+		for s := range profiles[m] {
+			profiles[m][s] = rng.NormFloat64()
+		}
+	}
+	expr := &ExpressionMatrix{Data: make([][]float64, genes)}
+	for s := 0; s < samples; s++ {
+		expr.Samples = append(expr.Samples, fmt.Sprintf("S%d", s+1))
+	}
+	for g := range expr.Data {
+		expr.Genes = append(expr.Genes, fmt.Sprintf("G%d", g+1))
+		profile := profiles[g%modules]
+		weight := 0.5 + rng.Float64()
+		if rng.Intn(4) == 0 {
+			weight = -weight
+		}
+		expr.Data[g] = make([]float64, samples)
+		for s := range expr.Data[g] {
+			expr.Data[g][s] = 5 + weight*profile[s] + 0.6*rng.NormFloat64()
+		}
+	}
+	return expr
+}
+
+// assertClose fails the test if got and want differ by more than tol.
+func assertClose(t *testing.T, name string, got, want, tol float64) {
+	t.Helper()
+	if math.IsNaN(got) != math.IsNaN(want) || math.Abs(got-want) > tol {
+		t.Errorf("%s = %v, want %v (tolerance %g)", name, got, want, tol)
+	}
+}
+
+// maxAbsDiff returns the largest element-wise difference of a full matrix
+// and a network matrix.
+func maxAbsDiff(want [][]float64, got *NetworkMatrix) float64 {
+	worst := 0.0
+	for i := range want {
+		for j := range want[i] {
+			worst = math.Max(worst, math.Abs(want[i][j]-got.At(i, j)))
+		}
+	}
+	return worst
+}
+
+// newSquare allocates an n x n matrix.
+func newSquare(n int) [][]float64 {
+	m := make([][]float64, n)
+	for i := range m {
+		m[i] = make([]float64, n)
+	}
+	return m
+}
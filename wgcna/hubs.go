@@ -0,0 +1,385 @@
+package wgcna
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HubRanking selects how HubGenes orders the genes of a module.
+type HubRanking string
+
+const (
+	// RankKME ("kme") ranks by decreasing kME with the module eigengene, as
+	// the Shiny app's hub table does.
+	RankKME HubRanking = "kme"
+	// RankKWithin ("kwithin") ranks by decreasing intramodular connectivity.
+	RankKWithin HubRanking = "kwithin"
+	// RankCombined ("combined") ranks by the mean of the kME and kWithin
+	// ranks; ties go to the higher kME.
+	RankCombined HubRanking = "combined"
+)
+
+// HubRankings lists every supported hub ranking.
+var HubRankings = []HubRanking{RankKME, RankKWithin, RankCombined}
+
+// HubOptions controls HubGenes.
+type HubOptions struct {
+	// Ranking orders the genes of a module; "" means RankKME.
+	Ranking HubRanking
+	// TopN is the number of hub genes kept per module; 0 keeps every gene
+	// that passes the thresholds.
+	TopN int
+	// MinKME keeps the genes whose kME with their module's eigengene is
+	// above it; 0 means no threshold.
+	MinKME float64
+	// MinGS keeps the genes whose absolute gene significance is above it;
+	// 0 means no threshold. It needs the gene significance.
+	MinGS float64
+}
+
+// DefaultHubOptions returns the hub table of the Shiny app: the top 20
+// genes of every module by kME.
+func DefaultHubOptions() HubOptions {
+	return HubOptions{Ranking: RankKME, TopN: 20}
+}
+
+// withDefaults fills in the zero values.
+func (o HubOptions) withDefaults() HubOptions {
+	if o.Ranking == "" {
+		o.Ranking = RankKME
+	}
+	return o
+}
+
+// Validate checks the ranking and the thresholds.
+func (o HubOptions) Validate() error {
+	o = o.withDefaults()
+	switch o.Ranking {
+	case RankKME, RankKWithin, RankCombined:
+	default:
+		return fmt.Errorf("unknown hub ranking %q", o.Ranking)
+	}
+	if o.TopN < 0 {
+		return fmt.Errorf("number of hub genes must be >= 0, got %d", o.TopN)
+	}
+	if !(o.MinKME >= 0 && o.MinKME < 1) {
+		return fmt.Errorf("kME threshold must be in [0, 1), got %v", o.MinKME)
+	}
+	if !(o.MinGS >= 0 && o.MinGS < 1) {
+		return fmt.Errorf("gene significance threshold must be in [0, 1), got %v", o.MinGS)
+	}
+	return nil
+}
+
+// HubGene is a gene picked by HubGenes.
+type HubGene struct {
+	Gene   string
+	Module int
+	// Rank is the position of the gene among the hubs of its module, from 1.
+	Rank int
+	// KME is the kME of the gene with its module's eigengene.
+	KME     float64
+	KWithin float64
+	// KMERank and KWithinRank are the positions of the gene in its whole
+	// module by decreasing kME and kWithin, from 1.
+	KMERank, KWithinRank int
+	// GS and GSPValue are the gene significance and its p-value, NaN when
+	// it was not computed.
+	GS, GSPValue float64
+}
+
+// HubGenes picks the hub genes of every module (not of the genes in no
+// module): the genes are ranked as opts.Ranking says, those at or below
+// the kME and gene significance thresholds are dropped, and the first
+// opts.TopN are kept. Ties keep the order of the genes of m, like the
+// Shiny app's arrange(desc(kME)) %>% head(topN).
+//
+// labels[g] is the module of gene g of m and c. gs is the gene
+// significance of every gene and gsPValue its p-value (see
+// GeneSignificance); both may be nil when opts.MinGS is 0.
+func HubGenes(labels []int, m *ModuleMembership, c *Connectivity, gs, gsPValue []float64, opts HubOptions) ([]HubGene, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	if len(labels) != len(m.Genes) || len(c.Genes) != len(m.Genes) {
+		return nil, fmt.Errorf("%d module labels, %d genes with kME and %d with connectivity", len(labels), len(m.Genes), len(c.Genes))
+	}
+	if gs == nil && opts.MinGS > 0 {
+		return nil, fmt.Errorf("the gene significance threshold needs the gene significance")
+	}
+	if gs != nil && (len(gs) != len(labels) || len(gsPValue) != len(labels)) {
+		return nil, fmt.Errorf("gene significance of %d genes for %d genes", len(gs), len(labels))
+	}
+	eigengene := make(map[int]int, len(m.Modules))
+	for k, module := range m.Modules {
+		eigengene[module] = k
+	}
+	members := make(map[int][]int)
+	var modules []int
+	for g, label := range labels {
+		if label == UnassignedModule {
+			continue
+		}
+		if _, ok := eigengene[label]; !ok {
+			return nil, fmt.Errorf("module %d of gene %s has no eigengene", label, m.Genes[g])
+		}
+		if _, ok := members[label]; !ok {
+			modules = append(modules, label)
+		}
+		members[label] = append(members[label], g)
+	}
+	sort.Ints(modules)
+
+	var hubs []HubGene
+	for _, module := range modules {
+		genes := members[module]
+		kme := make([]float64, len(genes))
+		for i, g := range genes {
+			kme[i] = m.KME[g][eigengene[module]]
+		}
+		kmeRank := rankDecreasing(kme)
+		kWithin := make([]float64, len(genes))
+		for i, g := range genes {
+			kWithin[i] = c.KWithin[g]
+		}
+		kWithinRank := rankDecreasing(kWithin)
+
+		order := make([]int, len(genes))
+		for i := range order {
+			order[i] = i
+		}
+		switch opts.Ranking {
+		case RankKME:
+			sort.SliceStable(order, func(a, b int) bool { return kmeRank[order[a]] < kmeRank[order[b]] })
+		case RankKWithin:
+			sort.SliceStable(order, func(a, b int) bool { return kWithinRank[order[a]] < kWithinRank[order[b]] })
+		case RankCombined:
+			sort.SliceStable(order, func(a, b int) bool {
+				i, j := order[a], order[b]
+				if si, sj := kmeRank[i]+kWithinRank[i], kmeRank[j]+kWithinRank[j]; si != sj {
+					return si < sj
+				}
+				return kmeRank[i] < kmeRank[j]
+			})
+		}
+
+		rank := 0
+		for _, i := range order {
+			g := genes[i]
+			if opts.MinKME > 0 && !(kme[i] > opts.MinKME) {
+				continue
+			}
+			if opts.MinGS > 0 && !(math.Abs(gs[g]) > opts.MinGS) {
+				continue
+			}
+			rank++
+			hub := HubGene{
+				Gene: m.Genes[g], Module: module, Rank: rank,
+				KME: kme[i], KWithin: kWithin[i], KMERank: kmeRank[i], KWithinRank: kWithinRank[i],
+				GS: math.NaN(), GSPValue: math.NaN(),
+			}
+			if gs != nil {
+				hub.GS, hub.GSPValue = gs[g], gsPValue[g]
+			}
+			hubs = append(hubs, hub)
+			if rank == opts.TopN {
+				break
+			}
+		}
+	}
+	return hubs, nil
+}
+
+// rankDecreasing returns the position of every value when they are sorted
+// in decreasing order, from 1; ties keep their order, like R's
+// rank(-x, ties.method = "first"). NaN values (the kME of a constant
+// gene) come last.
+func rankDecreasing(values []float64) []int {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		x, y := values[order[a]], values[order[b]]
+		return x > y || (!math.IsNaN(x) && math.IsNaN(y))
+	})
+	rank := make([]int, len(values))
+	for r, i := range order {
+		rank[i] = r + 1
+	}
+	return rank
+}
+
+// Traits are the clinical traits of the samples, R's datTraits: a sample x
+// trait table.
+type Traits struct {
+	Samples []string
+	Names   []string
+	// Values[s][t] is trait Names[t] of sample Samples[s]; NaN if missing.
+	Values [][]float64
+}
+
+// ReadTraitsCSV loads a trait table: a header row with a first column for
+// the sample IDs and one column per trait, then one row per sample. Empty,
+// NA and NaN values are missing.
+func ReadTraitsCSV(path string) (*Traits, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(bufio.NewReader(file))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read header: %w", path, err)
+	}
+	if len(header) < 2 {
+		return nil, fmt.Errorf("%s: expected a sample column and at least one trait column, got %v", path, header)
+	}
+	t := &Traits{Names: append([]string(nil), header[1:]...)}
+	seen := make(map[string]bool)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if seen[record[0]] {
+			return nil, fmt.Errorf("%s: sample %s is listed twice", path, record[0])
+		}
+		seen[record[0]] = true
+		row := make([]float64, len(t.Names))
+		for k, field := range record[1:] {
+			switch field = strings.TrimSpace(field); field {
+			case "", "NA", "NaN":
+				row[k] = math.NaN()
+			default:
+				if row[k], err = strconv.ParseFloat(field, 64); err != nil {
+					return nil, fmt.Errorf("%s: sample %s: invalid value %q for %s", path, record[0], field, t.Names[k])
+				}
+			}
+		}
+		t.Samples = append(t.Samples, record[0])
+		t.Values = append(t.Values, row)
+	}
+	if len(t.Samples) == 0 {
+		return nil, fmt.Errorf("%s: no samples", path)
+	}
+	return t, nil
+}
+
+// Trait returns the values of a trait for the given samples, NaN for the
+// samples the table does not list.
+func (t *Traits) Trait(name string, samples []string) ([]float64, error) {
+	k := -1
+	for i, n := range t.Names {
+		if n == name {
+			k = i
+		}
+	}
+	if k < 0 {
+		return nil, fmt.Errorf("no trait %q (traits: %s)", name, strings.Join(t.Names, ", "))
+	}
+	row := make(map[string]int, len(t.Samples))
+	for s, sample := range t.Samples {
+		row[sample] = s
+	}
+	values := make([]float64, len(samples))
+	for s, sample := range samples {
+		values[s] = math.NaN()
+		if r, ok := row[sample]; ok {
+			values[s] = t.Values[r][k]
+		}
+	}
+	return values, nil
+}
+
+// GeneSignificance correlates every gene of expr with a trait (one value
+// per sample, NaN if missing), like WGCNA's gene significance
+// cor(expr, trait, use = "p") with corPvalueStudent p-values. Only the
+// samples with a trait value count.
+func GeneSignificance(expr *ExpressionMatrix, trait []float64) (gs, pValue []float64, err error) {
+	if err := expr.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if len(trait) != expr.NumSamples() {
+		return nil, nil, fmt.Errorf("trait has %d values for %d samples", len(trait), expr.NumSamples())
+	}
+	var samples []int
+	for s, v := range trait {
+		if !math.IsNaN(v) {
+			samples = append(samples, s)
+		}
+	}
+	if len(samples) < 3 {
+		return nil, nil, fmt.Errorf("trait has a value for %d samples; at least 3 are needed", len(samples))
+	}
+	y := make([]float64, len(samples))
+	for i, s := range samples {
+		y[i] = trait[s]
+	}
+	y = pearsonRow(y)
+	if dot(y, y) == 0 {
+		return nil, nil, fmt.Errorf("trait is constant over the samples")
+	}
+	gs = make([]float64, expr.NumGenes())
+	pValue = make([]float64, expr.NumGenes())
+	x := make([]float64, len(samples))
+	for g, values := range expr.Data {
+		for i, s := range samples {
+			x[i] = values[s]
+		}
+		z := pearsonRow(x)
+		gs[g] = dot(z, y)
+		if dot(z, z) == 0 {
+			// A gene constant over these samples has no correlation
+			// (NA in R).
+			gs[g] = math.NaN()
+		}
+		pValue[g] = correlationPValue(gs[g], len(samples))
+	}
+	return gs, pValue, nil
+}
+
+// WriteHubGenesCSV saves hub genes with the columns Module_Label,
+// Module_Color, Rank, GeneID, kME, kWithin, kME_Rank and kWithin_Rank, and
+// GS and p_GS when withGS is set.
+func WriteHubGenesCSV(filePath string, hubs []HubGene, withGS bool) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	header := []string{"Module_Label", "Module_Color", "Rank", "GeneID", "kME", "kWithin", "kME_Rank", "kWithin_Rank"}
+	if withGS {
+		header = append(header, "GS", "p_GS")
+	}
+	w.Write(header)
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', 6, 64) }
+	for _, h := range hubs {
+		row := []string{
+			strconv.Itoa(h.Module), ModuleColor(h.Module), strconv.Itoa(h.Rank), h.Gene,
+			format(h.KME), format(h.KWithin), strconv.Itoa(h.KMERank), strconv.Itoa(h.KWithinRank),
+		}
+		if withGS {
+			row = append(row, format(h.GS), strconv.FormatFloat(h.GSPValue, 'g', 6, 64))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,155 @@
+package wgcna
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestRankDecreasing(t *testing.T) {
+	// rank(-x, ties.method = "first") in R.
+	tests := []struct {
+		values []float64
+		want   []int
+	}{
+		{[]float64{3, 1, 3, 2}, []int{1, 4, 2, 3}},
+		{[]float64{0.5, 0.5, 0.5}, []int{1, 2, 3}},
+		{[]float64{-1, 2, 0, 2, -1}, []int{4, 1, 3, 2, 5}},
+		// A constant gene has no kME and comes last.
+		{[]float64{math.NaN(), 0.2, -0.4, math.NaN(), 0.9}, []int{4, 2, 3, 5, 1}},
+		{nil, []int{}},
+	}
+	for _, tt := range tests {
+		if got := rankDecreasing(tt.values); !slices.Equal(got, tt.want) {
+			t.Errorf("rankDecreasing(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+// hubNetwork returns the kME and connectivity of two modules and a grey
+// gene:
+//
+//	gene  module  kME   kWithin  kME rank  kWithin rank  sum
+//	A     1       0.90  10       2         3             5
+//	B     1       0.95  4        1         5             6
+//	H     0       0.99  20
+//	C     1       0.80  12       4         1             5
+//	E     1       0.60  12       5         2             7
+//	F     2       0.70  1        2         2             4
+//	D     1       0.90  8        3         4             7
+//	G     2       0.75  2        1         1             2
+func hubNetwork() ([]int, *ModuleMembership, *Connectivity) {
+	genes := []string{"A", "B", "H", "C", "E", "F", "D", "G"}
+	labels := []int{1, 1, 0, 1, 1, 2, 1, 2}
+	kme := []float64{0.90, 0.95, 0.99, 0.80, 0.60, 0.70, 0.90, 0.75}
+	m := &ModuleMembership{Genes: genes, Modules: []int{0, 1, 2}, Eigengenes: []string{"ME0", "ME1", "ME2"}}
+	for g, label := range labels {
+		// The kME with the other eigengenes must not matter.
+		row := []float64{-0.5, -0.5, -0.5}
+		row[label] = kme[g]
+		m.KME = append(m.KME, row)
+		m.PValue = append(m.PValue, []float64{0.1, 0.1, 0.1})
+	}
+	c := &Connectivity{Genes: genes, KWithin: []float64{10, 4, 20, 12, 12, 1, 8, 2}}
+	return labels, m, c
+}
+
+func TestHubGenes(t *testing.T) {
+	labels, m, c := hubNetwork()
+	gs := []float64{0.5, -0.9, 0.9, 0.2, 0.7, 0.1, -0.1, math.NaN()}
+	tests := []struct {
+		name string
+		opts HubOptions
+		want []string
+	}{
+		{"kME", HubOptions{}, []string{"1 B", "1 A", "1 D", "1 C", "1 E", "2 G", "2 F"}},
+		{"kWithin", HubOptions{Ranking: RankKWithin}, []string{"1 C", "1 E", "1 A", "1 D", "1 B", "2 G", "2 F"}},
+		// A and C have the same sum of ranks and A the higher kME, as do
+		// D and E, although E comes first.
+		{"combined", HubOptions{Ranking: RankCombined}, []string{"1 A", "1 C", "1 B", "1 D", "1 E", "2 G", "2 F"}},
+		{"top 2", HubOptions{Ranking: RankCombined, TopN: 2}, []string{"1 A", "1 C", "2 G", "2 F"}},
+		// The threshold is strict: C's kME of 0.8 does not pass.
+		{"kME above 0.8", HubOptions{MinKME: 0.8}, []string{"1 B", "1 A", "1 D"}},
+		// G has no gene significance.
+		{"|GS| above 0.4", HubOptions{MinGS: 0.4}, []string{"1 B", "1 A", "1 E"}},
+		{"both thresholds", HubOptions{MinKME: 0.8, MinGS: 0.4, TopN: 1}, []string{"1 B"}},
+	}
+	for _, tt := range tests {
+		hubs, err := HubGenes(labels, m, c, gs, make([]float64, len(gs)), tt.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for k, hub := range hubs {
+			got = append(got, fmt.Sprintf("%d %s", hub.Module, hub.Gene))
+			if k == 0 || hubs[k-1].Module != hub.Module {
+				if hub.Rank != 1 {
+					t.Errorf("%s: %s is the first hub of module %d with rank %d", tt.name, hub.Gene, hub.Module, hub.Rank)
+				}
+			} else if hub.Rank != hubs[k-1].Rank+1 {
+				t.Errorf("%s: %s has rank %d after rank %d", tt.name, hub.Gene, hub.Rank, hubs[k-1].Rank)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: hubs = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHubGenesRanks(t *testing.T) {
+	labels, m, c := hubNetwork()
+	hubs, err := HubGenes(labels, m, c, nil, nil, HubOptions{Ranking: RankCombined})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]int{"A": {2, 3}, "B": {1, 5}, "C": {4, 1}, "D": {3, 4}, "E": {5, 2}, "F": {2, 2}, "G": {1, 1}}
+	for _, hub := range hubs {
+		if got := [2]int{hub.KMERank, hub.KWithinRank}; got != want[hub.Gene] {
+			t.Errorf("%s: kME and kWithin ranks %v, want %v", hub.Gene, got, want[hub.Gene])
+		}
+		if !math.IsNaN(hub.GS) || !math.IsNaN(hub.GSPValue) {
+			t.Errorf("%s: gene significance %v (p %v) without a trait", hub.Gene, hub.GS, hub.GSPValue)
+		}
+	}
+	if _, err := HubGenes(labels, m, c, nil, nil, HubOptions{MinGS: 0.2}); err == nil {
+		t.Error("no error for a gene significance threshold without the gene significance")
+	}
+	m.Modules = m.Modules[:2]
+	if _, err := HubGenes(labels, m, c, nil, nil, HubOptions{}); err == nil {
+		t.Error("no error for a module without an eigengene")
+	}
+}
+
+func TestGeneSignificance(t *testing.T) {
+	// Without the second sample the trait is (1, 3, 2, 4): gene X follows
+	// it, Y is reversed and Z = (1, 2, 3, 4) correlates by 0.8. With 2
+	// degrees of freedom the Student p-value of r is 1 - |r|.
+	expr := &ExpressionMatrix{
+		Genes:   []string{"X", "Y", "Z"},
+		Samples: []string{"S1", "S2", "S3", "S4", "S5"},
+		Data: [][]float64{
+			{2, 0, 6, 4, 8},
+			{4, 0, 2, 3, 1},
+			{1, 100, 2, 3, 4},
+		},
+	}
+	gs, p, err := GeneSignificance(expr, []float64{1, math.NaN(), 3, 2, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for g, want := range []float64{1, -1, 0.8} {
+		assertClose(t, "GS of "+expr.Genes[g], gs[g], want, 1e-12)
+		assertClose(t, "p-value of "+expr.Genes[g], p[g], 1-math.Abs(want), 1e-9)
+	}
+
+	for _, trait := range [][]float64{
+		{1, 2, 3, 4},
+		{1, math.NaN(), math.NaN(), 2, math.NaN()},
+		{2, 2, 2, math.NaN(), 2},
+	} {
+		if _, _, err := GeneSignificance(expr, trait); err == nil {
+			t.Errorf("trait %v: no error", trait)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package wgcna
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ModuleMembership is the correlation of every gene with every module
+// eigengene, WGCNA's kME (signedKME), and its p-value.
+type ModuleMembership struct {
+	Genes []string
+	// Modules and Eigengenes are the module labels and names of the
+	// eigengenes, in the order of the Eigengenes they were computed from.
+	Modules    []int
+	Eigengenes []string
+	// KME[g][k] is the Pearson correlation of gene g with eigengene k, and
+	// PValue[g][k] its two-sided Student p-value (corPvalueStudent).
+	KME    [][]float64
+	PValue [][]float64
+}
+
+// ModuleMembershipOf computes the kME of every gene of expr against every
+// eigengene, like WGCNA's signedKME(t(expr), MEs) with
+// corPvalueStudent(kME, nSamples) for the p-values.
+func ModuleMembershipOf(expr *ExpressionMatrix, eigengenes *Eigengenes) (*ModuleMembership, error) {
+	if err := expr.Validate(); err != nil {
+		return nil, err
+	}
+	if len(eigengenes.Samples) != expr.NumSamples() {
+		return nil, fmt.Errorf("eigengenes have %d samples but the expression matrix %d", len(eigengenes.Samples), expr.NumSamples())
+	}
+	for s, sample := range expr.Samples {
+		if eigengenes.Samples[s] != sample {
+			return nil, fmt.Errorf("sample %d is %s in the expression matrix but %s for the eigengenes", s+1, sample, eigengenes.Samples[s])
+		}
+	}
+	m := &ModuleMembership{
+		Genes:      expr.Genes,
+		Modules:    eigengenes.Modules,
+		Eigengenes: eigengenes.Names,
+		KME:        make([][]float64, expr.NumGenes()),
+		PValue:     make([][]float64, expr.NumGenes()),
+	}
+	// Eigengenes are centred and of unit length, or all zero if their
+	// module has no variance. A constant gene or eigengene has no
+	// correlation: R's cor gives NA.
+	constant := make([]bool, len(eigengenes.Values))
+	for k, values := range eigengenes.Values {
+		constant[k] = dot(values, values) == 0
+	}
+	for g, row := range expr.Data {
+		z := pearsonRow(row)
+		constantGene := dot(z, z) == 0
+		m.KME[g] = make([]float64, len(eigengenes.Values))
+		m.PValue[g] = make([]float64, len(eigengenes.Values))
+		for k, values := range eigengenes.Values {
+			r := dot(z, values)
+			if constantGene || constant[k] {
+				r = math.NaN()
+			}
+			m.KME[g][k] = r
+			m.PValue[g][k] = correlationPValue(r, expr.NumSamples())
+		}
+	}
+	return m, nil
+}
+
+// correlationPValue is R's corPvalueStudent(r, n): the two-sided p-value of
+// a correlation r over n samples, from Student's t with n - 2 degrees of
+// freedom. Like R, it is NaN for a missing (NaN) correlation.
+func correlationPValue(r float64, n int) float64 {
+	if n < 3 || math.IsNaN(r) {
+		return math.NaN()
+	}
+	df := float64(n - 2)
+	if math.Abs(r) >= 1 {
+		return 0
+	}
+	t2 := df * r * r / (1 - r*r)
+	return regularizedIncompleteBeta(df/2, 0.5, df/(df+t2))
+}
+
+// Connectivity is the whole-network and intramodular connectivity of
+// every gene, as returned by WGCNA's intramodularConnectivity.
+type Connectivity struct {
+	Genes []string
+	// KTotal is the sum of the adjacencies of a gene to all other genes;
+	// KWithin to the other genes of its module; KOut = KTotal - KWithin;
+	// KDiff = KWithin - KOut.
+	KTotal, KWithin, KOut, KDiff []float64
+}
+
+// IntramodularConnectivity computes the connectivity of every gene of an
+// adjacency matrix, like WGCNA's intramodularConnectivity(adjacency,
+// labels) (the diagonal is left out). Genes in no module count as one
+// module, as in R.
+//
+// The packed upper triangle is read once, row by row, so a disk-backed
+// adjacency is read sequentially and nothing but the four vectors is
+// allocated.
+func IntramodularConnectivity(adjacency *NetworkMatrix, labels []int) (*Connectivity, error) {
+	n := adjacency.Size()
+	if len(labels) != n {
+		return nil, fmt.Errorf("%d module labels for %d genes", len(labels), n)
+	}
+	c := &Connectivity{
+		Genes:   adjacency.Genes,
+		KTotal:  make([]float64, n),
+		KWithin: make([]float64, n),
+		KOut:    make([]float64, n),
+		KDiff:   make([]float64, n),
+	}
+	var buf []float64
+	for i := 0; i < n; i++ {
+		// row holds a_ii, a_i,i+1, ...: add each off-diagonal value to both genes.
+		row := adjacency.Data.readUpper(i, buf)
+		buf = row[:0]
+		for offset, a := range row[1:] {
+			j := i + 1 + offset
+			c.KTotal[i] += a
+			c.KTotal[j] += a
+			if labels[i] == labels[j] {
+				c.KWithin[i] += a
+				c.KWithin[j] += a
+			}
+		}
+	}
+	for g := 0; g < n; g++ {
+		c.KOut[g] = c.KTotal[g] - c.KWithin[g]
+		c.KDiff[g] = c.KWithin[g] - c.KOut[g]
+	}
+	return c, nil
+}
+
+// membershipColumns is the header of the module membership table.
+var membershipColumns = []string{"GeneID", "Gene_Index", "Module_Label", "Module_Color", "kTotal", "kWithin", "kOut", "kDiff",
+	"Eigengene", "kME", "p_kME"}
+
+// WriteModuleMembershipCSV saves the kME and the connectivity of the genes
+// (labels[g] is the module of gene g) as one tidy table, a row per gene and
+// eigengene, with the columns GeneID, Gene_Index, Module_Label,
+// Module_Color, kTotal, kWithin, kOut, kDiff, Eigengene, kME and p_kME.
+// Gene_Index is the position of the gene in m, from 1, which tells apart
+// genes of the same name. The genes are sorted by module, then by
+// decreasing kME with their own module's eigengene; the rows of a gene
+// follow the order of the eigengenes.
+func WriteModuleMembershipCSV(filePath string, labels []int, m *ModuleMembership, c *Connectivity) error {
+	if len(labels) != len(m.Genes) || len(c.Genes) != len(m.Genes) {
+		return fmt.Errorf("%d module labels, %d genes with kME and %d with connectivity", len(labels), len(m.Genes), len(c.Genes))
+	}
+	own := make([]float64, len(labels))
+	for g, label := range labels {
+		own[g] = math.Inf(-1)
+		for k, module := range m.Modules {
+			if module == label && !math.IsNaN(m.KME[g][k]) {
+				own[g] = m.KME[g][k]
+			}
+		}
+	}
+	order := make([]int, len(labels))
+	for g := range order {
+		order[g] = g
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if labels[a] != labels[b] {
+			return labels[a] < labels[b]
+		}
+		return own[a] > own[b]
+	})
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write(membershipColumns)
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', 6, 64) }
+	for _, g := range order {
+		gene := []string{
+			m.Genes[g], strconv.Itoa(g + 1), strconv.Itoa(labels[g]), ModuleColor(labels[g]),
+			format(c.KTotal[g]), format(c.KWithin[g]), format(c.KOut[g]), format(c.KDiff[g]),
+		}
+		for k, name := range m.Eigengenes {
+			w.Write(append(gene, name, format(m.KME[g][k]), strconv.FormatFloat(m.PValue[g][k], 'g', 6, 64)))
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// ReadModuleMembershipCSV loads a table written by WriteModuleMembershipCSV
+// and returns the module label of every gene, its kME and its
+// connectivity, with the genes back in the order of their Gene_Index.
+func ReadModuleMembershipCSV(filePath string) ([]int, *ModuleMembership, *Connectivity, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(bufio.NewReader(file))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: failed to read header: %w", filePath, err)
+	}
+	if !slices.Equal(header, membershipColumns) {
+		return nil, nil, nil, fmt.Errorf("%s: expected the columns %s, got %v", filePath, strings.Join(membershipColumns, ","), header)
+	}
+
+	// The genes as they come in the file; index[i] is the Gene_Index of
+	// gene i, minus 1.
+	var (
+		index, labels []int
+		eigengenes    []string
+		m             = &ModuleMembership{}
+		c             = &Connectivity{}
+	)
+	// k is the eigengene of the current row among those of its gene.
+	k := 0
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		values, err := parseCSVValues(append(record[4:8:8], record[9:]...))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s:%d: %w", filePath, line, err)
+		}
+		g, err := strconv.Atoi(record[1])
+		if err != nil || g < 1 {
+			return nil, nil, nil, fmt.Errorf("%s:%d: invalid gene index %q", filePath, line, record[1])
+		}
+		if len(index) == 0 || g-1 != index[len(index)-1] {
+			if len(index) > 0 && k != len(eigengenes) {
+				return nil, nil, nil, fmt.Errorf("%s:%d: gene %s has %d eigengenes, not %d", filePath, line, m.Genes[len(m.Genes)-1], k, len(eigengenes))
+			}
+			label, err := strconv.Atoi(record[2])
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s:%d: invalid module label %q", filePath, line, record[2])
+			}
+			index = append(index, g-1)
+			labels = append(labels, label)
+			m.Genes = append(m.Genes, record[0])
+			m.KME = append(m.KME, nil)
+			m.PValue = append(m.PValue, nil)
+			c.KTotal = append(c.KTotal, values[0])
+			c.KWithin = append(c.KWithin, values[1])
+			c.KOut = append(c.KOut, values[2])
+			c.KDiff = append(c.KDiff, values[3])
+			k = 0
+		}
+		i := len(index) - 1
+		if i == 0 {
+			// The rows of the first gene list the eigengenes.
+			eigengenes = append(eigengenes, record[8])
+		}
+		if k >= len(eigengenes) || record[8] != eigengenes[k] {
+			return nil, nil, nil, fmt.Errorf("%s:%d: eigengene %s is not in the order of the first gene", filePath, line, record[8])
+		}
+		m.KME[i] = append(m.KME[i], values[4])
+		m.PValue[i] = append(m.PValue[i], values[5])
+		k++
+	}
+	if len(index) == 0 {
+		return nil, nil, nil, fmt.Errorf("%s: no genes", filePath)
+	}
+	if k != len(eigengenes) {
+		return nil, nil, nil, fmt.Errorf("%s: gene %s has %d eigengenes, not %d", filePath, m.Genes[len(m.Genes)-1], k, len(eigengenes))
+	}
+
+	// Put the genes back in the order of their index.
+	n := len(index)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = -1
+	}
+	for i, g := range index {
+		if g >= n || order[g] >= 0 {
+			return nil, nil, nil, fmt.Errorf("%s: gene indices must be 1 to %d, each once; got %d twice or out of range", filePath, n, g+1)
+		}
+		order[g] = i
+	}
+	sorted := make([]int, n)
+	genes := make([]string, n)
+	kme := make([][]float64, n)
+	pValue := make([][]float64, n)
+	kTotal, kWithin, kOut, kDiff := make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n)
+	for g, i := range order {
+		sorted[g] = labels[i]
+		genes[g], kme[g], pValue[g] = m.Genes[i], m.KME[i], m.PValue[i]
+		kTotal[g], kWithin[g], kOut[g], kDiff[g] = c.KTotal[i], c.KWithin[i], c.KOut[i], c.KDiff[i]
+	}
+	m = &ModuleMembership{Genes: genes, Eigengenes: eigengenes, KME: kme, PValue: pValue}
+	c = &Connectivity{Genes: genes, KTotal: kTotal, KWithin: kWithin, KOut: kOut, KDiff: kDiff}
+
+	// The eigengenes are named after the labels or the colours of the
+	// modules of the genes.
+	module := make(map[string]int)
+	for _, label := range sorted {
+		module[EigengeneName(label)] = label
+		module["ME"+ModuleColor(label)] = label
+	}
+	m.Modules = make([]int, len(eigengenes))
+	for k, name := range eigengenes {
+		label, ok := module[name]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("%s: eigengene %s is not that of a module of the genes", filePath, name)
+		}
+		m.Modules[k] = label
+	}
+	return sorted, m, c, nil
+}
@@ -0,0 +1,170 @@
+package wgcna
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestModuleMembershipOf(t *testing.T) {
+	// The eigengenes are u = (-3, -1, 1, 3) / sqrt(20) and h = (1, -1, -1,
+	// 1) / 2. After standardization A is u and C is h; B = (1, 3, 2, 4)
+	// correlates with u by 8 / 10; D = (2, 1, 1, 3) is centred to (1, -3,
+	// -3, 5) / 4, of squared length 11 / 4, so it correlates with u by
+	// 3 / sqrt(55) and with h by 3 / sqrt(11). E is constant.
+	expr := &ExpressionMatrix{
+		Genes:   []string{"A", "B", "C", "D", "E"},
+		Samples: []string{"S1", "S2", "S3", "S4"},
+		Data: [][]float64{
+			{1, 2, 3, 4},
+			{1, 3, 2, 4},
+			{4, 1, 1, 4},
+			{2, 1, 1, 3},
+			{5, 5, 5, 5},
+		},
+	}
+	s := math.Sqrt(20)
+	eigengenes := &Eigengenes{
+		Samples: expr.Samples,
+		Modules: []int{1, 2},
+		Names:   []string{"ME1", "ME2"},
+		Values:  [][]float64{{-3 / s, -1 / s, 1 / s, 3 / s}, {0.5, -0.5, -0.5, 0.5}},
+	}
+	want := [][]float64{
+		{1, 0},
+		{0.8, 0},
+		{0, 1},
+		{3 / math.Sqrt(55), 3 / math.Sqrt(11)},
+		{math.NaN(), math.NaN()},
+	}
+
+	m, err := ModuleMembershipOf(expr, eigengenes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for g := range want {
+		for k := range want[g] {
+			name := fmt.Sprintf("kME of %s with %s", expr.Genes[g], eigengenes.Names[k])
+			assertClose(t, name, m.KME[g][k], want[g][k], 1e-12)
+			// With 2 degrees of freedom the p-value is 1 - |r| (NaN for
+			// the constant gene).
+			assertClose(t, "p-value of the "+name, m.PValue[g][k], 1-math.Abs(want[g][k]), 1e-9)
+		}
+	}
+
+	eigengenes.Samples = []string{"S1", "S2", "S4", "S3"}
+	if _, err := ModuleMembershipOf(expr, eigengenes); err == nil {
+		t.Error("no error for eigengenes of other samples")
+	}
+}
+
+func TestCorrelationPValue(t *testing.T) {
+	// corPvalueStudent(r, n) = 2 * pt(sqrt(n - 2) * |r| / sqrt(1 - r^2),
+	// n - 2, lower.tail = FALSE), whose closed forms are 1 - 2 asin|r| / pi
+	// with 1 degree of freedom, 1 - |r| with 2, and 1 - 2 (asin|r| + |r|
+	// sqrt(1 - r^2)) / pi with 3.
+	tests := []struct {
+		r    float64
+		n    int
+		want float64
+	}{
+		{0.5, 3, 2.0 / 3},
+		{-0.5, 3, 2.0 / 3},
+		{0.3, 4, 0.7},
+		{0.5, 5, 1 - 1.0/3 - math.Sqrt(3)/(2*math.Pi)},
+		{-0.8, 5, 1 - 2*(math.Asin(0.8)+0.8*0.6)/math.Pi},
+		{0, 10, 1},
+		{1, 10, 0},
+		{-1, 4, 0},
+		// corPvalueStudent gives NA for fewer than 3 samples and for a
+		// missing correlation.
+		{0.5, 2, math.NaN()},
+		{math.NaN(), 10, math.NaN()},
+	}
+	for _, tt := range tests {
+		assertClose(t, fmt.Sprintf("correlationPValue(%v, %d)", tt.r, tt.n), correlationPValue(tt.r, tt.n), tt.want, 1e-9)
+	}
+}
+
+func TestIntramodularConnectivityHandComputed(t *testing.T) {
+	// intramodularConnectivity(adj, colors) in R, without the diagonal:
+	//
+	//	     A    B    C    D
+	//	A    1   0.5  0.2  0.1
+	//	B   0.5   1   0.3  0.4
+	//	C   0.2  0.3   1   0.6
+	//	D   0.1  0.4  0.6   1
+	adj := NewNetworkMatrix([]string{"A", "B", "C", "D"})
+	for _, e := range []struct {
+		i, j int
+		a    float64
+	}{
+		{0, 0, 1}, {1, 1, 1}, {2, 2, 1}, {3, 3, 1},
+		{0, 1, 0.5}, {0, 2, 0.2}, {0, 3, 0.1}, {1, 2, 0.3}, {1, 3, 0.4}, {2, 3, 0.6},
+	} {
+		adj.Set(e.i, e.j, e.a)
+	}
+	kTotal := []float64{0.8, 1.2, 1.1, 1.1}
+	tests := []struct {
+		labels  []int
+		kWithin []float64
+	}{
+		{[]int{1, 1, 2, 2}, []float64{0.5, 0.5, 0.6, 0.6}},
+		// The grey genes A and C count as one module.
+		{[]int{0, 1, 0, 2}, []float64{0.2, 0, 0.2, 0}},
+		{[]int{3, 3, 3, 3}, kTotal},
+	}
+	for _, tt := range tests {
+		c, err := IntramodularConnectivity(adj, tt.labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for g, gene := range adj.Genes {
+			name := fmt.Sprintf("labels %v: %s", tt.labels, gene)
+			kOut := kTotal[g] - tt.kWithin[g]
+			assertClose(t, name+" kTotal", c.KTotal[g], kTotal[g], 1e-12)
+			assertClose(t, name+" kWithin", c.KWithin[g], tt.kWithin[g], 1e-12)
+			assertClose(t, name+" kOut", c.KOut[g], kOut, 1e-12)
+			assertClose(t, name+" kDiff", c.KDiff[g], tt.kWithin[g]-kOut, 1e-12)
+		}
+	}
+	if _, err := IntramodularConnectivity(adj, []int{1, 1, 2}); err == nil {
+		t.Error("no error for 3 labels of 4 genes")
+	}
+}
+
+func TestIntramodularConnectivityOfAdjacency(t *testing.T) {
+	// A float32 adjacency of more genes than a tile row, summed as stored.
+	expr := syntheticExpression(150, 12, 3, 5)
+	corr, err := Correlate(expr, CorrelationOptions{Precision: Float32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adj, err := Adjacency(corr, DefaultAdjacencyOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := make([]int, expr.NumGenes())
+	for g := range labels {
+		labels[g] = g % 3
+	}
+	c, err := IntramodularConnectivity(adj, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dense := adj.Data.Dense()
+	for i := range dense {
+		var kTotal, kWithin float64
+		for j, a := range dense[i] {
+			if j == i {
+				continue
+			}
+			kTotal += a
+			if labels[j] == labels[i] {
+				kWithin += a
+			}
+		}
+		assertClose(t, fmt.Sprintf("kTotal[%d]", i), c.KTotal[i], kTotal, 1e-9)
+		assertClose(t, fmt.Sprintf("kWithin[%d]", i), c.KWithin[i], kWithin, 1e-9)
+	}
+}
@@ -0,0 +1,252 @@
+package wgcna
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// standardColors is WGCNA's standardColors(), the colours labels2colors
+// gives to the module labels 1, 2, ...: 34 hand-picked colours, then the
+// other colours() of R without "grey", "gray" or "black" in their name,
+// shuffled by rank(sin(13 i + sin(13 i))).
+var standardColors = []string{
+	"turquoise", "blue", "brown", "yellow", "green", "red", "black", "pink", "magenta", "purple",
+	"greenyellow", "tan", "salmon", "cyan", "midnightblue", "lightcyan", "grey60", "lightgreen",
+	"lightyellow", "royalblue", "darkred", "darkgreen", "darkturquoise", "darkgrey", "orange", "darkorange",
+	"white", "skyblue", "saddlebrown", "steelblue", "paleturquoise", "violet", "darkolivegreen",
+	"darkmagenta", "sienna3", "yellowgreen", "skyblue3", "plum1", "orangered4", "mediumpurple3",
+	"lightsteelblue1", "lightcyan1", "ivory", "floralwhite", "darkorange2", "brown4", "bisque4",
+	"darkslateblue", "plum2", "thistle2", "thistle1", "salmon4", "palevioletred3", "navajowhite2", "maroon",
+	"lightpink4", "lavenderblush3", "honeydew1", "darkseagreen4", "coral1", "antiquewhite4", "coral2",
+	"mediumorchid", "skyblue2", "yellow4", "skyblue1", "plum", "orangered3", "mediumpurple2",
+	"lightsteelblue", "lightcoral", "indianred4", "firebrick4", "darkolivegreen4", "brown2", "blue2",
+	"darkviolet", "plum3", "thistle3", "thistle", "salmon2", "palevioletred2", "navajowhite1", "magenta4",
+	"lightpink3", "lavenderblush2", "honeydew", "darkseagreen3", "coral", "antiquewhite2", "coral3",
+	"mediumpurple4", "skyblue4", "yellow3", "sienna4", "pink4", "orangered1", "mediumpurple1",
+	"lightslateblue", "lightblue4", "indianred3", "firebrick3", "darkolivegreen2", "blueviolet", "blue4",
+	"deeppink", "plum4", "thistle4", "tan4", "salmon1", "palevioletred1", "navajowhite", "magenta3",
+	"lightpink2", "lavenderblush1", "green4", "darkseagreen2", "chocolate4", "antiquewhite1", "coral4",
+	"mistyrose", "slateblue", "yellow2", "sienna2", "pink3", "orangered", "mediumpurple", "lightskyblue4",
+	"lightblue3", "indianred2", "firebrick2", "darkolivegreen1", "blue3", "brown1", "deeppink1",
+	"powderblue", "tomato", "tan3", "royalblue3", "palevioletred", "moccasin", "magenta2", "lightpink1",
+	"lavenderblush", "green3", "darkseagreen1", "chocolate3", "aliceblue", "cornflowerblue", "navajowhite3",
+	"slateblue1", "whitesmoke", "sienna1", "pink2", "orange4", "mediumorchid4", "lightskyblue3",
+	"lightblue2", "indianred1", "firebrick", "darkgoldenrod4", "blue1", "brown3", "deeppink2", "purple2",
+	"tomato2", "tan2", "royalblue2", "paleturquoise4", "mistyrose4", "magenta1", "lightpink", "lavender",
+	"green2", "darkseagreen", "chocolate2", "antiquewhite", "cornsilk", "navajowhite4", "slateblue2",
+	"wheat3", "sienna", "pink1", "orange3", "mediumorchid3", "lightskyblue2", "lightblue1", "indianred",
+	"dodgerblue4", "darkgoldenrod3", "blanchedalmond", "burlywood", "deepskyblue", "red1", "tomato4", "tan1",
+	"rosybrown4", "paleturquoise3", "mistyrose3", "linen", "lightgoldenrodyellow", "khaki4", "green1",
+	"darksalmon", "chocolate1", "antiquewhite3", "cornsilk2", "oldlace", "slateblue3", "wheat1", "seashell4",
+	"peru", "orange2", "mediumorchid2", "lightskyblue1", "lightblue", "hotpink4", "dodgerblue3",
+	"darkgoldenrod1", "bisque3", "burlywood1", "deepskyblue4", "red4", "turquoise2", "steelblue4",
+	"rosybrown3", "paleturquoise1", "mistyrose2", "limegreen", "lightgoldenrod4", "khaki3", "goldenrod4",
+	"darkorchid4", "chocolate", "aquamarine", "cyan1", "orange1", "slateblue4", "violetred4", "seashell3",
+	"peachpuff4", "olivedrab4", "mediumorchid1", "lightskyblue", "lemonchiffon4", "hotpink3", "dodgerblue1",
+	"darkgoldenrod", "bisque2", "burlywood2", "dodgerblue2", "rosybrown2", "turquoise4", "steelblue3",
+	"rosybrown1", "palegreen4", "mistyrose1", "lightyellow4", "lightgoldenrod3", "khaki2", "goldenrod3",
+	"darkorchid3", "chartreuse4", "aquamarine1", "cyan4", "orangered2", "snow", "violetred2", "seashell2",
+	"peachpuff3", "olivedrab3", "mediumblue", "lightseagreen", "lemonchiffon3", "hotpink2", "dodgerblue",
+	"darkblue", "bisque1", "burlywood3", "firebrick1", "royalblue1", "violetred1", "steelblue1", "rosybrown",
+	"palegreen3", "mintcream", "lightyellow3", "lightgoldenrod2", "khaki1", "goldenrod2", "darkorchid2",
+	"chartreuse3", "aquamarine2", "darkcyan", "orchid", "snow2", "violetred", "seashell1", "peachpuff2",
+	"olivedrab2", "mediumaquamarine", "lightsalmon4", "lemonchiffon2", "hotpink1", "deepskyblue3", "cyan3",
+	"bisque", "burlywood4", "forestgreen", "royalblue4", "violetred3", "springgreen3", "red3", "palegreen1",
+	"mediumvioletred", "lightyellow2", "lightgoldenrod1", "khaki", "goldenrod1", "darkorchid1",
+	"chartreuse2", "aquamarine3", "darkgoldenrod2", "orchid1", "snow4", "turquoise3", "seashell",
+	"peachpuff1", "olivedrab1", "maroon4", "lightsalmon3", "lemonchiffon1", "hotpink", "deepskyblue2",
+	"cyan2", "beige", "cadetblue", "gainsboro", "salmon3", "wheat", "springgreen2", "red2", "palegreen",
+	"mediumturquoise", "lightyellow1", "lightgoldenrod", "ivory4", "goldenrod", "darkorchid", "chartreuse1",
+	"aquamarine4", "darkkhaki", "orchid3", "springgreen1", "turquoise1", "seagreen4", "peachpuff",
+	"olivedrab", "maroon3", "lightsalmon2", "lemonchiffon", "honeydew4", "deepskyblue1", "cornsilk4",
+	"azure4", "cadetblue1", "ghostwhite", "sandybrown", "wheat2", "springgreen", "purple4", "palegoldenrod",
+	"mediumspringgreen", "lightsteelblue4", "lightcyan4", "ivory3", "gold3", "darkorange4", "chartreuse",
+	"azure", "darkolivegreen3", "palegreen2", "springgreen4", "tomato3", "seagreen3", "papayawhip",
+	"navyblue", "maroon2", "lightsalmon1", "lawngreen", "honeydew3", "deeppink4", "cornsilk3", "azure3",
+	"cadetblue2", "gold", "seagreen", "wheat4", "snow3", "purple3", "orchid4", "mediumslateblue",
+	"lightsteelblue3", "lightcyan3", "ivory2", "gold2", "darkorange3", "cadetblue4", "azure1", "darkorange1",
+	"paleturquoise2", "steelblue2", "tomato1", "seagreen2", "palevioletred4", "navy", "maroon1",
+	"lightsalmon", "lavenderblush4", "honeydew2", "deeppink3", "cornsilk1", "azure2", "cadetblue3", "gold4",
+	"seagreen1", "yellow1", "snow1", "purple1", "orchid2", "mediumseagreen", "lightsteelblue2", "lightcyan2",
+	"ivory1", "gold1",
+}
+
+// ModuleColor returns the colour name of a module label, as WGCNA's
+// labels2colors does: "grey" for UnassignedModule, then "turquoise",
+// "blue", "brown", ... for the modules 1, 2, 3, ... Past the 435 standard
+// colours they repeat with a suffix, "turquoise.1", ..., as in R.
+func ModuleColor(label int) string {
+	if label == UnassignedModule {
+		return "grey"
+	}
+	k := label - 1
+	color := standardColors[k%len(standardColors)]
+	if round := k / len(standardColors); round > 0 {
+		color += "." + strconv.Itoa(round)
+	}
+	return color
+}
+
+// MergeOptions controls MergeCloseModules.
+type MergeOptions struct {
+	// CutHeight is the largest eigengene dissimilarity, 1 - correlation,
+	// at which modules are merged; 0 means 0.25.
+	CutHeight float64
+	// Workers is the number of goroutines; 0 means runtime.NumCPU().
+	Workers int
+}
+
+// DefaultMergeOptions returns the defaults of R's mergeCloseModules.
+func DefaultMergeOptions() MergeOptions {
+	return MergeOptions{CutHeight: 0.25}
+}
+
+// withDefaults fills in the zero values.
+func (o MergeOptions) withDefaults() MergeOptions {
+	if o.CutHeight == 0 {
+		o.CutHeight = 0.25
+	}
+	return o
+}
+
+// Validate checks the cut height.
+func (o MergeOptions) Validate() error {
+	if !(o.CutHeight >= 0 && o.CutHeight <= 2) {
+		return fmt.Errorf("merge cut height must be in [0, 2], got %v", o.CutHeight)
+	}
+	return nil
+}
+
+// ModuleMerge is the result of MergeCloseModules.
+type ModuleMerge struct {
+	// Labels[g] is the merged module of gene g. The merged modules are
+	// numbered by decreasing size; UnassignedModule is kept.
+	Labels []int
+	// NewLabel maps every module label of the input to its merged label.
+	NewLabel map[int]int
+	// Iterations is the number of rounds that merged modules.
+	Iterations int
+}
+
+// MergeCloseModules merges modules whose eigengenes are too similar, like
+// WGCNA's mergeCloseModules(expr, labels, cutHeight, iterate = TRUE): the
+// eigengenes of the modules (without the genes in no module, which are
+// never merged) are clustered with average linkage on 1 - correlation, the
+// tree is cut at CutHeight, and the modules of each branch become one. The
+// eigengenes of the merged modules are computed again and the process is
+// repeated until no modules merge. The result is numbered by size, so the
+// colours of ModuleColor follow labels2colors.
+func MergeCloseModules(expr *ExpressionMatrix, labels []int, opts MergeOptions) (*ModuleMerge, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	if len(labels) != expr.NumGenes() {
+		return nil, fmt.Errorf("%d module labels for %d genes", len(labels), expr.NumGenes())
+	}
+
+	current := append([]int(nil), labels...)
+	merge := &ModuleMerge{}
+	for {
+		modules := make(map[int]bool)
+		for _, label := range current {
+			if label != UnassignedModule {
+				modules[label] = true
+			}
+		}
+		if len(modules) < 2 {
+			break
+		}
+		eigengenes, err := ModuleEigengenes(expr, current, EigengeneOptions{ExcludeGrey: true, Workers: opts.Workers})
+		if err != nil {
+			return nil, err
+		}
+		groups, err := eigengeneGroups(eigengenes, opts.CutHeight)
+		if err != nil {
+			return nil, err
+		}
+		// Every module joins the first module of its group.
+		into := make(map[int]int, len(groups))
+		first := make(map[int]int)
+		for k, group := range groups {
+			if _, ok := first[group]; !ok {
+				first[group] = eigengenes.Modules[k]
+			}
+			into[eigengenes.Modules[k]] = first[group]
+		}
+		if len(first) == len(groups) {
+			break
+		}
+		for g, label := range current {
+			if label != UnassignedModule {
+				current[g] = into[label]
+			}
+		}
+		merge.Iterations++
+	}
+
+	merge.Labels = relabelBySize(current)
+	merge.NewLabel = make(map[int]int)
+	for g, label := range labels {
+		merge.NewLabel[label] = merge.Labels[g]
+	}
+	return merge, nil
+}
+
+// eigengeneGroups clusters eigengenes with average linkage on 1 -
+// correlation and cuts the tree at height, like
+// cutree(hclust(as.dist(1 - cor(MEs)), "average"), h = height). It
+// returns the group of every eigengene.
+func eigengeneGroups(e *Eigengenes, height float64) ([]int, error) {
+	dist := NewNetworkMatrix(e.Names)
+	for i := range e.Values {
+		for j := i + 1; j < len(e.Values); j++ {
+			// Eigengenes are centred and of unit length.
+			dist.Set(i, j, max(1-dot(e.Values[i], e.Values[j]), 0))
+		}
+	}
+	tree, err := HierarchicalCluster(dist, AverageLinkage)
+	if err != nil {
+		return nil, err
+	}
+	return cutStatic(tree, height), nil
+}
+
+// cutStatic cuts a dendrogram at a fixed height, like R's cutree(tree,
+// h = height): genes joined at or below height share a group. Groups are
+// numbered from 1 in the order of their first gene.
+func cutStatic(tree *Dendrogram, height float64) []int {
+	n := tree.Size()
+	group := make([]int, n)
+	for i := range group {
+		group[i] = i
+	}
+	members := make([][]int, len(tree.Merge))
+	genesOf := func(node int) []int {
+		if node < 0 {
+			return []int{-node - 1}
+		}
+		return members[node-1]
+	}
+	for k, pair := range tree.Merge {
+		if tree.Height[k] > height {
+			break
+		}
+		members[k] = append(append([]int(nil), genesOf(pair[0])...), genesOf(pair[1])...)
+		lowest := n
+		for _, g := range members[k] {
+			lowest = min(lowest, group[g])
+		}
+		for _, g := range members[k] {
+			group[g] = lowest
+		}
+	}
+	number := make(map[int]int)
+	for i, g := range group {
+		if _, ok := number[g]; !ok {
+			number[g] = len(number) + 1
+		}
+		group[i] = number[g]
+	}
+	return group
+}
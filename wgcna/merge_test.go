@@ -0,0 +1,160 @@
+package wgcna
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestCutStatic(t *testing.T) {
+	tests := []struct {
+		x       []float64
+		linkage Linkage
+		height  float64
+		want    []int
+	}{
+		// Complete linkage joins at 1, 3, 5 and 12 (see
+		// TestHierarchicalClusterMatchesR).
+		{[]float64{1, 2, 4, 8, 13}, CompleteLinkage, 0.5, []int{1, 2, 3, 4, 5}},
+		{[]float64{1, 2, 4, 8, 13}, CompleteLinkage, 3, []int{1, 1, 1, 2, 3}},
+		{[]float64{1, 2, 4, 8, 13}, CompleteLinkage, 5, []int{1, 1, 1, 2, 2}},
+		{[]float64{1, 2, 4, 8, 13}, CompleteLinkage, 12, []int{1, 1, 1, 1, 1}},
+		// Average linkage joins genes 2 and 5, then 4, at 2.5; groups are
+		// numbered in the order of their first gene.
+		{[]float64{8, 1, 13, 4, 2}, AverageLinkage, 2.5, []int{1, 2, 3, 2, 2}},
+		{[]float64{8, 1, 13, 4, 2}, AverageLinkage, 5, []int{1, 2, 1, 2, 2}},
+	}
+	for _, tt := range tests {
+		tree, err := HierarchicalCluster(lineDistances(tt.x), tt.linkage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cutStatic(tree, tt.height); !slices.Equal(got, tt.want) {
+			t.Errorf("cutree(hclust(dist(%v), %q), h = %v) = %v, want %v", tt.x, tt.linkage, tt.height, got, tt.want)
+		}
+	}
+}
+
+// closeModules returns genes whose standardized expression is built from
+// the orthonormal centred vectors h1, h2 and h3 of 4 samples:
+//
+//	gene  module  standardized expression
+//	A     2       a = sqrt(0.9) h1 + sqrt(0.1) h2
+//	B     3       b = sqrt(0.9) h1 - sqrt(0.1) h2
+//	C     4       c = 0.77 h1 + sqrt(1 - 0.77^2) h3
+//	D1    1       h2
+//	D2    1       h2
+//	E     0       a
+//
+// The eigengene dissimilarities are 0.2 for A and B, and 1 - sqrt(0.9) *
+// 0.77 = 0.2695 for C and either; once A and B are merged their eigengene
+// is h1, at 1 - 0.77 = 0.23 of C. D is at least 0.68 from everything.
+func closeModules() (*ExpressionMatrix, []int) {
+	h1 := []float64{0.5, 0.5, -0.5, -0.5}
+	h2 := []float64{0.5, -0.5, 0.5, -0.5}
+	h3 := []float64{0.5, -0.5, -0.5, 0.5}
+	combine := func(offset, x float64, u []float64, y float64, v []float64) []float64 {
+		row := make([]float64, len(u))
+		for s := range row {
+			row[s] = offset + x*u[s] + y*v[s]
+		}
+		return row
+	}
+	expr := &ExpressionMatrix{
+		Genes:   []string{"A", "B", "C", "D1", "D2", "E"},
+		Samples: []string{"S1", "S2", "S3", "S4"},
+		Data: [][]float64{
+			combine(5, math.Sqrt(0.9), h1, math.Sqrt(0.1), h2),
+			combine(5, math.Sqrt(0.9), h1, -math.Sqrt(0.1), h2),
+			combine(5, 0.77, h1, math.Sqrt(1-0.77*0.77), h3),
+			combine(5, 1, h2, 0, h3),
+			combine(3, 2, h2, 0, h3),
+			combine(9, 3*math.Sqrt(0.9), h1, 3*math.Sqrt(0.1), h2),
+		},
+	}
+	return expr, []int{2, 3, 4, 1, 1, 0}
+}
+
+func TestMergeCloseModules(t *testing.T) {
+	expr, labels := closeModules()
+	tests := []struct {
+		cutHeight  float64
+		want       []int
+		newLabel   map[int]int
+		iterations int
+	}{
+		{
+			// A and B merge in the first round, C with them in the second;
+			// the 3 genes of A, B and C then outnumber D.
+			cutHeight:  0.25,
+			want:       []int{1, 1, 1, 2, 2, 0},
+			newLabel:   map[int]int{0: 0, 1: 2, 2: 1, 3: 1, 4: 1},
+			iterations: 2,
+		},
+		{
+			// Only A and B merge; D has as many genes and a lower label.
+			cutHeight:  0.22,
+			want:       []int{2, 2, 3, 1, 1, 0},
+			newLabel:   map[int]int{0: 0, 1: 1, 2: 2, 3: 2, 4: 3},
+			iterations: 1,
+		},
+		{
+			cutHeight:  0.1,
+			want:       []int{2, 3, 4, 1, 1, 0},
+			newLabel:   map[int]int{0: 0, 1: 1, 2: 2, 3: 3, 4: 4},
+			iterations: 0,
+		},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("cut height %v", tt.cutHeight)
+		merged, err := MergeCloseModules(expr, labels, MergeOptions{CutHeight: tt.cutHeight})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !slices.Equal(merged.Labels, tt.want) {
+			t.Errorf("%s: labels = %v, want %v", name, merged.Labels, tt.want)
+		}
+		if !maps.Equal(merged.NewLabel, tt.newLabel) {
+			t.Errorf("%s: new labels = %v, want %v", name, merged.NewLabel, tt.newLabel)
+		}
+		if merged.Iterations != tt.iterations {
+			t.Errorf("%s: %d iterations, want %d", name, merged.Iterations, tt.iterations)
+		}
+	}
+	if !slices.Equal(labels, []int{2, 3, 4, 1, 1, 0}) {
+		t.Errorf("the input labels were changed to %v", labels)
+	}
+}
+
+func TestModuleColor(t *testing.T) {
+	// labels2colors(c(0:3, 34:36, 100, 435:436, 871)) in R.
+	for label, want := range map[int]string{
+		UnassignedModule: "grey",
+		1:                "turquoise",
+		2:                "blue",
+		3:                "brown",
+		34:               "darkmagenta",
+		35:               "sienna3",
+		36:               "yellowgreen",
+		100:              "lightblue4",
+		435:              "gold1",
+		436:              "turquoise.1",
+		871:              "turquoise.2",
+	} {
+		if got := ModuleColor(label); got != want {
+			t.Errorf("ModuleColor(%d) = %q, want %q", label, got, want)
+		}
+	}
+
+	// Every module gets its own colour, never the grey of unassigned genes.
+	seen := map[string]int{"grey": UnassignedModule}
+	for label := 1; label <= 2*len(standardColors); label++ {
+		color := ModuleColor(label)
+		if other, dup := seen[color]; dup {
+			t.Fatalf("ModuleColor(%d) = %q, the colour of module %d", label, color, other)
+		}
+		seen[color] = label
+	}
+}
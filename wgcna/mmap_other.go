@@ -0,0 +1,13 @@
+//go:build !unix
+
+package wgcna
+
+import "errors"
+
+// mapFile is only implemented on Unix systems; elsewhere every matrix is
+// held in memory and a memory budget that is too small is an error.
+func mapFile(dir string, size int) ([]byte, error) {
+	return nil, errors.New("disk-backed matrices are only supported on Unix systems")
+}
+
+func unmapFile(data []byte) error { return nil }
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package wgcna
+
+import "testing"
+
+func TestDiskBackedMatrixUnsupported(t *testing.T) {
+	m, err := allocSymMatrix(10, Float64, MatrixStorage{MemoryBudget: 1, Dir: t.TempDir()})
+	if err == nil {
+		t.Errorf("a matrix over the memory budget was allocated (disk-backed %v)", m.DiskBacked())
+	}
+	if m, err := allocSymMatrix(10, Float64, MatrixStorage{}); err != nil || m.DiskBacked() {
+		t.Errorf("a matrix without a budget: disk-backed %v, error %v", m != nil && m.DiskBacked(), err)
+	}
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package wgcna
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile creates a file of size bytes in dir and maps it read-write into
+// memory. The file is unlinked before returning: the mapping keeps its
+// blocks alive until unmapFile, and nothing is left behind if the process
+// dies.
+func mapFile(dir string, size int) ([]byte, error) {
+	file, err := os.CreateTemp(dir, "wgcna-matrix-*.bin")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create matrix file: %w", err)
+	}
+	defer file.Close()
+	defer os.Remove(file.Name())
+
+	// Write the zeros instead of only truncating, so a full disk is
+	// reported here rather than as a SIGBUS in the middle of a phase.
+	zeros := make([]byte, 1<<20)
+	for written := 0; written < size; {
+		chunk := min(len(zeros), size-written)
+		if _, err := file.Write(zeros[:chunk]); err != nil {
+			return nil, fmt.Errorf("failed to allocate %d bytes in %s: %w", size, dir, err)
+		}
+		written += chunk
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map matrix file %s: %w", file.Name(), err)
+	}
+	return data, nil
+}
+
+// unmapFile releases a mapping returned by mapFile.
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,158 @@
+//go:build unix
+
+package wgcna
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkSpillDirEmpty fails the test if a matrix file was left in dir:
+// mapFile unlinks them as soon as they are mapped.
+func checkSpillDirEmpty(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s was left in the spill directory", e.Name())
+	}
+}
+
+func TestDiskBackedPhasesMatchInMemory(t *testing.T) {
+	// A budget of 1 byte maps every network matrix to a file; the phases
+	// must compute the same values as in memory, bit for bit.
+	expr := syntheticExpression(150, 12, 3, 11)
+	for _, precision := range []Precision{Float64, Float32} {
+		dir := t.TempDir()
+		run := func(storage MatrixStorage) []*NetworkMatrix {
+			corr, err := Correlate(expr, CorrelationOptions{Precision: precision, Storage: storage, Workers: 2})
+			if err != nil {
+				t.Fatalf("%s: %v", precision, err)
+			}
+			adj, err := Adjacency(corr, AdjacencyOptions{Beta: 6, Type: Unsigned})
+			if err != nil {
+				t.Fatalf("%s: %v", precision, err)
+			}
+			tom, err := TOM(adj, TOMOptions{Type: SignedTOM, Correlation: corr, Workers: 2})
+			if err != nil {
+				t.Fatalf("%s: %v", precision, err)
+			}
+			diss, err := Dissimilarity(tom)
+			if err != nil {
+				t.Fatalf("%s: %v", precision, err)
+			}
+			return []*NetworkMatrix{corr, adj, tom, diss}
+		}
+		inMemory := run(MatrixStorage{})
+		onDisk := run(MatrixStorage{MemoryBudget: 1, Dir: dir})
+		checkSpillDirEmpty(t, dir)
+
+		for k, name := range []string{"correlation", "adjacency", "TOM", "dissimilarity"} {
+			name = fmt.Sprintf("%s %s", precision, name)
+			m := onDisk[k]
+			if inMemory[k].Data.DiskBacked() || !m.Data.DiskBacked() {
+				t.Fatalf("%s: disk-backed %v in memory and %v with a 1-byte budget",
+					name, inMemory[k].Data.DiskBacked(), m.Data.DiskBacked())
+			}
+			if m.Data.Precision() != precision {
+				t.Errorf("%s: stored in %s", name, m.Data.Precision())
+			}
+			if diff := maxAbsDiff(inMemory[k].Data.Dense(), m); diff != 0 {
+				t.Errorf("%s: differs from the in-memory matrix by %g", name, diff)
+			}
+			if err := m.Close(); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			if m.Data.DiskBacked() {
+				t.Errorf("%s: still disk-backed after Close", name)
+			}
+			if err := m.Close(); err != nil {
+				t.Errorf("%s: second Close: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestTOMScratchCountsAgainstBudget(t *testing.T) {
+	// For 100 genes in float64 the adjacency and the TOM take 2 x 40,400
+	// bytes; one worker's panels take 8 (2 x 64 x 100 + 64 x 64) = 135,168
+	// bytes, and 8 x 64 x 100 = 51,200 more for a signed TOM, whose
+	// correlation matrix is another 40,400 bytes. A budget of exactly
+	// 80,800 + 135,168 holds the unsigned TOM in memory but not the signed
+	// one, and the matrices alone would fit a budget of 100,000.
+	const n = 100
+	if got := panelScratchBytes(n, false); got != 135168 {
+		t.Errorf("panelScratchBytes(%d, false) = %d, want 135168", n, got)
+	}
+	if got := panelScratchBytes(n, true); got != 186368 {
+		t.Errorf("panelScratchBytes(%d, true) = %d, want 186368", n, got)
+	}
+	tests := []struct {
+		budget     int64
+		signed     bool
+		diskBacked bool
+	}{
+		{100000, false, true},
+		{80800 + 135168, false, false},
+		{80800 + 135168, true, true},
+		{80800 + 40400 + 186368, true, false},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("budget %d, signed %v", tt.budget, tt.signed)
+		dir := t.TempDir()
+		storage := MatrixStorage{MemoryBudget: tt.budget, Dir: dir}
+		adj, signs := NewSymMatrix(n), NewSymMatrix(n)
+		adj.storage = storage
+		for i := 0; i < n; i++ {
+			for j := i; j < n; j++ {
+				adj.Set(i, j, 0.5)
+				signs.Set(i, j, -1)
+			}
+		}
+		if !tt.signed {
+			signs = nil
+		}
+		tom, err := calculateTOM(adj, signs, 1)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if tom.DiskBacked() != tt.diskBacked {
+			t.Errorf("%s: disk-backed %v, want %v", name, tom.DiskBacked(), tt.diskBacked)
+		}
+		checkSpillDirEmpty(t, dir)
+		if err := tom.Close(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestMapFile(t *testing.T) {
+	// More than the 1 MB of zeros written at a time.
+	dir := t.TempDir()
+	size := 3<<20 + 5
+	data, err := mapFile(dir, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSpillDirEmpty(t, dir)
+	if len(data) != size {
+		t.Errorf("mapped %d bytes, want %d", len(data), size)
+	}
+	for k, b := range data {
+		if b != 0 {
+			t.Fatalf("byte %d of a new mapping is %d", k, b)
+		}
+	}
+	data[size-1] = 7
+	if err := unmapFile(data); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := mapFile(filepath.Join(dir, "missing"), 8); err == nil {
+		t.Error("no error for a spill directory that does not exist")
+	}
+}
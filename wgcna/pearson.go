@@ -0,0 +1,151 @@
+package wgcna
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// RunPhase2 starts the parallel calculation of the Pearson correlation matrix.
+func RunPhase2(matrix [][]float64, geneList []string) (*SymMatrix, error) {
+	return runPhase2(matrix, geneList, CorrelationOptions{Method: Pearson}, runtime.NumCPU())
+}
+
+// runPhase2 is RunPhase2 with an explicit correlation method and number of worker goroutines.
+//
+// The correlation matrix is computed as the Gram matrix Z * Z^T of the
+// normalized rows Z: the upper triangle is cut into tiles, and workers take
+// tiles from a shared counter and write each result straight into its
+// (disjoint) block of the output, with no per-pair channel traffic.
+func runPhase2(matrix [][]float64, geneList []string, opts CorrelationOptions, numWorkers int) (*SymMatrix, error) {
+	numGenes := len(geneList)
+	if numGenes == 0 {
+		return nil, fmt.Errorf("matrix is empty")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	log.Printf("  (P2) Pre-calculating %s statistics for %d genes...", opts.Method, numGenes)
+
+	// 1. Pre-calculate a normalized row for every gene, so that the
+	// correlation of genes i and j is the dot product of rows i and j.
+	// For Pearson the row is centred by the mean and scaled to unit length.
+	normalized, err := prepareCorrelationRows(matrix, opts)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("  (P2) ...Pre-calculation complete.")
+
+	// 2. Initialize the final correlation matrix (packed upper triangle).
+	// The dot products are always accumulated in float64; opts.Precision
+	// only decides how the results are stored.
+	corrMatrix, err := allocSymMatrix(numGenes, opts.Precision, opts.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Tiled Z * Z^T over the upper triangle.
+	tiles := upperTiles(numGenes, tileRows)
+	log.Printf("  (P2) Starting %d workers for %d correlation tiles...", numWorkers, len(tiles))
+
+	scratch := make([][]float64, numWorkers)
+	for w := range scratch {
+		scratch[w] = make([]float64, tileRows*tileRows)
+	}
+	forEachTile(tiles, numWorkers, func(w int, t tile) {
+		acc := scratch[w]
+		gramTile(normalized[t.I0:t.I1], normalized[t.J0:t.J1], acc)
+		nj := t.J1 - t.J0
+		for i := t.I0; i < t.I1; i++ {
+			for j := max(t.J0, i+1); j < t.J1; j++ {
+				// Rounding can push |corr| a hair above 1.
+				corr := math.Max(-1, math.Min(1, acc[(i-t.I0)*nj+(j-t.J0)]))
+				corrMatrix.Set(i, j, corr)
+			}
+		}
+	}, progressLogger("  (P2) ...Correlation", len(tiles)))
+
+	// Fill the diagonal (self-correlation is always 1).
+	for i := 0; i < numGenes; i++ {
+		corrMatrix.Set(i, i, 1.0)
+	}
+
+	log.Println("  (P2) ...All correlation tasks complete!")
+	return corrMatrix, nil
+}
+
+// progressLogger returns a forEachTile progress callback that logs every 10%.
+func progressLogger(prefix string, total int) func(done int) {
+	step := max(total/10, 1)
+	return func(done int) {
+		if done%step == 0 || done == total {
+			log.Printf("%s progress: %d%% (%d/%d tiles)", prefix, done*100/total, done, total)
+		}
+	}
+}
+
+// WriteCorrelationMatrix saves the final correlation matrix to a CSV file.
+func WriteCorrelationMatrix(
+	filePath string,
+	matrix *SymMatrix,
+	geneList []string,
+) error {
+	// Create the output file
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create correlation file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	// Use a csv.Writer for efficient writing
+	writer := csv.NewWriter(file)
+	defer writer.Flush() // Ensure all buffered data is written
+
+	numGenes := len(geneList)
+	if numGenes == 0 {
+		return fmt.Errorf("gene list is empty, nothing to write")
+	}
+	if matrix.Size() != numGenes {
+		return fmt.Errorf("matrix is %d x %d but there are %d genes", matrix.Size(), matrix.Size(), numGenes)
+	}
+
+	// 1. Write the header row
+	// The header is: "gene_id", "GENE_1", "GENE_2", ...
+	header := make([]string, numGenes+1)
+	header[0] = "gene_id" // First column header
+	copy(header[1:], geneList)
+
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write correlation header: %w", err)
+	}
+
+	// 2. Write the matrix data row by row
+	// Create a reusable slice to reduce memory allocations
+	rowStr := make([]string, numGenes+1)
+
+	matrix.forEachRow(func(i int, row []float64) error {
+		// The first column of each row is the gene name (row header)
+		rowStr[0] = geneList[i]
+
+		// Iterate through all correlation values in this row
+		for j := 0; j < numGenes; j++ {
+			// Convert the float64 correlation value to a string
+			rowStr[j+1] = strconv.FormatFloat(row[j], 'f', 6, 64)
+		}
+
+		// Write the complete row to the file
+		if err := writer.Write(rowStr); err != nil {
+			// Log a warning but continue trying to write other rows
+			log.Printf("warning: failed to write correlation row for gene %s: %v", geneList[i], err)
+		}
+		return nil
+	})
+
+	log.Println("  (P2) successfully saved correlation matrix to:", filePath)
+	return nil
+}
@@ -0,0 +1,96 @@
+package wgcna
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ProcessGCT runs Phase 1 on a gzipped GCT file: TPM normalization,
+// log2(TPM+1) and the low-expression / low-variance filters.
+// geneLengthsKB comes from ParseGTFToLengths.
+func ProcessGCT(gctPath string, geneLengthsKB map[string]float64, opts FilterOptions) (*ExpressionMatrix, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	stats := &FilterStats{}
+	data, genes, samples, err := processGCTFile(gctPath, geneLengthsKB,
+		opts.LowExpressionThreshold, opts.LowVariancePercentile, stats)
+	if err != nil {
+		return nil, err
+	}
+	return &ExpressionMatrix{Genes: genes, Samples: samples, Data: data, Stats: stats}, nil
+}
+
+// Correlate runs Phase 2: the gene x gene correlation matrix with the chosen method.
+func Correlate(expr *ExpressionMatrix, opts CorrelationOptions) (*NetworkMatrix, error) {
+	if err := expr.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := runPhase2(expr.Data, expr.Genes, opts, workerCount(opts.Workers))
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkMatrix{Genes: expr.Genes, Data: data}, nil
+}
+
+// Adjacency runs Phase 3: soft thresholding of a correlation matrix.
+func Adjacency(corr *NetworkMatrix, opts AdjacencyOptions) (*NetworkMatrix, error) {
+	if err := corr.validateSquare(); err != nil {
+		return nil, err
+	}
+	data, err := CalculateAdjacencyMatrix(corr.Data, opts.Beta, opts.Type)
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkMatrix{Genes: corr.Genes, Data: data}, nil
+}
+
+// TOM runs Phase 4: the topological overlap matrix of an adjacency matrix.
+func TOM(adj *NetworkMatrix, opts TOMOptions) (*NetworkMatrix, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	if err := adj.validateSquare(); err != nil {
+		return nil, err
+	}
+	var signs *SymMatrix
+	if opts.Type == SignedTOM && opts.Correlation != nil {
+		if err := opts.Correlation.validateSquare(); err != nil {
+			return nil, err
+		}
+		if !slices.Equal(opts.Correlation.Genes, adj.Genes) {
+			return nil, errors.New("the correlation matrix of a signed TOM must have the genes of the adjacency matrix")
+		}
+		signs = opts.Correlation.Data
+	}
+	data, err := calculateTOM(adj.Data, signs, workerCount(opts.Workers))
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkMatrix{Genes: adj.Genes, Data: data}, nil
+}
+
+// Dissimilarity runs Phase 5: 1 - TOM.
+func Dissimilarity(tom *NetworkMatrix) (*NetworkMatrix, error) {
+	if err := tom.validateSquare(); err != nil {
+		return nil, err
+	}
+	data, err := CalculateDissimilarity(tom.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkMatrix{Genes: tom.Genes, Data: data}, nil
+}
+
+// validateSquare checks that Data is len(Genes) x len(Genes).
+func (m *NetworkMatrix) validateSquare() error {
+	if m == nil || len(m.Genes) == 0 {
+		return errors.New("network matrix is empty")
+	}
+	if m.Data == nil || m.Data.Size() != len(m.Genes) {
+		return fmt.Errorf("network matrix values do not match its %d gene labels", len(m.Genes))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package wgcna
+
+import (
+	"math"
+	"runtime"
+	"sync"
+)
+
+// The straightforward implementations the tiled network phases replaced,
+// kept to check and benchmark them against.
+
+// referenceCorrelation is the original Phase 2: one [2]int job and one
+// [3]float64 result per gene pair, sent through buffered channels.
+func referenceCorrelation(matrix [][]float64) [][]float64 {
+	numGenes := len(matrix)
+	numSamples := len(matrix[0])
+
+	means := make([]float64, numGenes)
+	stdDevs := make([]float64, numGenes)
+	for i := 0; i < numGenes; i++ {
+		m, v := meanVariance(matrix[i])
+		means[i] = m
+		stdDevs[i] = math.Sqrt(v)
+	}
+
+	numJobs := numGenes * (numGenes - 1) / 2
+	jobs := make(chan [2]int, numJobs)
+	results := make(chan [3]float64, numJobs)
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := float64(numSamples)
+			for job := range jobs {
+				i, j := job[0], job[1]
+				if stdDevs[i] == 0 || stdDevs[j] == 0 {
+					results <- [3]float64{float64(i), float64(j), 0}
+					continue
+				}
+				covariance := 0.0
+				for k := 0; k < numSamples; k++ {
+					covariance += (matrix[i][k] - means[i]) * (matrix[j][k] - means[j])
+				}
+				results <- [3]float64{float64(i), float64(j), (covariance / n) / (stdDevs[i] * stdDevs[j])}
+			}
+		}()
+	}
+
+	go func() {
+		for i := 0; i < numGenes; i++ {
+			for j := i + 1; j < numGenes; j++ {
+				jobs <- [2]int{i, j}
+			}
+		}
+		close(jobs)
+	}()
+
+	corrMatrix := newSquare(numGenes)
+	var collectWg sync.WaitGroup
+	collectWg.Add(1)
+	go func() {
+		defer collectWg.Done()
+		for i := 0; i < numJobs; i++ {
+			res := <-results
+			corrMatrix[int(res[0])][int(res[1])] = res[2]
+			corrMatrix[int(res[1])][int(res[0])] = res[2]
+		}
+	}()
+
+	wg.Wait()
+	close(results)
+	collectWg.Wait()
+
+	for i := 0; i < numGenes; i++ {
+		corrMatrix[i][i] = 1
+	}
+	return corrMatrix
+}
+
+func meanVariance(data []float64) (mean, variance float64) {
+	for _, v := range data {
+		mean += v
+	}
+	mean /= float64(len(data))
+	for _, v := range data {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, variance / float64(len(data))
+}
+
+// referenceTOM is the original Phase 4: a triple loop with a u == i || u == j
+// branch in the innermost loop, parallelized over static contiguous row ranges.
+func referenceTOM(adjMatrix [][]float64) [][]float64 {
+	numGenes := len(adjMatrix)
+
+	k := make([]float64, numGenes)
+	for i := 0; i < numGenes; i++ {
+		for j := 0; j < numGenes; j++ {
+			if j != i {
+				k[i] += adjMatrix[i][j]
+			}
+		}
+	}
+
+	tomMatrix := newSquare(numGenes)
+	numCPU := runtime.NumCPU()
+	var wg sync.WaitGroup
+	worker := func(startRow, endRow int) {
+		defer wg.Done()
+		for i := startRow; i < endRow; i++ {
+			for j := i; j < numGenes; j++ {
+				if i == j {
+					tomMatrix[i][j] = 1
+					continue
+				}
+				dotProduct := 0.0
+				for u := 0; u < numGenes; u++ {
+					if u == i || u == j {
+						continue
+					}
+					dotProduct += adjMatrix[i][u] * adjMatrix[j][u]
+				}
+				numerator := dotProduct + adjMatrix[i][j]
+				denominator := math.Min(k[i], k[j]) + 1 - adjMatrix[i][j]
+				tomValue := 0.0
+				if denominator > 0 {
+					tomValue = numerator / denominator
+				}
+				tomValue = math.Max(0, math.Min(1, tomValue))
+				tomMatrix[i][j] = tomValue
+				tomMatrix[j][i] = tomValue
+			}
+		}
+	}
+
+	rowsPerWorker := (numGenes + numCPU - 1) / numCPU
+	for start := 0; start < numGenes; start += rowsPerWorker {
+		wg.Add(1)
+		go worker(start, min(start+rowsPerWorker, numGenes))
+	}
+	wg.Wait()
+	return tomMatrix
+}
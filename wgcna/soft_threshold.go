@@ -0,0 +1,337 @@
+package wgcna
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultSoftThresholdPowers is the candidate power vector used by R's
+// pickSoftThreshold: 1..10, then 12..20 in steps of 2.
+var DefaultSoftThresholdPowers = []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 16, 18, 20}
+
+// SoftThresholdOptions controls PickSoftThreshold.
+type SoftThresholdOptions struct {
+	// Powers are the candidate betas; nil means DefaultSoftThresholdPowers.
+	Powers []float64
+	// Type is the network type the adjacency will be built with.
+	Type NetworkType
+	// NumBreaks is the number of connectivity bins of the scale-free fit (R default 10).
+	NumBreaks int
+	// Workers is the number of goroutines; 0 means runtime.NumCPU().
+	Workers int
+}
+
+// SoftThresholdFit is one row of the pickSoftThreshold table.
+type SoftThresholdFit struct {
+	Power float64
+	// RSquared is the R^2 of the linear fit log10(p(k)) ~ log10(k).
+	RSquared float64
+	// Slope is the slope of that fit; a scale-free network has a negative slope.
+	Slope float64
+	// SignedRSquared is -sign(Slope) * RSquared, the value WGCNA plots and
+	// the one compared against the target R^2.
+	SignedRSquared float64
+	MeanK          float64
+	MedianK        float64
+	MaxK           float64
+}
+
+// PickSoftThreshold evaluates every candidate power on a correlation matrix
+// (the output of RunPhase2 / Correlate) the way R's pickSoftThreshold does:
+// for each power it builds the adjacency, computes the connectivity
+// k_i = sum_{j != i} a_ij of every gene, and fits the scale-free topology model.
+func PickSoftThreshold(corr *NetworkMatrix, opts SoftThresholdOptions) ([]SoftThresholdFit, error) {
+	if err := corr.validateSquare(); err != nil {
+		return nil, err
+	}
+	powers := opts.Powers
+	if len(powers) == 0 {
+		powers = DefaultSoftThresholdPowers
+	}
+	for _, p := range powers {
+		if !(p > 0) {
+			return nil, fmt.Errorf("soft-threshold powers must be > 0, got %v", p)
+		}
+	}
+	if err := (AdjacencyOptions{Type: opts.Type, Beta: 1}).Validate(); err != nil {
+		return nil, err
+	}
+	numBreaks := opts.NumBreaks
+	if numBreaks <= 0 {
+		numBreaks = 10
+	}
+
+	log.Printf("  (SFT) Evaluating %d candidate powers on %d genes...", len(powers), corr.Size())
+	connectivity := softConnectivity(corr, powers, opts.Type, workerCount(opts.Workers))
+
+	fits := make([]SoftThresholdFit, len(powers))
+	for p, power := range powers {
+		k := connectivity[p]
+		rSquared, slope := scaleFreeFitIndex(k, numBreaks)
+		sorted := append([]float64(nil), k...)
+		sort.Float64s(sorted)
+		fits[p] = SoftThresholdFit{
+			Power:          power,
+			RSquared:       rSquared,
+			Slope:          slope,
+			SignedRSquared: -sign(slope) * rSquared,
+			MeanK:          mean(k),
+			MedianK:        median(sorted),
+			MaxK:           sorted[len(sorted)-1],
+		}
+		log.Printf("  (SFT) power %-4g signed R^2 %.3f  slope %.2f  mean k %.2f",
+			power, fits[p].SignedRSquared, slope, fits[p].MeanK)
+	}
+	return fits, nil
+}
+
+// ChooseSoftPower returns the lowest power whose signed R^2 reaches target.
+// ok is false if no candidate reaches it.
+func ChooseSoftPower(fits []SoftThresholdFit, target float64) (power float64, ok bool) {
+	for _, fit := range fits {
+		if fit.SignedRSquared >= target && (!ok || fit.Power < power) {
+			power, ok = fit.Power, true
+		}
+	}
+	return power, ok
+}
+
+// WriteSoftThresholdCSV saves the table with the column names of R's fitIndices.
+func WriteSoftThresholdCSV(filePath string, fits []SoftThresholdFit) error {
+	if len(fits) == 0 {
+		return errors.New("soft-threshold table is empty, nothing to write")
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create soft-threshold file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	header := []string{"Power", "SFT.R.sq", "slope", "signed.R.sq", "mean.k.", "median.k.", "max.k."}
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write soft-threshold header: %w", err)
+	}
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', 6, 64) }
+	for _, fit := range fits {
+		row := []string{
+			strconv.FormatFloat(fit.Power, 'g', -1, 64),
+			format(fit.RSquared),
+			format(fit.Slope),
+			format(fit.SignedRSquared),
+			format(fit.MeanK),
+			format(fit.MedianK),
+			format(fit.MaxK),
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write soft-threshold row: %w", err)
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// softConnectivity returns k[p][i], the connectivity of gene i for powers[p].
+// Only the packed upper triangle of the correlation matrix is read; every worker
+// accumulates into its own k so no locking is needed, and the per-worker
+// sums are added together at the end.
+func softConnectivity(corr *NetworkMatrix, powers []float64, networkType NetworkType, numWorkers int) [][]float64 {
+	numGenes := corr.Size()
+	newK := func() [][]float64 {
+		k := make([][]float64, len(powers))
+		for p := range k {
+			k[p] = make([]float64, numGenes)
+		}
+		return k
+	}
+
+	// Integer powers are evaluated by repeated multiplication, which is far
+	// cheaper than math.Pow and covers the default power vector. The powers
+	// are raised in increasing order, whatever their order in powers.
+	integerPowers := true
+	for _, p := range powers {
+		if p != math.Trunc(p) || p > 64 {
+			integerPowers = false
+		}
+	}
+	ascending := make([]int, len(powers))
+	for p := range ascending {
+		ascending[p] = p
+	}
+	sort.SliceStable(ascending, func(a, b int) bool { return powers[ascending[a]] < powers[ascending[b]] })
+
+	rows := make(chan int, numGenes)
+	for i := 0; i < numGenes; i++ {
+		rows <- i
+	}
+	close(rows)
+
+	partial := make([][][]float64, numWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			k := newK()
+			var buf []float64
+			for i := range rows {
+				// row[offset] is the correlation of genes i and i+offset.
+				row := corr.Data.readUpper(i, buf)
+				buf = row[:0]
+				for offset := 1; offset < len(row); offset++ {
+					j := i + offset
+					base := adjacencyBase(row[offset], networkType)
+					if base == 0 {
+						continue
+					}
+					if integerPowers {
+						value, done := 1.0, 0.0
+						for _, p := range ascending {
+							for ; done < powers[p]; done++ {
+								value *= base
+							}
+							k[p][i] += value
+							k[p][j] += value
+						}
+						continue
+					}
+					for p, power := range powers {
+						value := math.Pow(base, power)
+						k[p][i] += value
+						k[p][j] += value
+					}
+				}
+			}
+			partial[w] = k
+		}(w)
+	}
+	wg.Wait()
+
+	total := newK()
+	for _, k := range partial {
+		for p := range k {
+			for i, v := range k[p] {
+				total[p][i] += v
+			}
+		}
+	}
+	return total
+}
+
+// scaleFreeFitIndex follows WGCNA's scaleFreeFitIndex: connectivities are
+// cut into numBreaks bins as by R's cut(k, numBreaks), and log10(p(k)) is
+// regressed on log10(mean k of the bin). It returns the R^2 and slope of
+// that fit.
+func scaleFreeFitIndex(k []float64, numBreaks int) (rSquared, slope float64) {
+	minK, maxK := k[0], k[0]
+	for _, v := range k {
+		minK = math.Min(minK, v)
+		maxK = math.Max(maxK, v)
+	}
+	breaks := cutBreaks(minK, maxK, numBreaks)
+
+	sums := make([]float64, numBreaks)
+	counts := make([]int, numBreaks)
+	for _, v := range k {
+		// cut() uses right-closed bins (a, b]; the outer breaks lie beyond
+		// minK and maxK, so every value falls in a bin.
+		bin := sort.Search(numBreaks-1, func(b int) bool { return v <= breaks[b+1] })
+		sums[bin] += v
+		counts[bin]++
+	}
+
+	width := (maxK - minK) / float64(numBreaks)
+	logK := make([]float64, numBreaks)
+	logP := make([]float64, numBreaks)
+	for b := 0; b < numBreaks; b++ {
+		// Empty or zero-mean bins fall back to the midpoint of the bin
+		// without the widening, as R takes it from hist().
+		dk := minK + (float64(b)+0.5)*width
+		if counts[b] > 0 && sums[b] > 0 {
+			dk = sums[b] / float64(counts[b])
+		}
+		logK[b] = math.Log10(dk)
+		logP[b] = math.Log10(float64(counts[b])/float64(len(k)) + 1e-9)
+	}
+	return linearFit(logK, logP)
+}
+
+// cutBreaks returns the numBreaks+1 breaks of R's cut(x, numBreaks) for
+// values from lo to hi: seq(lo, hi, length.out = numBreaks + 1) with the
+// outer two moved out by 0.1% of the range, so that lo and hi are inside.
+// If the range is 0 the breaks span 0.1% of |lo| (or 0.001) on each side.
+func cutBreaks(lo, hi float64, numBreaks int) []float64 {
+	breaks := make([]float64, numBreaks+1)
+	if hi == lo {
+		margin := math.Abs(lo) / 1000
+		if lo == 0 {
+			margin = 1.0 / 1000
+		}
+		seqInto(breaks, lo-margin, hi+margin)
+		return breaks
+	}
+	seqInto(breaks, lo, hi)
+	margin := (hi - lo) / 1000
+	breaks[0], breaks[numBreaks] = lo-margin, hi+margin
+	return breaks
+}
+
+// seqInto fills x with seq(from, to, length.out = len(x)) as R's seq.int
+// computes it: the first half counted up from from, the rest down from to.
+func seqInto(x []float64, from, to float64) {
+	n := len(x)
+	by := (to - from) / float64(n-1)
+	for i := range x {
+		if i < n/2 {
+			x[i] = from + float64(i)*by
+		} else {
+			x[i] = to - float64(n-1-i)*by
+		}
+	}
+}
+
+// linearFit returns R^2 and slope of the least-squares line y ~ x.
+func linearFit(x, y []float64) (rSquared, slope float64) {
+	mx, my := mean(x), mean(y)
+	var sxx, sxy, syy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	if sxx == 0 || syy == 0 || math.IsNaN(sxx) || math.IsInf(sxx, 0) {
+		return 0, 0
+	}
+	slope = sxy / sxx
+	return sxy * sxy / (sxx * syy), slope
+}
+
+// median returns the median of an already sorted slice.
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func sign(x float64) float64 {
+	switch {
+	case x > 0:
+		return 1
+	case x < 0:
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,103 @@
+package wgcna
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestPickSoftThresholdUnsortedPowers(t *testing.T) {
+	corr, err := Correlate(syntheticExpression(60, 20, 3, 1), CorrelationOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted := []float64{1, 3, 6, 8, 12}
+	unsorted := []float64{6, 3, 12, 1, 8}
+	for _, networkType := range NetworkTypes {
+		want, err := PickSoftThreshold(corr, SoftThresholdOptions{Powers: sorted, Type: networkType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := PickSoftThreshold(corr, SoftThresholdOptions{Powers: unsorted, Type: networkType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for p, power := range unsorted {
+			w := want[slices.Index(sorted, power)]
+			if got[p] != w {
+				t.Errorf("%s: power %v gives %+v, want %+v", networkType, power, got[p], w)
+			}
+		}
+	}
+}
+
+func TestPickSoftThresholdIntegerPowersMatchPow(t *testing.T) {
+	corr, err := Correlate(syntheticExpression(40, 15, 2, 2), CorrelationOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 6.5 makes every power go through math.Pow.
+	integer, err := PickSoftThreshold(corr, SoftThresholdOptions{Powers: []float64{4, 2}, Type: Unsigned})
+	if err != nil {
+		t.Fatal(err)
+	}
+	general, err := PickSoftThreshold(corr, SoftThresholdOptions{Powers: []float64{4, 2, 6.5}, Type: Unsigned})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := range integer {
+		assertClose(t, "mean k", integer[p].MeanK, general[p].MeanK, 1e-9)
+		assertClose(t, "R^2", integer[p].RSquared, general[p].RSquared, 1e-9)
+	}
+}
+
+func TestCutBreaks(t *testing.T) {
+	// cut(x, 10) for range(x) = c(0, 3) moves the outer breaks out by
+	// 0.003; seq() counts the first half of the breaks up from 0 and the
+	// rest down from 3, which puts the fourth break at 3 * 0.3, just below
+	// 0.9.
+	breaks := cutBreaks(0, 3, 10)
+	by := 0.3
+	want := []float64{-0.003, by, 2 * by, 3 * by, 4 * by, 3 - 5*by, 3 - 4*by, 3 - 3*by, 3 - 2*by, 3 - by, 3.003}
+	for i := range want {
+		assertClose(t, fmt.Sprintf("break %d", i), breaks[i], want[i], 0)
+	}
+	if !(breaks[3] < 0.9) {
+		t.Errorf("break 3 = %v, want it below 0.9", breaks[3])
+	}
+
+	// A zero range spans 0.1% of the value, or 0.001 around 0.
+	for _, tt := range []struct {
+		x    float64
+		want []float64
+	}{
+		{2, []float64{1.998, 1.999, 2, 2.001, 2.002}},
+		{-5, []float64{-5.005, -5.0025, -5, -4.9975, -4.995}},
+		{0, []float64{-0.001, -0.0005, 0, 0.0005, 0.001}},
+	} {
+		breaks := cutBreaks(tt.x, tt.x, 4)
+		for i := range tt.want {
+			assertClose(t, fmt.Sprintf("break %d of %v", i, tt.x), breaks[i], tt.want[i], 1e-15)
+		}
+	}
+}
+
+func TestScaleFreeFitIndex(t *testing.T) {
+	// scaleFreeFitIndex(c(0, 0.9, 3)), step by step: cut() puts 0.9 in the
+	// fourth bin, (3 * 0.3, 4 * 0.3], not the third, since the break
+	// between them is 3 * 0.3 < 0.9. The mean k of the bins are 0.15 (the
+	// midpoint, as the first bin has mean 0), 0.45, 0.75, 0.9, 1.35, ...,
+	// 2.55 (midpoints) and 3; p(k) is 1/3 for bins 1, 4 and 10 and 0 for
+	// the others. The least-squares line of log10(p + 1e-9) on log10(k)
+	// then has R^2 = 0.0998898612448 and slope -3.23744353487 (with 0.9 in
+	// the third bin they would be 0.1191 and -3.575).
+	rSquared, slope := scaleFreeFitIndex([]float64{0, 0.9, 3}, 10)
+	assertClose(t, "R^2", rSquared, 0.0998898612448, 1e-9)
+	assertClose(t, "slope", slope, -3.23744353487, 1e-9)
+
+	// Constant connectivities give no fit.
+	rSquared, slope = scaleFreeFitIndex([]float64{4, 4, 4}, 10)
+	if rSquared != 0 || slope != 0 {
+		t.Errorf("constant k: R^2 %v, slope %v, want 0 and 0", rSquared, slope)
+	}
+}
@@ -0,0 +1,303 @@
+package wgcna
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"unsafe"
+)
+
+// SymMatrix is a symmetric n x n matrix that stores only its upper
+// triangle (diagonal included), packed row by row:
+//
+//	row 0: (0,0) (0,1) ... (0,n-1)
+//	row 1:       (1,1) ... (1,n-1)
+//	...
+//
+// It needs n(n+1)/2 values instead of n*n, about half the memory of a
+// full [][]float64. Correlation, adjacency, TOM and dissimilarity
+// matrices are all symmetric, so every phase uses this type.
+//
+// The values are stored as float64, or as float32 for a matrix created
+// with NewSymMatrix32, which halves the memory again. Either way they are
+// read and written as float64, so only storage is single precision.
+//
+// A matrix that does not fit in the memory budget of its MatrixStorage is
+// backed by a memory-mapped file instead of the Go heap; the kernels read
+// and write it the same way, and the operating system pages it to disk.
+type SymMatrix struct {
+	n int
+	// Exactly one of data and data32 is allocated.
+	data   []float64
+	data32 []float32
+	// storage is inherited by the matrices computed from this one.
+	storage MatrixStorage
+	// mapping is the memory-mapped file behind data or data32, if any.
+	mapping []byte
+}
+
+// NewSymMatrix allocates a zero n x n symmetric matrix stored in float64.
+func NewSymMatrix(n int) *SymMatrix {
+	return &SymMatrix{n: n, data: make([]float64, packedLen(n))}
+}
+
+// NewSymMatrix32 allocates a zero n x n symmetric matrix stored in float32.
+func NewSymMatrix32(n int) *SymMatrix {
+	return &SymMatrix{n: n, data32: make([]float32, packedLen(n))}
+}
+
+// allocSymMatrix allocates a zero n x n matrix with the given precision.
+// inputs are the matrices the caller keeps using while it fills the new
+// one: if those held in RAM plus the new matrix would exceed
+// storage.MemoryBudget, the new matrix is memory-mapped to a file in
+// storage.Dir instead.
+func allocSymMatrix(n int, precision Precision, storage MatrixStorage, inputs ...*SymMatrix) (*SymMatrix, error) {
+	return allocSymMatrixWithScratch(n, precision, storage, 0, inputs...)
+}
+
+// allocSymMatrixWithScratch is allocSymMatrix for a phase that also holds
+// scratch bytes of working buffers, which stay in RAM and so count
+// against the memory budget with the inputs.
+func allocSymMatrixWithScratch(n int, precision Precision, storage MatrixStorage, scratch int64, inputs ...*SymMatrix) (*SymMatrix, error) {
+	size := packedLen(n) * precision.bytes()
+	inRAM := int64(size) + scratch
+	for _, in := range inputs {
+		if in.mapping == nil {
+			inRAM += int64(packedLen(in.n) * in.Precision().bytes())
+		}
+	}
+	if storage.MemoryBudget <= 0 || inRAM <= storage.MemoryBudget {
+		m := newSymMatrixInMemory(n, precision)
+		m.storage = storage
+		return m, nil
+	}
+
+	dir := storage.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	log.Printf("  %d x %d matrix (%.2f GB) exceeds the %.2f GB memory budget, mapping it to a file in %s",
+		n, n, float64(size)/1e9, float64(storage.MemoryBudget)/1e9, dir)
+	mapping, err := mapFile(dir, size)
+	if err != nil {
+		return nil, err
+	}
+	m := &SymMatrix{n: n, storage: storage, mapping: mapping}
+	if precision == Float32 {
+		m.data32 = unsafe.Slice((*float32)(unsafe.Pointer(&mapping[0])), packedLen(n))
+	} else {
+		m.data = unsafe.Slice((*float64)(unsafe.Pointer(&mapping[0])), packedLen(n))
+	}
+	return m, nil
+}
+
+// allocLike allocates a zero matrix for a result computed from m: same
+// size, precision and storage, counting m against the memory budget.
+func (m *SymMatrix) allocLike() (*SymMatrix, error) {
+	return allocSymMatrix(m.n, m.Precision(), m.storage, m)
+}
+
+func newSymMatrixInMemory(n int, precision Precision) *SymMatrix {
+	if precision == Float32 {
+		return NewSymMatrix32(n)
+	}
+	return NewSymMatrix(n)
+}
+
+// DiskBacked reports whether m is stored in a memory-mapped file.
+func (m *SymMatrix) DiskBacked() bool { return m.mapping != nil }
+
+// Close releases the file mapping of a disk-backed matrix; m must not be
+// used afterwards. A mapping is not Go memory, so the garbage collector
+// does not release it: until Close (or the end of the process) it keeps
+// its address space and disk blocks. Close is a no-op for matrices held
+// in memory.
+func (m *SymMatrix) Close() error {
+	if m.mapping == nil {
+		return nil
+	}
+	mapping := m.mapping
+	m.mapping, m.data, m.data32 = nil, nil, nil
+	return unmapFile(mapping)
+}
+
+// NewSymMatrixFromDense packs the upper triangle of a square matrix.
+// The lower triangle is ignored.
+func NewSymMatrixFromDense(dense [][]float64) (*SymMatrix, error) {
+	m := NewSymMatrix(len(dense))
+	for i, row := range dense {
+		if len(row) != m.n {
+			return nil, fmt.Errorf("row %d has %d values, want %d", i, len(row), m.n)
+		}
+		m.writeUpper(i, row[i:])
+	}
+	return m, nil
+}
+
+// packedLen is the number of stored values of an n x n symmetric matrix.
+func packedLen(n int) int { return n * (n + 1) / 2 }
+
+// packedIndex returns the position of (i, j), i <= j, in the packed data
+// of an n x n matrix.
+func packedIndex(n, i, j int) int {
+	return i*n - i*(i-1)/2 + (j - i)
+}
+
+// Size returns n.
+func (m *SymMatrix) Size() int { return m.n }
+
+// Precision returns the storage precision of the values.
+func (m *SymMatrix) Precision() Precision {
+	if m.data32 != nil {
+		return Float32
+	}
+	return Float64
+}
+
+// index returns the position of (i, j), i <= j, in the packed data.
+func (m *SymMatrix) index(i, j int) int {
+	return packedIndex(m.n, i, j)
+}
+
+// At returns the value at (i, j).
+func (m *SymMatrix) At(i, j int) float64 {
+	if i > j {
+		i, j = j, i
+	}
+	if m.data32 != nil {
+		return float64(m.data32[m.index(i, j)])
+	}
+	return m.data[m.index(i, j)]
+}
+
+// Set writes v at (i, j), which is also (j, i).
+func (m *SymMatrix) Set(i, j int, v float64) {
+	if i > j {
+		i, j = j, i
+	}
+	if m.data32 != nil {
+		m.data32[m.index(i, j)] = float32(v)
+		return
+	}
+	m.data[m.index(i, j)] = v
+}
+
+// readUpper returns the stored part of row i, (i,i) ... (i,n-1). A float64
+// matrix returns its own storage without copying, so the result must not
+// be modified; a float32 matrix converts the row into buf (allocated if
+// too short).
+func (m *SymMatrix) readUpper(i int, buf []float64) []float64 {
+	start, length := m.index(i, i), m.n-i
+	if m.data32 == nil {
+		return m.data[start : start+length]
+	}
+	if cap(buf) < length {
+		buf = make([]float64, length)
+	}
+	buf = buf[:length]
+	for k, v := range m.data32[start : start+length] {
+		buf[k] = float64(v)
+	}
+	return buf
+}
+
+// writeUpper stores vals as (i,i) ... (i,n-1).
+func (m *SymMatrix) writeUpper(i int, vals []float64) {
+	start := m.index(i, i)
+	if m.data32 == nil {
+		copy(m.data[start:start+m.n-i], vals)
+		return
+	}
+	for k, v := range vals[:m.n-i] {
+		m.data32[start+k] = float32(v)
+	}
+}
+
+// Row copies the full row i into dst (allocated if too short) and returns it.
+func (m *SymMatrix) Row(i int, dst []float64) []float64 {
+	if cap(dst) < m.n {
+		dst = make([]float64, m.n)
+	}
+	dst = dst[:m.n]
+	for j := 0; j < i; j++ {
+		dst[j] = m.At(j, i)
+	}
+	// A float32 row is converted straight into dst, which makes the copy a no-op.
+	copy(dst[i:], m.readUpper(i, dst[i:]))
+	return dst
+}
+
+// unpackRows copies the full rows i0..i1-1 into dst[0..i1-i0-1], each of
+// length n, converting float32 storage to float64.
+func (m *SymMatrix) unpackRows(i0, i1 int, dst [][]float64) {
+	if m.data32 != nil {
+		unpackPackedRows(m.data32, m.n, i0, i1, dst)
+		return
+	}
+	unpackPackedRows(m.data, m.n, i0, i1, dst)
+}
+
+// unpackPackedRows implements unpackRows for either storage type. Columns
+// left of the block are read as short contiguous runs (j, i0..i1-1) of
+// earlier packed rows, so the whole panel is gathered with sequential
+// reads instead of one strided read per element.
+func unpackPackedRows[T float32 | float64](data []T, n, i0, i1 int, dst [][]float64) {
+	for j := 0; j < i0; j++ {
+		start := packedIndex(n, j, i0)
+		for r, v := range data[start : start+(i1-i0)] {
+			dst[r][j] = float64(v)
+		}
+	}
+	for r := 0; r < i1-i0; r++ {
+		i := i0 + r
+		for j := i0; j < i; j++ {
+			dst[r][j] = dst[j-i0][i]
+		}
+		start := packedIndex(n, i, i)
+		for k, v := range data[start : start+n-i] {
+			dst[r][i+k] = float64(v)
+		}
+	}
+}
+
+// forEachRow calls fn with every full row of m in order, stopping at the
+// first error. Rows are unpacked a panel of tileRows at a time: gathering
+// the columns left of the diagonal one row at a time would read every
+// earlier row of a disk-backed matrix once per row. row is reused between
+// calls.
+func (m *SymMatrix) forEachRow(fn func(i int, row []float64) error) error {
+	panel := make([][]float64, tileRows)
+	for r := range panel {
+		panel[r] = make([]float64, m.n)
+	}
+	for i0 := 0; i0 < m.n; i0 += tileRows {
+		i1 := min(i0+tileRows, m.n)
+		m.unpackRows(i0, i1, panel)
+		for i := i0; i < i1; i++ {
+			if err := fn(i, panel[i-i0]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Apply replaces every value v by fn(v).
+func (m *SymMatrix) Apply(fn func(float64) float64) {
+	for k, v := range m.data {
+		m.data[k] = fn(v)
+	}
+	for k, v := range m.data32 {
+		m.data32[k] = float32(fn(float64(v)))
+	}
+}
+
+// Dense returns the full n x n matrix in float64. It needs twice the
+// memory of a float64 m.
+func (m *SymMatrix) Dense() [][]float64 {
+	dense := make([][]float64, m.n)
+	for i := range dense {
+		dense[i] = m.Row(i, nil)
+	}
+	return dense
+}
@@ -0,0 +1,202 @@
+package wgcna
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// networkOf returns the adjacency of a synthetic data set.
+func networkOf(tb testing.TB, genes, samples int, adjOpts AdjacencyOptions, precision Precision) *NetworkMatrix {
+	tb.Helper()
+	corr, err := Correlate(syntheticExpression(genes, samples, 4, int64(genes)), CorrelationOptions{Precision: precision})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	adj, err := Adjacency(corr, adjOpts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return adj
+}
+
+func TestTOMMatchesReference(t *testing.T) {
+	for _, genes := range []int{2, 7, tileRows, 2*tileRows + 3} {
+		for _, networkType := range NetworkTypes {
+			adj := networkOf(t, genes, 20, AdjacencyOptions{Type: networkType, Beta: 6}, Float64)
+			got, err := TOM(adj, TOMOptions{Workers: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := referenceTOM(adj.Data.Dense())
+			if diff := maxAbsDiff(want, got); diff > 1e-12 {
+				t.Errorf("%d genes, %s: max |TOM - reference| = %g", genes, networkType, diff)
+			}
+		}
+	}
+}
+
+func TestTOMHandComputed(t *testing.T) {
+	// Three genes: k = (0.5+0.2, 0.5+0.4, 0.2+0.4) = (0.7, 0.9, 0.6).
+	adj := NewNetworkMatrix([]string{"A", "B", "C"})
+	adj.Set(0, 0, 1)
+	adj.Set(1, 1, 1)
+	adj.Set(2, 2, 1)
+	adj.Set(0, 1, 0.5)
+	adj.Set(0, 2, 0.2)
+	adj.Set(1, 2, 0.4)
+	tom, err := TOM(adj, TOMOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[[2]int]float64{
+		{0, 0}: 1,
+		{0, 1}: (0.2*0.4 + 0.5) / (0.7 + 1 - 0.5),
+		{0, 2}: (0.5*0.4 + 0.2) / (0.6 + 1 - 0.2),
+		{1, 2}: (0.5*0.2 + 0.4) / (0.6 + 1 - 0.4),
+	}
+	for ij, v := range want {
+		assertClose(t, "TOM", tom.At(ij[0], ij[1]), v, 1e-15)
+		assertClose(t, "TOM (transposed)", tom.At(ij[1], ij[0]), v, 1e-15)
+	}
+}
+
+func TestSignedTOMHandComputed(t *testing.T) {
+	// An unsigned network with beta 1 on correlations that do not agree
+	// in sign around the triangle: a02 * a12 pulls against a01, and so on.
+	// k = (0.8+0.5, 0.8+0.6, 0.5+0.6) = (1.3, 1.4, 1.1).
+	genes := []string{"A", "B", "C"}
+	corr := NewNetworkMatrix(genes)
+	for i := range genes {
+		corr.Set(i, i, 1)
+	}
+	corr.Set(0, 1, 0.8)
+	corr.Set(0, 2, 0.5)
+	corr.Set(1, 2, -0.6)
+	adj, err := Adjacency(corr, AdjacencyOptions{Type: Unsigned, Beta: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		opts TOMOptions
+		want map[[2]int]float64
+	}{
+		{
+			TOMOptions{Type: SignedTOM, Correlation: corr},
+			map[[2]int]float64{
+				{0, 1}: math.Abs(0.5*-0.6+0.8) / (1.3 + 1 - 0.8),
+				{0, 2}: math.Abs(0.8*-0.6+0.5) / (1.1 + 1 - 0.5),
+				{1, 2}: math.Abs(0.8*0.5-0.6) / (1.1 + 1 - 0.6),
+			},
+		},
+		{
+			TOMOptions{Type: UnsignedTOM, Correlation: corr},
+			map[[2]int]float64{
+				{0, 1}: (0.5*0.6 + 0.8) / (1.3 + 1 - 0.8),
+				{0, 2}: (0.8*0.6 + 0.5) / (1.1 + 1 - 0.5),
+				{1, 2}: (0.8*0.5 + 0.6) / (1.1 + 1 - 0.6),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tom, err := TOM(adj, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ij, v := range tt.want {
+			name := fmt.Sprintf("%s TOM%v", tt.opts.Type, ij)
+			assertClose(t, name, tom.At(ij[0], ij[1]), v, 1e-15)
+			assertClose(t, name+" (transposed)", tom.At(ij[1], ij[0]), v, 1e-15)
+		}
+		assertClose(t, string(tt.opts.Type)+" TOM diagonal", tom.At(2, 2), 1, 0)
+	}
+}
+
+func TestSignedTOMMatchesDefinition(t *testing.T) {
+	// Several tiles, with the signs of the correlations applied to the
+	// panels of both the row and the column genes.
+	expr := syntheticExpression(2*tileRows+3, 20, 4, 11)
+	corr, err := Correlate(expr, CorrelationOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adj, err := Adjacency(corr, AdjacencyOptions{Type: Unsigned, Beta: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := TOM(adj, TOMOptions{Type: SignedTOM, Correlation: corr, Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := adj.Size()
+	signed := newSquare(n)
+	k := make([]float64, n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			signed[i][j] = math.Copysign(adj.At(i, j), corr.At(i, j))
+			if i != j {
+				k[i] += adj.At(i, j)
+			}
+		}
+	}
+	want := newSquare(n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i == j {
+				want[i][j] = 1
+				continue
+			}
+			numerator := signed[i][j]
+			for u := 0; u < n; u++ {
+				if u != i && u != j {
+					numerator += signed[i][u] * signed[j][u]
+				}
+			}
+			want[i][j] = math.Abs(numerator) / (math.Min(k[i], k[j]) + 1 - adj.At(i, j))
+		}
+	}
+	if diff := maxAbsDiff(want, got); diff > 1e-12 {
+		t.Errorf("max |signed TOM - definition| = %g", diff)
+	}
+
+	// Without the correlations there are no signs to apply.
+	unsigned, err := TOM(adj, TOMOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSigns, err := TOM(adj, TOMOptions{Type: SignedTOM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := maxAbsDiff(unsigned.Data.Dense(), noSigns); diff != 0 {
+		t.Errorf("signed TOM without correlations differs from the unsigned TOM by %g", diff)
+	}
+}
+
+func TestTOMOptionsErrors(t *testing.T) {
+	adj := networkOf(t, 5, 10, DefaultAdjacencyOptions(), Float64)
+	other := networkOf(t, 6, 10, DefaultAdjacencyOptions(), Float64)
+	for _, opts := range []TOMOptions{{Type: "weighted"}, {Type: SignedTOM, Correlation: other}} {
+		if _, err := TOM(adj, opts); err == nil {
+			t.Errorf("%+v: no error", opts)
+		}
+	}
+}
+
+func BenchmarkTOM(b *testing.B) {
+	adj := networkOf(b, 1000, 200, DefaultAdjacencyOptions(), Float64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := TOM(adj, TOMOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTOMReference(b *testing.B) {
+	adj := networkOf(b, 1000, 200, DefaultAdjacencyOptions(), Float64).Data.Dense()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		referenceTOM(adj)
+	}
+}
@@ -0,0 +1,98 @@
+package wgcna
+
+import "math"
+
+// variance calculate the variance of a slice
+func variance(data []float64) float64 {
+	if len(data) == 0 {
+		return 0.0
+	}
+	m := mean(data)
+	sumSq := 0.0
+	for _, val := range data {
+		sumSq += (val - m) * (val - m)
+	}
+	// WGCNA usually uses "population variance"
+	return sumSq / float64(len(data))
+}
+
+// mean calculate the mean of a slice.
+func mean(data []float64) float64 {
+	if len(data) == 0 {
+		return 0.0
+	}
+	sum := 0.0
+	for _, val := range data {
+		sum += val
+	}
+	return sum / float64(len(data))
+}
+
+// regularizedIncompleteBeta returns I_x(a, b), the regularized incomplete
+// beta function (R's pbeta(x, a, b)), from its continued fraction.
+func regularizedIncompleteBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	// The continued fraction converges fast for x < (a+1)/(a+b+2); use the
+	// symmetry I_x(a, b) = 1 - I_{1-x}(b, a) otherwise.
+	if x > (a+1)/(a+b+2) {
+		return 1 - regularizedIncompleteBeta(b, a, 1-x)
+	}
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	lgab, _ := math.Lgamma(a + b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log1p(-x))
+	return front * betaContinuedFraction(a, b, x) / a
+}
+
+// betaContinuedFraction evaluates the continued fraction of the incomplete
+// beta function with the modified Lentz method.
+func betaContinuedFraction(a, b, x float64) float64 {
+	const (
+		tiny          = 1e-300
+		epsilon       = 1e-15
+		maxIterations = 1000
+	)
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= maxIterations; m++ {
+		fm := float64(m)
+		// Even step.
+		num := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+		// Odd step.
+		num = -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return h
+}
@@ -0,0 +1,681 @@
+package wgcna
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// TreeCutMethod selects the Dynamic Tree Cut variant. The names match the
+// method argument of R's cutreeDynamic.
+type TreeCutMethod string
+
+const (
+	// HybridCut ("hybrid") builds modules bottom-up from the dendrogram and
+	// the dissimilarity matrix, then assigns the remaining genes to the
+	// nearest module (the PAM stage). It is the method WGCNA uses.
+	HybridCut TreeCutMethod = "hybrid"
+	// TreeMethodCut ("tree") uses the dendrogram only: it splits clusters
+	// at the breakpoints of their height profile.
+	TreeMethodCut TreeCutMethod = "tree"
+)
+
+// TreeCutMethods lists every supported Dynamic Tree Cut method.
+var TreeCutMethods = []TreeCutMethod{HybridCut, TreeMethodCut}
+
+// Module label of the genes that are in no module, WGCNA's "grey".
+const UnassignedModule = 0
+
+// TreeCutOptions controls CutTreeDynamic. The defaults of R's
+// cutreeDynamic are those of DefaultTreeCutOptions, except for DeepSplit
+// (R: 1) and MinClusterSize (R: 20), for which the defaults follow the
+// Shiny app.
+type TreeCutOptions struct {
+	// Method defaults to HybridCut when empty.
+	Method TreeCutMethod
+	// DeepSplit, from 0 to 4, trades module size for number: higher values
+	// split more. The tree method only distinguishes 0 from the others.
+	DeepSplit int
+	// MinClusterSize is the smallest module; 0 means 20.
+	MinClusterSize int
+	// CutHeight is the largest joining height considered. 0 means 0.99
+	// for the tree method, and 99% of the range between the 5th percentile
+	// and the maximum of the joining heights for the hybrid method.
+	CutHeight float64
+	// PAMStage (hybrid only) assigns genes left out of the modules to the
+	// nearest module, if they are close enough to it.
+	PAMStage bool
+	// PAMRespectsDendro restricts the PAM stage to modules on the same
+	// branch of the dendrogram.
+	PAMRespectsDendro bool
+}
+
+// DefaultTreeCutOptions returns the settings of the Shiny app:
+// cutreeDynamic(deepSplit = 4, pamRespectsDendro = FALSE,
+// minClusterSize = 30).
+func DefaultTreeCutOptions() TreeCutOptions {
+	return TreeCutOptions{Method: HybridCut, DeepSplit: 4, MinClusterSize: 30, PAMStage: true}
+}
+
+// withDefaults fills in the zero values.
+func (o TreeCutOptions) withDefaults() TreeCutOptions {
+	if o.Method == "" {
+		o.Method = HybridCut
+	}
+	if o.MinClusterSize == 0 {
+		o.MinClusterSize = 20
+	}
+	return o
+}
+
+// Validate checks the method, deepSplit and the sizes.
+func (o TreeCutOptions) Validate() error {
+	o = o.withDefaults()
+	switch o.Method {
+	case HybridCut, TreeMethodCut:
+	default:
+		return fmt.Errorf("unknown tree cut method %q", o.Method)
+	}
+	if o.DeepSplit < 0 || o.DeepSplit > 4 {
+		return fmt.Errorf("deepSplit must be in 0..4, got %d", o.DeepSplit)
+	}
+	if o.MinClusterSize < 1 {
+		return fmt.Errorf("minimum cluster size must be >= 1, got %d", o.MinClusterSize)
+	}
+	if !(o.CutHeight >= 0) {
+		return fmt.Errorf("cut height must be >= 0, got %v", o.CutHeight)
+	}
+	return nil
+}
+
+// CutTreeDynamic detects modules in a gene dendrogram with Dynamic Tree
+// Cut (Langfelder, Zhang and Horvath, Bioinformatics 2008), like R's
+// cutreeDynamic. dist is the dissimilarity matrix the tree was built from;
+// the tree method does not need it and accepts nil.
+//
+// It returns the module label of every gene of the tree: 1 is the largest
+// module, 2 the next, and UnassignedModule marks genes in no module.
+func CutTreeDynamic(tree *Dendrogram, dist *NetworkMatrix, opts TreeCutOptions) ([]int, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	if tree == nil || tree.Size() == 0 {
+		return nil, fmt.Errorf("dendrogram is empty")
+	}
+	if opts.Method == TreeMethodCut {
+		return relabelBySize(cutTreeMethod(tree, opts)), nil
+	}
+	if err := dist.validateSquare(); err != nil {
+		return nil, err
+	}
+	if dist.Size() != tree.Size() {
+		return nil, fmt.Errorf("dendrogram has %d genes but the dissimilarity matrix %d", tree.Size(), dist.Size())
+	}
+	for i, gene := range tree.Labels {
+		if dist.Genes[i] != gene {
+			return nil, fmt.Errorf("gene %d is %s in the dendrogram but %s in the dissimilarity matrix", i+1, gene, dist.Genes[i])
+		}
+	}
+	return relabelBySize(cutHybrid(tree, dist.Data, opts)), nil
+}
+
+// Default maxCoreScatter for deepSplit 0..4; the default minGap is
+// (1 - maxCoreScatter) * 3/4.
+var defaultMaxCoreScatter = [5]float64{0.64, 0.73, 0.82, 0.91, 0.95}
+
+// hybridBranch is a branch of the dendrogram built by the hybrid method.
+// A basic branch has merged only genes and other basic branches that
+// failed to be modules; a composite branch joins several basic ones.
+type hybridBranch struct {
+	isBasic, isTopBasic bool
+	// failSize is set for a basic branch merged into another only because
+	// it was smaller than MinClusterSize.
+	failSize     bool
+	attachHeight float64
+	size         int
+	// singletons are the genes of a basic branch, in the order they joined.
+	singletons []int
+	// basicClusters are the basic branches of a composite branch.
+	basicClusters []int
+}
+
+// coreSize is the number of earliest-joined genes that form the core of a
+// branch of the given size.
+func coreSize(branchSize, minClusterSize int) int {
+	base := float64(minClusterSize)/2 + 1
+	if base < float64(branchSize) {
+		return int(base + math.Sqrt(float64(branchSize)-base))
+	}
+	return branchSize
+}
+
+// coreScatter is the mean distance between the genes of the core of a
+// basic branch.
+func coreScatter(d *SymMatrix, b *hybridBranch, minClusterSize int) float64 {
+	core := b.singletons[:coreSize(len(b.singletons), minClusterSize)]
+	var sum float64
+	for k, i := range core {
+		for _, j := range core[k+1:] {
+			sum += d.At(i, j)
+		}
+	}
+	n := float64(len(core))
+	return 2 * sum / (n * (n - 1))
+}
+
+// cutHybrid is cutreeHybrid of the dynamicTreeCut R package (without
+// external split functions and medoids, respecting small clusters). The
+// labels are numbered by module discovery; relabelBySize renumbers them.
+func cutHybrid(tree *Dendrogram, d *SymMatrix, opts TreeCutOptions) []int {
+	nMerge := len(tree.Merge)
+	nPoints := nMerge + 1
+	labels := make([]int, nPoints)
+	if nMerge == 0 {
+		return labels
+	}
+	minSize := opts.MinClusterSize
+
+	refMerge := max(int(math.RoundToEven(float64(nMerge)*0.05)), 1)
+	refHeight := tree.Height[refMerge-1]
+	maxHeight := tree.Height[nMerge-1]
+	cutHeight := opts.CutHeight
+	if cutHeight == 0 {
+		cutHeight = 0.99*(maxHeight-refHeight) + refHeight
+	} else if cutHeight > maxHeight {
+		cutHeight = maxHeight
+	}
+	maxPamDist := cutHeight
+
+	nMergeBelowCut := 0
+	for _, h := range tree.Height {
+		if h <= cutHeight {
+			nMergeBelowCut++
+		}
+	}
+	if nMergeBelowCut < minSize {
+		return labels
+	}
+
+	maxCoreScatter := defaultMaxCoreScatter[opts.DeepSplit]
+	minGap := (1 - maxCoreScatter) * 3 / 4
+	maxAbsCoreScatter := refHeight + maxCoreScatter*(cutHeight-refHeight)
+	minAbsGap := minGap * (cutHeight - refHeight)
+	minAbsSplitHeight := refHeight
+
+	var branches []*hybridBranch
+	// mergeBranch[k] is the branch formed by merge k; onBranch[g] the
+	// composite branch gene g was added to directly (-1 if none).
+	mergeBranch := make([]int, nMerge)
+	onBranch := make([]int, nPoints)
+	for g := range onBranch {
+		onBranch[g] = -1
+	}
+	// fails reports whether a basic branch fails to be a module at
+	// height, and whether it fails only by its size.
+	fails := func(b *hybridBranch, height float64) (fail, onlySize bool) {
+		if !b.isBasic {
+			return false, false
+		}
+		scatter := coreScatter(d, b, minSize)
+		tooScattered := scatter > maxAbsCoreScatter
+		noGap := height-scatter < minAbsGap
+		fail = b.size < minSize || tooScattered || noGap || height < minAbsSplitHeight
+		return fail, !(tooScattered || noGap)
+	}
+
+	for m := 0; m < nMerge; m++ {
+		height := tree.Height[m]
+		if height > cutHeight {
+			break
+		}
+		x, y := tree.Merge[m][0], tree.Merge[m][1]
+		switch {
+		case x < 0 && y < 0:
+			// Two genes start a new basic branch.
+			branches = append(branches, &hybridBranch{
+				isBasic: true, isTopBasic: true, attachHeight: math.NaN(),
+				size: 2, singletons: []int{-x - 1, -y - 1},
+			})
+			mergeBranch[m] = len(branches) - 1
+		case x < 0 || y < 0:
+			// A gene joins a branch.
+			gene, clust := -min(x, y)-1, mergeBranch[max(x, y)-1]
+			b := branches[clust]
+			if b.isBasic {
+				b.singletons = append(b.singletons, gene)
+			} else {
+				onBranch[gene] = clust
+			}
+			b.size++
+			mergeBranch[m] = clust
+		default:
+			c1, c2 := mergeBranch[x-1], mergeBranch[y-1]
+			small, large := c1, c2
+			if branches[c2].size < branches[c1].size {
+				small, large = c2, c1
+			}
+			doMerge, failOnlySize := false, false
+			if fail, onlySize := fails(branches[small], height); fail {
+				doMerge, failOnlySize = true, onlySize
+			} else if fail, onlySize := fails(branches[large], height); fail {
+				doMerge, failOnlySize = true, onlySize
+				small, large = large, small
+			}
+
+			if doMerge {
+				// The failed branch joins the other one and is closed.
+				s, l := branches[small], branches[large]
+				s.failSize = failOnlySize
+				s.attachHeight = height
+				s.isTopBasic = false
+				if l.isBasic {
+					l.singletons = append(l.singletons, s.singletons...)
+				} else {
+					for _, g := range s.singletons {
+						onBranch[g] = large
+					}
+				}
+				l.size += s.size
+				mergeBranch[m] = large
+				break
+			}
+
+			// Both are modules (or composite): start or extend a composite branch.
+			if branches[large].isBasic && !branches[small].isBasic {
+				small, large = large, small
+			}
+			s, l := branches[small], branches[large]
+			basicOf := func(clust int) []int {
+				if branches[clust].isBasic {
+					return []int{clust}
+				}
+				return branches[clust].basicClusters
+			}
+			if l.isBasic || (opts.PAMStage && opts.PAMRespectsDendro) {
+				s.attachHeight, l.attachHeight = height, height
+				basic := append(append([]int(nil), basicOf(small)...), basicOf(large)...)
+				branches = append(branches, &hybridBranch{
+					attachHeight: math.NaN(), size: s.size + l.size, basicClusters: basic,
+				})
+				mergeBranch[m] = len(branches) - 1
+			} else {
+				l.basicClusters = append(l.basicClusters, basicOf(small)...)
+				l.size += s.size
+				s.attachHeight = height
+				mergeBranch[m] = large
+			}
+		}
+	}
+
+	// The modules are the top basic branches that pass every criterion.
+	smallLabels := make([]int, nPoints)
+	isCluster := make([]bool, len(branches))
+	for k, b := range branches {
+		if math.IsNaN(b.attachHeight) {
+			b.attachHeight = cutHeight
+		}
+		if b.isTopBasic {
+			scatter := coreScatter(d, b, minSize)
+			isCluster[k] = b.size >= minSize && scatter < maxAbsCoreScatter && b.attachHeight-scatter > minAbsGap
+		}
+		if b.failSize {
+			for _, g := range b.singletons {
+				smallLabels[g] = k + 1
+			}
+		}
+	}
+	branchLabel := make([]int, len(branches))
+	numLabels := 0
+	for k, b := range branches {
+		if !isCluster[k] {
+			continue
+		}
+		numLabels++
+		for _, g := range b.singletons {
+			labels[g] = numLabels
+			smallLabels[g] = 0
+		}
+		branchLabel[k] = numLabels
+	}
+	if !opts.PAMStage || numLabels == 0 {
+		return labels
+	}
+
+	// PAM stage: assign the remaining genes to the module at the smallest
+	// mean distance, if that is below the module's diameter (the largest
+	// mean distance of one of its genes to the others) or the cut height.
+	labeled := append([]int(nil), labels...)
+	members := make([][]int, numLabels+1)
+	for g, label := range labeled {
+		members[label] = append(members[label], g)
+	}
+	diameter := make([]float64, numLabels+1)
+	for label := 1; label <= numLabels; label++ {
+		genes := members[label]
+		if len(genes) < 2 {
+			continue
+		}
+		for _, i := range genes {
+			var sum float64
+			for _, j := range genes {
+				sum += d.At(i, j)
+			}
+			diameter[label] = max(diameter[label], sum/float64(len(genes)-1))
+		}
+	}
+	// labelsOnBranch lists the modules a gene directly on branch may join.
+	labelsOnBranch := func(branch int) []int {
+		var out []int
+		if !opts.PAMRespectsDendro {
+			for label := 1; label <= numLabels; label++ {
+				out = append(out, label)
+			}
+			return out
+		}
+		if branch < 0 {
+			return nil
+		}
+		for _, basic := range branches[branch].basicClusters {
+			if label := branchLabel[basic]; label > 0 {
+				out = append(out, label)
+			}
+		}
+		return out
+	}
+	// nearest returns the candidate module with the smallest mean of
+	// meanDist(g) over its genes g.
+	nearest := func(candidates []int, meanDist func(g int) float64) (int, float64) {
+		best, bestDist := 0, math.Inf(1)
+		for _, label := range candidates {
+			var sum float64
+			for _, g := range members[label] {
+				sum += meanDist(g)
+			}
+			if dist := sum / float64(len(members[label])); dist < bestDist {
+				best, bestDist = label, dist
+			}
+		}
+		return best, bestDist
+	}
+	closeEnough := func(label int, dist float64) bool {
+		return label > 0 && (dist < diameter[label] || dist < maxPamDist)
+	}
+
+	// Small branches that failed only by their size move as a whole.
+	small := make(map[int][]int)
+	var smallIDs []int
+	for g, s := range smallLabels {
+		if s == 0 {
+			continue
+		}
+		if _, ok := small[s]; !ok {
+			smallIDs = append(smallIDs, s)
+		}
+		small[s] = append(small[s], g)
+	}
+	sort.Ints(smallIDs)
+	for _, s := range smallIDs {
+		genes := small[s]
+		var candidates []int
+		if opts.PAMRespectsDendro {
+			candidates = labelsOnBranch(onBranch[genes[0]])
+		} else {
+			candidates = labelsOnBranch(-1)
+		}
+		label, dist := nearest(candidates, func(g int) float64 {
+			var sum float64
+			for _, i := range genes {
+				sum += d.At(i, g)
+			}
+			return sum / float64(len(genes))
+		})
+		if closeEnough(label, dist) {
+			for _, g := range genes {
+				labels[g] = label
+			}
+		} else {
+			for _, g := range genes {
+				labels[g] = -1 // not assigned gene by gene below
+			}
+		}
+	}
+	for g := range labels {
+		if labels[g] != 0 {
+			continue
+		}
+		label, dist := nearest(labelsOnBranch(onBranch[g]), func(j int) float64 { return d.At(g, j) })
+		if closeEnough(label, dist) {
+			labels[g] = label
+		}
+	}
+	for g := range labels {
+		labels[g] = max(labels[g], 0)
+	}
+	return labels
+}
+
+// cutTreeMethod is the "tree" method: a static cut at CutHeight keeps the
+// branches of at least MinClusterSize genes, then every cluster is split
+// at the breakpoints of its height profile (the joining heights of
+// neighbouring genes in dendrogram order): the gaps above its mean height
+// (or, with DeepSplit 0, above the midpoint of its mean and maximum
+// heights). A split is kept if at least two of the pieces have
+// MinClusterSize genes; those pieces are split again in turn, and the
+// genes of the smaller pieces are left unassigned.
+func cutTreeMethod(tree *Dendrogram, opts TreeCutOptions) []int {
+	n := tree.Size()
+	labels := make([]int, n)
+	cutHeight := opts.CutHeight
+	if cutHeight == 0 {
+		cutHeight = 0.99
+	}
+	// leaves[k] is the gene at position k of the dendrogram order, and
+	// gaps[k] the height at which leaves k and k+1 are joined.
+	leaves := make([]int, n)
+	for k, leaf := range tree.Order {
+		leaves[k] = leaf - 1
+	}
+	gaps := orderGaps(tree)
+
+	numLabels := 0
+	var split func(from, to int)
+	split = func(from, to int) {
+		var runs [][2]int
+		if to-from > 1 {
+			var sum, top float64
+			for _, h := range gaps[from : to-1] {
+				sum += h
+				top = max(top, h)
+			}
+			level := sum / float64(to-from-1)
+			if opts.DeepSplit == 0 {
+				level = (level + top) / 2
+			}
+			runs = significantRuns(gaps, from, to, level, opts.MinClusterSize)
+		}
+		if len(runs) < 2 {
+			numLabels++
+			for _, g := range leaves[from:to] {
+				labels[g] = numLabels
+			}
+			return
+		}
+		for _, run := range runs {
+			split(run[0], run[1])
+		}
+	}
+	for _, run := range significantRuns(gaps, 0, n, cutHeight, opts.MinClusterSize) {
+		split(run[0], run[1])
+	}
+	return labels
+}
+
+// significantRuns cuts the leaves from..to-1 at the gaps above level and
+// returns the pieces of at least minSize leaves, as [start, end) ranges.
+func significantRuns(gaps []float64, from, to int, level float64, minSize int) [][2]int {
+	var runs [][2]int
+	start := from
+	for k := from; k < to; k++ {
+		if k == to-1 || gaps[k] > level {
+			if k+1-start >= minSize {
+				runs = append(runs, [2]int{start, k + 1})
+			}
+			start = k + 1
+		}
+	}
+	return runs
+}
+
+// orderGaps returns the height at which each pair of neighbouring leaves
+// of the dendrogram order is joined: the height of their lowest common
+// merge, which is the merge whose left subtree ends at the first leaf.
+func orderGaps(tree *Dendrogram) []float64 {
+	n := tree.Size()
+	gaps := make([]float64, max(n-1, 0))
+	if n < 2 {
+		return gaps
+	}
+	sizes := make([]int, len(tree.Merge))
+	subtreeSize := func(node int) int {
+		if node < 0 {
+			return 1
+		}
+		return sizes[node-1]
+	}
+	for k, pair := range tree.Merge {
+		sizes[k] = subtreeSize(pair[0]) + subtreeSize(pair[1])
+	}
+	// Each merge covers the leaves from start on, its left subtree first.
+	type span struct{ node, start int }
+	stack := []span{{len(tree.Merge), 0}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if s.node < 0 {
+			continue
+		}
+		pair := tree.Merge[s.node-1]
+		leftSize := subtreeSize(pair[0])
+		gaps[s.start+leftSize-1] = tree.Height[s.node-1]
+		stack = append(stack, span{pair[0], s.start}, span{pair[1], s.start + leftSize})
+	}
+	return gaps
+}
+
+// relabelBySize numbers the modules by decreasing size (ties keep their
+// order), leaving UnassignedModule as is.
+func relabelBySize(labels []int) []int {
+	sizes := make(map[int]int)
+	var modules []int
+	for _, label := range labels {
+		if label == UnassignedModule {
+			continue
+		}
+		if sizes[label] == 0 {
+			modules = append(modules, label)
+		}
+		sizes[label]++
+	}
+	sort.Ints(modules)
+	sort.SliceStable(modules, func(i, j int) bool { return sizes[modules[i]] > sizes[modules[j]] })
+	rank := make(map[int]int, len(modules))
+	for k, label := range modules {
+		rank[label] = k + 1
+	}
+	out := make([]int, len(labels))
+	for g, label := range labels {
+		out[g] = rank[label]
+	}
+	return out
+}
+
+// WriteModulesCSV saves the module label of every gene with the columns
+// of gene_modules.csv (GeneID, Module_Label), sorted by label; genes with
+// the same label keep their order.
+func WriteModulesCSV(filePath string, genes []string, labels []int) error {
+	return writeModulesCSV(filePath, genes, labels, false)
+}
+
+// WriteModuleColorsCSV is WriteModulesCSV with a third column,
+// Module_Color, holding the colour of each label (see ModuleColor).
+// ReadModulesCSV reads it too.
+func WriteModuleColorsCSV(filePath string, genes []string, labels []int) error {
+	return writeModulesCSV(filePath, genes, labels, true)
+}
+
+func writeModulesCSV(filePath string, genes []string, labels []int, colors bool) error {
+	if len(genes) != len(labels) {
+		return fmt.Errorf("%d genes but %d module labels", len(genes), len(labels))
+	}
+	order := make([]int, len(genes))
+	for g := range order {
+		order[g] = g
+	}
+	sort.SliceStable(order, func(i, j int) bool { return labels[order[i]] < labels[order[j]] })
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	header := []string{"GeneID", "Module_Label"}
+	if colors {
+		header = append(header, "Module_Color")
+	}
+	w.Write(header)
+	for _, g := range order {
+		record := []string{genes[g], strconv.Itoa(labels[g])}
+		if colors {
+			record = append(record, ModuleColor(labels[g]))
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// ReadModulesCSV loads a gene_modules.csv file (GeneID, Module_Label) and
+// returns the label of every gene.
+func ReadModulesCSV(filePath string) (map[string]int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(bufio.NewReader(file))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read header: %w", filePath, err)
+	}
+	if len(header) < 2 || header[0] != "GeneID" || header[1] != "Module_Label" {
+		return nil, fmt.Errorf("%s: expected the columns GeneID,Module_Label, got %v", filePath, header)
+	}
+	labels := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return labels, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		label, err := strconv.Atoi(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: gene %s: invalid module label %q", filePath, record[0], record[1])
+		}
+		if _, dup := labels[record[0]]; dup {
+			return nil, fmt.Errorf("%s: gene %s is listed twice", filePath, record[0])
+		}
+		labels[record[0]] = label
+	}
+}
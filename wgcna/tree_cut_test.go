@@ -0,0 +1,135 @@
+package wgcna
+
+import (
+	"slices"
+	"testing"
+)
+
+// twoModules is the average-linkage tree of two groups of points on a
+// line, genes 1-5 and 6-8, and an outlier, gene 9. Its joining heights
+// are 0.01, 0.02, 0.025, 0.04, 0.0467, 0.085 (the last gene of the first
+// group), 0.3813 (the two groups) and 0.785 (the outlier), and its order
+// is 9 8 6 7 5 4 3 1 2.
+func twoModules(t *testing.T) (*Dendrogram, *NetworkMatrix) {
+	t.Helper()
+	dist := lineDistances([]float64{0, 0.01, 0.03, 0.06, 0.11, 0.40, 0.42, 0.45, -0.6})
+	tree, err := HierarchicalCluster(dist, AverageLinkage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{9, 8, 6, 7, 5, 4, 3, 1, 2}; !slices.Equal(tree.Order, want) {
+		t.Fatalf("order = %v, want %v", tree.Order, want)
+	}
+	return tree, dist
+}
+
+func TestCutTreeDynamicHybrid(t *testing.T) {
+	// The default cut height is 0.01 + 0.99 * (0.785 - 0.01) = 0.77725,
+	// below the join of the outlier, so the outlier is on no branch. With
+	// deepSplit 2 a module needs a core scatter below 0.6391 and a gap of
+	// 0.1036 to its joining height: the cores of the groups (the first 4
+	// and 3 genes) have a scatter of 0.0333 and join at 0.3813, so both
+	// are modules. The outlier is 0.642 from the first group on average,
+	// within the cut height, and 1.023 from the second.
+	tree, dist := twoModules(t)
+	tests := []struct {
+		name string
+		opts TreeCutOptions
+		want []int
+	}{
+		{
+			name: "no PAM",
+			opts: TreeCutOptions{DeepSplit: 2, MinClusterSize: 3},
+			want: []int{1, 1, 1, 1, 1, 2, 2, 2, 0},
+		},
+		{
+			name: "PAM",
+			opts: TreeCutOptions{DeepSplit: 2, MinClusterSize: 3, PAMStage: true},
+			want: []int{1, 1, 1, 1, 1, 2, 2, 2, 1},
+		},
+		{
+			// The outlier is on no branch, so no module is on its branch.
+			name: "PAM respecting the dendrogram",
+			opts: TreeCutOptions{DeepSplit: 2, MinClusterSize: 3, PAMStage: true, PAMRespectsDendro: true},
+			want: []int{1, 1, 1, 1, 1, 2, 2, 2, 0},
+		},
+		{
+			// The second group fails only by its size and joins the first:
+			// the core of the 8 genes has a scatter of 0.1553.
+			name: "groups below the minimum size",
+			opts: TreeCutOptions{DeepSplit: 2, MinClusterSize: 6},
+			want: []int{1, 1, 1, 1, 1, 1, 1, 1, 0},
+		},
+		{
+			// Only 7 merges are below the cut height.
+			name: "minimum size above the merges",
+			opts: TreeCutOptions{DeepSplit: 2, MinClusterSize: 8},
+			want: []int{0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		labels, err := CutTreeDynamic(tree, dist, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !slices.Equal(labels, tt.want) {
+			t.Errorf("%s: labels = %v, want %v", tt.name, labels, tt.want)
+		}
+	}
+}
+
+func TestCutTreeDynamicTreeMethod(t *testing.T) {
+	// No height is above the default cut height of 0.99, so the whole
+	// order is split. Its mean gap is 1.393 / 8 = 0.1741: the gaps above
+	// it (0.785 and 0.3813) leave the outlier and the two groups; neither
+	// group has two pieces of 3 genes to split into. With deepSplit 0
+	// the level is (0.1741 + 0.785) / 2: only the outlier is cut off,
+	// which leaves one piece, so the order is not split at all.
+	tree, _ := twoModules(t)
+	tests := []struct {
+		deepSplit int
+		want      []int
+	}{
+		{2, []int{1, 1, 1, 1, 1, 2, 2, 2, 0}},
+		{0, []int{1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		labels, err := CutTreeDynamic(tree, nil, TreeCutOptions{Method: TreeMethodCut, DeepSplit: tt.deepSplit, MinClusterSize: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(labels, tt.want) {
+			t.Errorf("deepSplit %d: labels = %v, want %v", tt.deepSplit, labels, tt.want)
+		}
+	}
+}
+
+func TestRelabelBySize(t *testing.T) {
+	tests := []struct {
+		labels, want []int
+	}{
+		{[]int{3, 1, 3, 0, 2, 2, 3}, []int{1, 3, 1, 0, 2, 2, 1}},
+		// Equal sizes keep the order of the labels.
+		{[]int{5, 2, 5, 2, 0}, []int{2, 1, 2, 1, 0}},
+		{[]int{0, 0}, []int{0, 0}},
+	}
+	for _, tt := range tests {
+		if got := relabelBySize(tt.labels); !slices.Equal(got, tt.want) {
+			t.Errorf("relabelBySize(%v) = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestCutTreeDynamicChecksGenes(t *testing.T) {
+	tree, dist := twoModules(t)
+	other := lineDistances(make([]float64, tree.Size()))
+	other.Genes[0] = "X"
+	for _, d := range []*NetworkMatrix{lineDistances(make([]float64, 3)), other} {
+		if _, err := CutTreeDynamic(tree, d, TreeCutOptions{MinClusterSize: 3}); err == nil {
+			t.Errorf("%d genes %v: no error for a dissimilarity matrix of other genes", d.Size(), d.Genes)
+		}
+	}
+	if _, err := CutTreeDynamic(tree, dist, TreeCutOptions{DeepSplit: 5}); err == nil {
+		t.Error("no error for deepSplit 5")
+	}
+}
@@ -0,0 +1,344 @@
+package wgcna
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// ExpressionMatrix is a gene x sample matrix of log2(TPM+1) values,
+// as produced by Phase 1.
+type ExpressionMatrix struct {
+	Genes   []string
+	Samples []string
+	// Data[g][s] is the value of gene g in sample s.
+	Data [][]float64
+	// Stats records how the Phase 1 filters produced the matrix; nil if
+	// that is unknown (e.g. for a subset).
+	Stats *FilterStats
+}
+
+// FilterStats counts the genes left after each step of Phase 1.
+type FilterStats struct {
+	Samples int `json:"samples"`
+	// GenesInFile is the number of gene rows read from the GCT file;
+	// SkippedLines the number of unreadable lines.
+	GenesInFile  int `json:"genes_in_file"`
+	SkippedLines int `json:"skipped_lines"`
+	// GenesWithLength have a gene length in the GTF, which TPM needs.
+	GenesWithLength         int `json:"genes_with_length"`
+	GenesAfterLowExpression int `json:"genes_after_low_expression_filter"`
+	GenesAfterLowVariance   int `json:"genes_after_low_variance_filter"`
+}
+
+// NumGenes returns the number of rows.
+func (e *ExpressionMatrix) NumGenes() int { return len(e.Genes) }
+
+// NumSamples returns the number of columns.
+func (e *ExpressionMatrix) NumSamples() int { return len(e.Samples) }
+
+// Validate checks that the labels match the shape of Data.
+func (e *ExpressionMatrix) Validate() error {
+	if len(e.Data) != len(e.Genes) {
+		return fmt.Errorf("expression matrix has %d rows but %d gene labels", len(e.Data), len(e.Genes))
+	}
+	for i, row := range e.Data {
+		if len(row) != len(e.Samples) {
+			return fmt.Errorf("expression row %d (%s) has %d values but there are %d samples",
+				i, e.Genes[i], len(row), len(e.Samples))
+		}
+	}
+	return nil
+}
+
+// WriteCSV saves the matrix with a gene_id column and one column per sample.
+func (e *ExpressionMatrix) WriteCSV(path string) error {
+	return WriteOutputCSV(path, e.Data, e.Genes, e.Samples)
+}
+
+// NetworkMatrix is a symmetric gene x gene matrix: a correlation,
+// adjacency, TOM or dissimilarity matrix. Rows and columns share the
+// labels in Genes; the values are stored packed (see SymMatrix).
+type NetworkMatrix struct {
+	Genes []string
+	Data  *SymMatrix
+}
+
+// NewNetworkMatrix allocates a zero n x n matrix for the given genes.
+func NewNetworkMatrix(genes []string) *NetworkMatrix {
+	return &NetworkMatrix{Genes: genes, Data: NewSymMatrix(len(genes))}
+}
+
+// Size returns the number of genes (rows and columns).
+func (m *NetworkMatrix) Size() int { return len(m.Genes) }
+
+// At returns the value at row i, column j.
+func (m *NetworkMatrix) At(i, j int) float64 { return m.Data.At(i, j) }
+
+// Set writes v at (i, j), which is also (j, i).
+func (m *NetworkMatrix) Set(i, j int, v float64) { m.Data.Set(i, j, v) }
+
+// Close releases the file behind a disk-backed matrix (see SymMatrix.Close).
+func (m *NetworkMatrix) Close() error { return m.Data.Close() }
+
+// WriteCSV saves the matrix with gene labels as header row and first column.
+func (m *NetworkMatrix) WriteCSV(path string) error {
+	return WriteCorrelationMatrix(path, m.Data, m.Genes)
+}
+
+// FilterOptions controls the two gene filters of Phase 1.
+type FilterOptions struct {
+	// A gene is dropped if at least this fraction of samples has log2(TPM+1) < 1.
+	LowExpressionThreshold float64
+	// This lower fraction of the remaining genes, ranked by variance, is dropped.
+	LowVariancePercentile float64
+}
+
+// DefaultFilterOptions returns the thresholds used for the thyroid analysis.
+func DefaultFilterOptions() FilterOptions {
+	return FilterOptions{LowExpressionThreshold: 0.9, LowVariancePercentile: 0.25}
+}
+
+// Validate checks that both thresholds are usable fractions.
+func (o FilterOptions) Validate() error {
+	// Every sample would count as "low" with a threshold of 0, which drops every gene.
+	if t := o.LowExpressionThreshold; !(t > 0 && t <= 1) {
+		return fmt.Errorf("low expression threshold must be in (0, 1], got %v", t)
+	}
+	if p := o.LowVariancePercentile; !(p >= 0 && p < 1) {
+		return fmt.Errorf("low variance percentile must be in [0, 1), got %v", p)
+	}
+	return nil
+}
+
+// CorrelationMethod selects the correlation computed in Phase 2.
+type CorrelationMethod string
+
+const (
+	// Pearson is the product-moment correlation.
+	Pearson CorrelationMethod = "pearson"
+	// Bicor is the biweight midcorrelation, which down-weights outlier samples.
+	Bicor CorrelationMethod = "bicor"
+	// Spearman is the Pearson correlation of ranks (ties get average ranks).
+	Spearman CorrelationMethod = "spearman"
+	// Kendall is Kendall's tau-b. It needs memory quadratic in the number of
+	// samples, so it is limited to KendallMaxSamples samples.
+	Kendall CorrelationMethod = "kendall"
+)
+
+// CorrelationMethods lists every supported correlation method.
+var CorrelationMethods = []CorrelationMethod{Pearson, Bicor, Spearman, Kendall}
+
+// KendallMaxSamples is the largest cohort Kendall's tau-b is computed for.
+const KendallMaxSamples = 200
+
+// PearsonFallback says what bicor does for a gene whose median absolute
+// deviation is zero. The names match the pearsonFallback argument of R WGCNA.
+type PearsonFallback string
+
+const (
+	// FallbackIndividual uses the Pearson normalization for such genes only.
+	FallbackIndividual PearsonFallback = "individual"
+	// FallbackNone leaves their correlations at 0 (R returns NA).
+	FallbackNone PearsonFallback = "none"
+)
+
+// CorrelationOptions controls Phase 2.
+type CorrelationOptions struct {
+	// Method defaults to Pearson when empty.
+	Method CorrelationMethod
+	// MaxPOutliers only applies to Bicor: at most this fraction of samples on
+	// each side of the median is treated as outliers (given zero weight).
+	// 1, the default when 0, places no limit.
+	MaxPOutliers float64
+	// PearsonFallback only applies to Bicor; empty means FallbackIndividual.
+	PearsonFallback PearsonFallback
+	// Precision is the storage precision of the correlation matrix and of the
+	// adjacency, TOM and dissimilarity matrices derived from it; empty means Float64.
+	Precision Precision
+	// Storage decides whether the correlation matrix and the matrices
+	// derived from it are held in RAM or in memory-mapped files.
+	Storage MatrixStorage
+	// Workers is the number of goroutines; 0 means runtime.NumCPU().
+	Workers int
+}
+
+// withDefaults fills in the zero values.
+func (o CorrelationOptions) withDefaults() CorrelationOptions {
+	if o.Method == "" {
+		o.Method = Pearson
+	}
+	if o.MaxPOutliers == 0 {
+		o.MaxPOutliers = 1
+	}
+	if o.PearsonFallback == "" {
+		o.PearsonFallback = FallbackIndividual
+	}
+	if o.Precision == "" {
+		o.Precision = Float64
+	}
+	return o
+}
+
+// Validate checks the method and the bicor parameters.
+func (o CorrelationOptions) Validate() error {
+	o = o.withDefaults()
+	switch o.Method {
+	case Pearson, Bicor, Spearman, Kendall:
+	default:
+		return fmt.Errorf("unknown correlation method %q", o.Method)
+	}
+	if p := o.MaxPOutliers; !(p > 0 && p <= 1) {
+		return fmt.Errorf("maxPOutliers must be in (0, 1], got %v", p)
+	}
+	switch o.PearsonFallback {
+	case FallbackIndividual, FallbackNone:
+	default:
+		return fmt.Errorf("unknown Pearson fallback %q", o.PearsonFallback)
+	}
+	switch o.Precision {
+	case Float64, Float32:
+	default:
+		return fmt.Errorf("unknown precision %q", o.Precision)
+	}
+	if o.Storage.MemoryBudget < 0 {
+		return fmt.Errorf("memory budget must be >= 0, got %d", o.Storage.MemoryBudget)
+	}
+	return nil
+}
+
+// Precision is the storage precision of a network matrix.
+type Precision string
+
+const (
+	// Float64 stores every value in double precision.
+	Float64 Precision = "float64"
+	// Float32 stores values in single precision, which halves the memory of
+	// every network matrix. Sums (covariances, connectivities and the
+	// shared-neighbour sums of the TOM) are still accumulated in float64;
+	// only the stored results are rounded, to about 7 significant digits.
+	Float32 Precision = "float32"
+)
+
+// Precisions lists every supported precision.
+var Precisions = []Precision{Float64, Float32}
+
+// bytes returns the size of one stored value.
+func (p Precision) bytes() int {
+	if p == Float32 {
+		return 4
+	}
+	return 8
+}
+
+// MatrixStorage decides where network matrices are allocated.
+type MatrixStorage struct {
+	// MemoryBudget is the number of bytes of network matrices a phase may
+	// hold in RAM: its input plus its output, and for the TOM the row
+	// panels of its workers (64 full float64 rows per panel, 2 per worker,
+	// 3 for a signed TOM). An output that would exceed it is backed by a
+	// memory-mapped file in Dir, which the operating system pages to disk
+	// as needed. 0 means no limit.
+	MemoryBudget int64
+	// Dir receives the backing files; empty means os.TempDir(). The files
+	// are unlinked as soon as they are mapped, so none are left behind.
+	Dir string
+}
+
+// NetworkType selects how correlations are turned into adjacencies.
+type NetworkType string
+
+// The names match the networkType argument of R WGCNA, so results can be
+// compared with R runs.
+const (
+	// Unsigned treats negative and positive correlations alike: a = |r|^beta.
+	Unsigned NetworkType = "unsigned"
+	// Signed maps r from [-1, 1] to [0, 1] first: a = ((1 + r) / 2)^beta.
+	Signed NetworkType = "signed"
+	// SignedHybrid keeps positive correlations only: a = r^beta if r > 0, else 0.
+	SignedHybrid NetworkType = "signed hybrid"
+)
+
+// NetworkTypes lists every supported network type.
+var NetworkTypes = []NetworkType{Unsigned, Signed, SignedHybrid}
+
+// AdjacencyOptions controls Phase 3.
+type AdjacencyOptions struct {
+	Type NetworkType
+	// Beta is the soft-thresholding power.
+	Beta float64
+}
+
+// DefaultAdjacencyOptions returns the settings used for the thyroid analysis.
+func DefaultAdjacencyOptions() AdjacencyOptions {
+	return AdjacencyOptions{Type: SignedHybrid, Beta: 6}
+}
+
+// Validate checks the network type and the power.
+func (o AdjacencyOptions) Validate() error {
+	switch o.Type {
+	case Unsigned, Signed, SignedHybrid:
+	default:
+		return fmt.Errorf("unknown network type %q", o.Type)
+	}
+	if !(o.Beta > 0) {
+		return fmt.Errorf("beta must be > 0, got %v", o.Beta)
+	}
+	return nil
+}
+
+// TOMType selects the topological overlap computed in Phase 4. The names
+// match the TOMType argument of R WGCNA.
+type TOMType string
+
+const (
+	// UnsignedTOM uses the adjacencies as they are.
+	UnsignedTOM TOMType = "unsigned"
+	// SignedTOM gives every adjacency the sign of its correlation and
+	// takes the absolute value of the shared-neighbour sum, so neighbours
+	// that pull two genes in opposite directions lower their overlap.
+	SignedTOM TOMType = "signed"
+)
+
+// TOMTypes lists every supported TOM type.
+var TOMTypes = []TOMType{UnsignedTOM, SignedTOM}
+
+// TOMOptions controls Phase 4.
+type TOMOptions struct {
+	// Type defaults to UnsignedTOM when empty.
+	Type TOMType
+	// Correlation is the correlation matrix the adjacency was built from,
+	// which a signed TOM takes the signs of the adjacencies from; the
+	// unsigned TOM ignores it. Only the adjacencies of an unsigned network
+	// lose their sign: those of signed and signed hybrid networks already
+	// keep negative correlations low, and R gives them the same signed and
+	// unsigned TOM, so leave Correlation nil for them.
+	Correlation *NetworkMatrix
+	// Workers is the number of goroutines; 0 means runtime.NumCPU().
+	Workers int
+}
+
+// withDefaults fills in the zero values.
+func (o TOMOptions) withDefaults() TOMOptions {
+	if o.Type == "" {
+		o.Type = UnsignedTOM
+	}
+	return o
+}
+
+// Validate checks the TOM type.
+func (o TOMOptions) Validate() error {
+	switch o.withDefaults().Type {
+	case UnsignedTOM, SignedTOM:
+	default:
+		return fmt.Errorf("unknown TOM type %q", o.Type)
+	}
+	return nil
+}
+
+// workerCount turns a Workers option into an actual goroutine count.
+func workerCount(workers int) int {
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}